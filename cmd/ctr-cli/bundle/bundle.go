@@ -0,0 +1,208 @@
+package bundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/load"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bundle"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/server"
+	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var logger = log.G(context.TODO())
+
+func Command() *cli.Command {
+	cmd := cli.Command{
+		Name:  "bundle",
+		Usage: "Offline bundle related commands",
+		Subcommands: []*cli.Command{
+			createCommand(),
+			importCommand(),
+		},
+	}
+	return &cmd
+}
+
+func createCommand() *cli.Command {
+	cmd := cli.Command{
+		Name:  "create",
+		Usage: "Create a bundle to update an image from the local version",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "storeDir",
+				Usage:    "path to DimgStore with tags (the server must be stopped)",
+				Value:    server.ImageStorePath,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "from",
+				Usage:    "version of the image on the target node. the bundle includes the base image if not specified",
+				Value:    "",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "to",
+				Usage:    "image tag (name:version) to be imported",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "out",
+				Usage:    "path to output bundle",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:     "threadNum",
+				Usage:    "The number of threads to merge diffs",
+				Value:    8,
+				Required: false,
+			},
+		},
+		Action: createAction,
+	}
+	return &cmd
+}
+
+func createAction(c *cli.Context) error {
+	logger.Logger.SetLevel(logrus.InfoLevel)
+	toTag := c.String("to")
+	toNames := strings.Split(toTag, ":")
+	if len(toNames) != 2 {
+		return fmt.Errorf("invalid image name %s", toTag)
+	}
+
+	store, err := image.NewDimgStore(c.String("storeDir"))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	fromId := digest.Digest("")
+	if from := c.String("from"); from != "" {
+		fromTag := toNames[0] + ":" + from
+		var ok bool
+		fromId, ok = store.GetTag(fromTag)
+		if !ok {
+			return fmt.Errorf("tag %s not found", fromTag)
+		}
+	}
+
+	pm, err := bsdiffx.LoadOrDefaultPlugins("")
+	if err != nil {
+		return err
+	}
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	mc := image.MergeConfig{
+		ThreadNum:              c.Int("threadNum"),
+		MergeDimgConcurrentNum: 4,
+		Progress:               progress,
+	}
+
+	tmpDir, err := os.MkdirTemp("", "d4c-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	out, err := os.Create(c.String("out"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	manifest, err := bundle.Create(store, fromId, toTag, tmpDir, mc, pm, out)
+	if err != nil {
+		return err
+	}
+	for _, d := range manifest.Dimgs {
+		logger.Infof("bundled %s (Id=%s ParentId=%s size=%d)", d.Tag, d.Id, d.ParentId, d.Blob.Size)
+	}
+
+	return nil
+}
+
+func importCommand() *cli.Command {
+	cmd := cli.Command{
+		Name:  "import",
+		Usage: "Verify a bundle and load its images into containerd",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "bundle",
+				Usage:    "path to bundle",
+				Required: true,
+			},
+		},
+		Action: importAction,
+	}
+	return &cmd
+}
+
+func importAction(c *cli.Context) error {
+	logger.Logger.SetLevel(logrus.InfoLevel)
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	bundleFile, err := os.Open(c.String("bundle"))
+	if err != nil {
+		return err
+	}
+	defer bundleFile.Close()
+
+	// dimgs are moved into the snapshotter's store from here
+	tmpDir := filepath.Join(os.TempDir(), utils.GetRandomId("d4c-bundle"))
+	defer os.RemoveAll(tmpDir)
+	manifest, err := bundle.Extract(bundleFile, tmpDir)
+	if err != nil {
+		return err
+	}
+	logger.Infof("verified bundle with %d dimgs", len(manifest.Dimgs))
+
+	snClient, err := sns.NewClient()
+	if err != nil {
+		return err
+	}
+	localDimgs, err := load.GetLocalDimgIds(c.Context, snClient)
+	if err != nil {
+		return err
+	}
+	if manifest.BaseId != "" && !slices.Contains(localDimgs, manifest.BaseId) {
+		return fmt.Errorf("image %s required by the bundle is not found", manifest.BaseId)
+	}
+
+	for _, d := range manifest.Dimgs {
+		if slices.Contains(localDimgs, d.Id) {
+			logger.Infof("%s is already loaded", d.Tag)
+			continue
+		}
+		names := strings.Split(d.Tag, ":")
+		if len(names) != 2 {
+			return fmt.Errorf("invalid image name %s", d.Tag)
+		}
+		header, err := bundle.CdimgHeader(tmpDir, d)
+		if err != nil {
+			return err
+		}
+		err = load.LoadImage(snClient, c.Context, names[0], names[1], header, bundle.DimgPath(tmpDir, d), progress)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", d.Tag, err)
+		}
+		logger.Infof("loaded %s", d.Tag)
+	}
+
+	return nil
+}
@@ -53,6 +53,11 @@ var Flags = []cli.Flag{
 		Value:    1,
 		Required: false,
 	},
+	&cli.StringFlag{
+		Name:     "profile",
+		Usage:    "path to access profile. bodies of files in the profile are placed at the front",
+		Required: false,
+	},
 }
 
 var workDir = filepath.Join(os.TempDir(), "ctr-cli", "convert")
@@ -238,9 +243,21 @@ func Action(c *cli.Context) error {
 		}
 	}
 
+	progress, err := di3fsImage.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+
 	logger.Info("packing dimg")
 	dimgPath := filepath.Join(outputPath, "image.dimg")
-	err = di3fsImage.PackDir(tempDir, dimgPath, threadNum)
+	var profile *di3fsImage.AccessProfile
+	if p := c.String("profile"); p != "" {
+		profile, err = di3fsImage.LoadAccessProfile(p)
+		if err != nil {
+			return fmt.Errorf("failed to load profile %s: %v", p, err)
+		}
+	}
+	err = di3fsImage.PackDir(c.Context, tempDir, dimgPath, threadNum, profile, progress)
 	if err != nil {
 		return fmt.Errorf("failed to pack dimg: %v", err)
 	}
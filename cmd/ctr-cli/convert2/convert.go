@@ -73,6 +73,11 @@ var Flags = []cli.Flag{
 		Value:    1,
 		Required: false,
 	},
+	&cli.StringFlag{
+		Name:     "profile",
+		Usage:    "path to access profile. bodies of files in the profile are placed at the front",
+		Required: false,
+	},
 }
 
 func action(c *cli.Context) error {
@@ -113,7 +118,18 @@ func action(c *cli.Context) error {
 		return fmt.Errorf("failed to copy layer: %v", err)
 	}
 
-	err = image.PackLayer(layer, filepath.Join(outputPath, "image.dimg"), 8)
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	var profile *image.AccessProfile
+	if p := c.String("profile"); p != "" {
+		profile, err = image.LoadAccessProfile(p)
+		if err != nil {
+			return fmt.Errorf("failed to load profile %s: %v", p, err)
+		}
+	}
+	err = image.PackLayer(c.Context, layer, filepath.Join(outputPath, "image.dimg"), 8, profile, progress)
 	if err != nil {
 		return fmt.Errorf("failed to pack layer: %v", err)
 	}
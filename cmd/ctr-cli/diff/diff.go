@@ -2,7 +2,9 @@ package diff
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/containerd/containerd/log"
@@ -80,10 +82,15 @@ func DimgCommand() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:     "deltaEncoding",
-				Usage:    "algorithm for delta encoding (bsdiffx, xdelta3, mixted)",
+				Usage:    "algorithm for delta encoding (bsdiffx, xdelta3, archive, elf, mixed). mixed routes archives and ELF files to their plugins by extension or magic",
 				Value:    "bsdiffx",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "profile",
+				Usage:    "path to access profile. bodies of files in the profile are placed at the front",
+				Required: false,
+			},
 		},
 	}
 
@@ -133,6 +140,17 @@ func dimgAction(c *cli.Context) error {
 		return err
 	}
 
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	var profile *image.AccessProfile
+	if p := c.String("profile"); p != "" {
+		profile, err = image.LoadAccessProfile(p)
+		if err != nil {
+			return fmt.Errorf("failed to load profile %s: %v", p, err)
+		}
+	}
 	dc := image.DiffConfig{
 		ThreadNum:        threadNum,
 		ScheduleMode:     threadSchedMode,
@@ -140,10 +158,12 @@ func dimgAction(c *cli.Context) error {
 		BenchmarkPerFile: enableBenchPerFile,
 		Benchmarker:      b,
 		DeltaEncoding:    c.String("deltaEncoding"),
+		Progress:         progress,
+		Profile:          profile,
 	}
-	err = image.GenerateDiffFromDimg(oldDimg, newDimg, outDimg, mode == ModeDiffBinary, dc, pm)
+	err = image.GenerateDiffFromDimg(c.Context, oldDimg, newDimg, outDimg, mode == ModeDiffBinary, dc, pm)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	elapsed := time.Since(start)
@@ -233,10 +253,15 @@ func CdimgCommand() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:     "deltaEncoding",
-				Usage:    "algorithm for delta encoding (bsdiffx, xdelta3, mixted)",
+				Usage:    "algorithm for delta encoding (bsdiffx, xdelta3, archive, elf, mixed). mixed routes archives and ELF files to their plugins by extension or magic",
 				Value:    "bsdiffx",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "profile",
+				Usage:    "path to access profile. bodies of files in the profile are placed at the front",
+				Required: false,
+			},
 		},
 	}
 
@@ -286,6 +311,17 @@ func cdimgAction(c *cli.Context) error {
 		return err
 	}
 
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	var profile *image.AccessProfile
+	if p := c.String("profile"); p != "" {
+		profile, err = image.LoadAccessProfile(p)
+		if err != nil {
+			return fmt.Errorf("failed to load profile %s: %v", p, err)
+		}
+	}
 	dc := image.DiffConfig{
 		ThreadNum:        threadNum,
 		ScheduleMode:     threadSchedMode,
@@ -293,10 +329,12 @@ func cdimgAction(c *cli.Context) error {
 		BenchmarkPerFile: enableBenchPerFile,
 		Benchmarker:      b,
 		DeltaEncoding:    c.String("deltaEncoding"),
+		Progress:         progress,
+		Profile:          profile,
 	}
-	err = image.GenerateDiffFromCdimg(oldCdimg, newCdimg, outCdimg, mode == ModeDiffBinary, dc, pm)
+	err = image.GenerateDiffFromCdimg(c.Context, oldCdimg, newCdimg, outCdimg, mode == ModeDiffBinary, dc, pm)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	elapsed := time.Since(start)
@@ -324,3 +362,138 @@ func cdimgAction(c *cli.Context) error {
 	logger.Info("diff done")
 	return nil
 }
+
+func MatrixCdimgCommand() *cli.Command {
+	cmd := cli.Command{
+		Name:  "diff-matrix",
+		Usage: "generate diff cdimgs from each of previous images in the window",
+		Action: func(context *cli.Context) error {
+			return matrixCdimgAction(context)
+		},
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     "images",
+				Usage:    "paths to cdimgs ordered from the oldest to the newest",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:     "window",
+				Usage:    "the number of previous images to generate diffs from",
+				Value:    1,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "outDir",
+				Usage:    "directory to output diff cdimgs",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "manifest",
+				Usage:    "path to manifest listing generated diffs (default: <outDir>/manifest.json)",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "mode",
+				Usage:    "diff generating mdoe",
+				Required: false,
+				Value:    ModeDiffBinary,
+			},
+			&cli.IntFlag{
+				Name:     "threadNum",
+				Usage:    "The number of threads to process",
+				Value:    1,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "threadSchedMode",
+				Usage:    "Multithread scheduling mode",
+				Value:    "none",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "compressionMode",
+				Usage:    "Mode to compress diffs",
+				Value:    "bzip2",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "deltaEncoding",
+				Usage:    "algorithm for delta encoding (bsdiffx, xdelta3, archive, elf, mixed). mixed routes archives and ELF files to their plugins by extension or magic",
+				Value:    "bsdiffx",
+				Required: false,
+			},
+			&cli.Int64Flag{
+				Name:     "bodyCacheQuotaMiB",
+				Usage:    "Memory quota in MiB for decompressed file bodies shared among diffs (0 disables cache)",
+				Value:    1024,
+				Required: false,
+			},
+		},
+	}
+
+	return &cmd
+}
+
+func matrixCdimgAction(c *cli.Context) error {
+	images := c.StringSlice("images")
+	window := c.Int("window")
+	outDir := c.String("outDir")
+	manifestPath := c.String("manifest")
+	mode := c.String("mode")
+	if manifestPath == "" {
+		manifestPath = filepath.Join(outDir, "manifest.json")
+	}
+	logger.WithFields(logrus.Fields{
+		"images": images,
+		"window": window,
+		"outDir": outDir,
+		"mode":   mode,
+	}).Info("starting to diff-matrix")
+
+	if mode != ModeDiffBinary && mode != ModeDiffFile {
+		return fmt.Errorf("mode '%s' does not exist. only 'binary-diff' or 'file-diff' is allowed", mode)
+	}
+	if len(images) < 2 {
+		return fmt.Errorf("at least 2 images are required")
+	}
+
+	pm, err := bsdiffx.LoadOrDefaultPlugins("")
+	if err != nil {
+		return err
+	}
+
+	compMode, err := bsdiffx.GetCompressMode(c.String("compressionMode"))
+	if err != nil {
+		return err
+	}
+
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", outDir, err)
+	}
+
+	dc := image.DiffConfig{
+		ThreadNum:       c.Int("threadNum"),
+		ScheduleMode:    c.String("threadSchedMode"),
+		CompressionMode: compMode,
+		DeltaEncoding:   c.String("deltaEncoding"),
+		Progress:        progress,
+		BodyCacheQuota:  c.Int64("bodyCacheQuotaMiB") * 1024 * 1024,
+	}
+	manifest, err := image.GenerateDiffMatrixFromCdimg(c.Context, images, window, outDir, mode == ModeDiffBinary, dc, pm)
+	if err != nil {
+		return err
+	}
+
+	err = manifest.Write(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	logger.Infof("%d diffs generated. manifest is written to %s", len(manifest.Deltas)-1, manifestPath)
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
 	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/sirupsen/logrus"
@@ -35,8 +36,12 @@ var Flags = []cli.Flag{
 	},
 }
 
-func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersion string, imageHeader *image.CdimgHeader, dimgPath string) error {
+func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersion string, imageHeader *image.CdimgHeader, dimgPath string, progress image.ProgressReporter) error {
 	cs := snClient.CtrClient.ContentStore()
+	// manifest, config, image and snapshot
+	pt := image.NewProgressTracker(progress, "load")
+	pt.AddTotal(4)
+	pt.SetPhase(image.PROGRESS_PHASE_PROCESS)
 
 	configSize, configDigest, err := utils.GetSizeAndDigest(imageHeader.ConfigBytes)
 	if err != nil {
@@ -90,6 +95,7 @@ func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersio
 		return err
 	}
 	log.G(ctx).Debug("load manifest done")
+	pt.FileDone("manifest", int64(len(manifestBytes)), int64(len(manifestBytes)))
 
 	err = content.WriteBlob(
 		ctx, cs, configDigest.Hex(), bytes.NewReader(imageHeader.ConfigBytes),
@@ -105,6 +111,7 @@ func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersio
 		return err
 	}
 	log.G(ctx).Debug("load config done")
+	pt.FileDone("config", int64(len(imageHeader.ConfigBytes)), int64(len(imageHeader.ConfigBytes)))
 
 	// register image
 	is := snClient.CtrClient.ImageService()
@@ -126,12 +133,15 @@ func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersio
 	if err != nil {
 		return err
 	}
+	pt.FileDone(imageName+":"+imageVersion, 0, 0)
 
 	// now ready to create snapshot
 	err = sns.CreateSnapshot(ctx, snClient.SnClient, *manifestDigest, dimgId, imageName+":"+imageVersion, dimgPath)
 	if err != nil {
 		return err
 	}
+	pt.FileDone(dimgPath, imageHeader.Head.DimgSize, imageHeader.Head.DimgSize)
+	pt.SetPhase(image.PROGRESS_PHASE_DONE)
 
 	log.G(ctx).WithFields(logrus.Fields{
 		"header":   imageHeader,
@@ -142,7 +152,53 @@ func LoadImage(snClient *sns.Client, ctx context.Context, imageName, imageVersio
 	return nil
 }
 
-func Load(ctx context.Context, imgNameWithVersion, imgPath string) error {
+// GetLocalDimgIds returns ids of dimgs loaded as di3fs images in containerd
+func GetLocalDimgIds(ctx context.Context, snClient *sns.Client) ([]digest.Digest, error) {
+	imgStore := snClient.CtrClient.ImageService()
+	images, err := imgStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contentStore := snClient.CtrClient.ContentStore()
+
+	localDimgs := make([]digest.Digest, 0)
+	for _, img := range images {
+		targetSns, ok := img.Labels[sns.TargetSnapshotLabel]
+		if !ok {
+			continue
+		}
+		if targetSns != "di3fs" {
+			continue
+		}
+		manReader, err := contentStore.ReaderAt(ctx, img.Target)
+		if err != nil {
+			log.G(ctx).Errorf("failed to reade target %s from content store: %v", img.Target.Digest, err)
+			continue
+		}
+		defer manReader.Close()
+
+		manifestBytes := make([]byte, manReader.Size())
+		_, err = manReader.ReadAt(manifestBytes, 0)
+		if err != nil {
+			log.G(ctx).Errorf("failed to ReadAll from manifest reader: %v", err)
+			continue
+		}
+
+		manifest := v1.Manifest{}
+		err = json.Unmarshal(manifestBytes, &manifest)
+		if err != nil {
+			log.G(ctx).Errorf("failed to unmarshal manifest: %v", err)
+			continue
+		}
+
+		localDimgs = append(localDimgs, manifest.Layers[0].Digest)
+	}
+
+	return localDimgs, nil
+}
+
+func Load(ctx context.Context, imgNameWithVersion, imgPath string, progress image.ProgressReporter) error {
 	snClient, err := sns.NewClient()
 	if err != nil {
 		return err
@@ -177,7 +233,7 @@ func Load(ctx context.Context, imgNameWithVersion, imgPath string) error {
 	// LaodImage use written dimg. so close here.
 	dimgFile.Close()
 
-	err = LoadImage(snClient, ctx, imgName, imgVersion, image.Header, dimgPath)
+	err = LoadImage(snClient, ctx, imgName, imgVersion, image.Header, dimgPath, progress)
 	if err != nil {
 		return err
 	}
@@ -188,7 +244,11 @@ func Load(ctx context.Context, imgNameWithVersion, imgPath string) error {
 func Action(c *cli.Context) error {
 	imgName := c.String("image")
 	imgPath := c.String("cdimg")
-	err := Load(context.TODO(), imgName, imgPath)
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	err = Load(context.TODO(), imgName, imgPath, progress)
 	if err != nil {
 		return err
 	}
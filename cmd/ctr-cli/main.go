@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/bundle"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/convert"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/convert2"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/diff"
@@ -15,6 +16,7 @@ import (
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/push"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/show"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/stat"
+	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/store"
 	"github.com/naoki9911/fuse-diff-containerd/cmd/ctr-cli/util"
 	"github.com/urfave/cli/v2"
 )
@@ -41,6 +43,12 @@ func NewApp() *cli.App {
 			Usage:    "labels to be added to benchmark result",
 			Required: false,
 		},
+		&cli.StringFlag{
+			Name:     "progress",
+			Usage:    "progress reporting mode (none, bar, json). reports are written to stderr",
+			Value:    "none",
+			Required: false,
+		},
 	}
 	app.Commands = []*cli.Command{
 		convert.Command(),
@@ -53,6 +61,8 @@ func NewApp() *cli.App {
 		push.Command(),
 		util.Command(),
 		stat.Command(),
+		store.Command(),
+		bundle.Command(),
 	}
 
 	return app
@@ -82,6 +92,7 @@ func cdimgCommand() *cli.Command {
 		Subcommands: []*cli.Command{
 			patch.CdimgCommand(),
 			diff.CdimgCommand(),
+			diff.MatrixCdimgCommand(),
 			merge.CdimgCommand(),
 			show.CdimgCommand(),
 		},
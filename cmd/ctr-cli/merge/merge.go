@@ -76,10 +76,16 @@ func DimgCommand() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:     "mergeMode",
-				Usage:    "The mode to merge (linear, bisect)",
+				Usage:    "The mode to merge (linear, bisect, auto). auto plans the merge order with sizes of dimgs",
 				Value:    "linear",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "verifyImages",
+				Usage:    "comma-separated paths to full dimgs. merged diffs are verified against them and re-diffed on failure",
+				Value:    "",
+				Required: false,
+			},
 		},
 	}
 
@@ -117,11 +123,22 @@ func dimgAction(c *cli.Context) error {
 		b.SetDefaultLabels(utils.ParseLabels(c.StringSlice("labels")))
 	}
 
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
 	mergeConfig := image.MergeConfig{
 		ThreadNum:              threadNum,
 		MergeDimgConcurrentNum: mergeDimgConcurrentNum,
 		BenchmarkPerFile:       enableBenchPerFile,
 		Benchmarker:            b,
+		Progress:               progress,
+	}
+	if verifyImages := c.String("verifyImages"); verifyImages != "" {
+		mergeConfig.FullImages, err = image.NewFullImageResolver(strings.Split(verifyImages, ","), false)
+		if err != nil {
+			return err
+		}
 	}
 	var header *image.DimgHeader
 	start := time.Now()
@@ -152,8 +169,10 @@ func dimgAction(c *cli.Context) error {
 			mergedDimg, err = image.MergeDimgsWithLinear(dimgEntry, tmpDir, mergeConfig, false, pm)
 		case "bisect":
 			mergedDimg, err = image.MergeDimgsWithBisectMultithread(dimgEntry, tmpDir, mergeConfig, false, pm)
+		case "auto":
+			mergedDimg, err = image.MergeDimgsWithPlan(dimgEntry, tmpDir, mergeConfig, false, pm)
 		default:
-			return fmt.Errorf("invalid mergeMode %s (only 'linear' or 'bisect' are allowed)", mergeMode)
+			return fmt.Errorf("invalid mergeMode %s (only 'linear', 'bisect' or 'auto' are allowed)", mergeMode)
 		}
 		if err != nil {
 			return fmt.Errorf("failed to merge: %v", err)
@@ -259,10 +278,16 @@ func CdimgCommand() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:     "mergeMode",
-				Usage:    "The mode to merge (linear, bisect)",
+				Usage:    "The mode to merge (linear, bisect, auto). auto plans the merge order with sizes of dimgs",
 				Value:    "linear",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "verifyImages",
+				Usage:    "comma-separated paths to full cdimgs. merged diffs are verified against them and re-diffed on failure",
+				Value:    "",
+				Required: false,
+			},
 		},
 	}
 
@@ -300,11 +325,22 @@ func cdimgAction(c *cli.Context) error {
 		b.SetDefaultLabels(utils.ParseLabels(c.StringSlice("labels")))
 	}
 
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
 	mergeConfig := image.MergeConfig{
 		ThreadNum:              threadNum,
 		MergeDimgConcurrentNum: mergeDimgConcurrentNum,
 		BenchmarkPerFile:       enableBenchPerFile,
 		Benchmarker:            b,
+		Progress:               progress,
+	}
+	if verifyImages := c.String("verifyImages"); verifyImages != "" {
+		mergeConfig.FullImages, err = image.NewFullImageResolver(strings.Split(verifyImages, ","), true)
+		if err != nil {
+			return err
+		}
 	}
 	var header *image.DimgHeader
 	start := time.Now()
@@ -338,8 +374,10 @@ func cdimgAction(c *cli.Context) error {
 			mergedDimg, err = image.MergeDimgsWithLinear(dimgEntry, tmpDir, mergeConfig, true, pm)
 		case "bisect":
 			mergedDimg, err = image.MergeDimgsWithBisectMultithread(dimgEntry, tmpDir, mergeConfig, true, pm)
+		case "auto":
+			mergedDimg, err = image.MergeDimgsWithPlan(dimgEntry, tmpDir, mergeConfig, true, pm)
 		default:
-			return fmt.Errorf("invalid mergeMode %s (only 'linear' or 'bisect' are allowed)", mergeMode)
+			return fmt.Errorf("invalid mergeMode %s (only 'linear', 'bisect' or 'auto' are allowed)", mergeMode)
 		}
 		if err != nil {
 			return fmt.Errorf("failed to merge: %v", err)
@@ -2,6 +2,8 @@ package pack
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/containerd/containerd/log"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
@@ -87,6 +89,11 @@ func PackDimgCommand() *cli.Command {
 				Required: false,
 				Value:    8,
 			},
+			&cli.StringFlag{
+				Name:     "profile",
+				Usage:    "path to access profile. bodies of files in the profile are placed at the front",
+				Required: false,
+			},
 		},
 	}
 	return cmd
@@ -96,7 +103,18 @@ func packDimgAction(c *cli.Context) error {
 	inPath := c.String("in")
 	outPath := c.String("out")
 	threadNum := c.Int("threadNum")
-	err := image.PackDir(inPath, outPath, threadNum)
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	var profile *image.AccessProfile
+	if p := c.String("profile"); p != "" {
+		profile, err = image.LoadAccessProfile(p)
+		if err != nil {
+			return fmt.Errorf("failed to load profile %s: %v", p, err)
+		}
+	}
+	err = image.PackDir(c.Context, inPath, outPath, threadNum, profile, progress)
 	if err != nil {
 		return err
 	}
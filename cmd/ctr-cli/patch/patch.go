@@ -1,8 +1,12 @@
 package patch
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd/log"
@@ -32,12 +36,12 @@ func DimgCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:     "outDir",
 				Usage:    "path to output directory",
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "diffDimg",
 				Usage:    "path to diff dimg",
-				Required: true,
+				Required: false,
 			},
 			&cli.BoolFlag{
 				Name:     "benchmark",
@@ -45,6 +49,42 @@ func DimgCommand() *cli.Command {
 				Value:    false,
 				Required: false,
 			},
+			&cli.IntFlag{
+				Name:     "threadNum",
+				Usage:    "The number of threads to process",
+				Value:    8,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "inPlace",
+				Usage:    "patch baseDir in place instead of writing to outDir",
+				Value:    false,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "recover",
+				Usage:    "recover interrupted in-place patch in baseDir and exit",
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "chain",
+				Usage:    "comma-separated paths to diff dimgs applied in order (lower to upper) instead of diffDimg",
+				Value:    "",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "outTar",
+				Usage:    "path to output tar instead of outDir ('-' for stdout)",
+				Value:    "",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "baseDimg",
+				Usage:    "path to base dimg used instead of baseDir (only with outTar)",
+				Value:    "",
+				Required: false,
+			},
 		},
 	}
 
@@ -63,7 +103,16 @@ func dimgAction(c *cli.Context) error {
 		"diffDimg": diffDimg,
 	}).Info("starting to patch")
 
-	os.RemoveAll(outDir)
+	if c.Bool("recover") {
+		return recoverInPlace(baseDir)
+	}
+	err := validateFlags(c, diffDimg, c.String("baseDimg"))
+	if err != nil {
+		return err
+	}
+	if writesOutDir(c) {
+		os.RemoveAll(outDir)
+	}
 
 	pm, err := bsdiffx.LoadOrDefaultPlugins("")
 	if err != nil {
@@ -78,15 +127,23 @@ func dimgAction(c *cli.Context) error {
 		defer b.Close()
 	}
 
-	dimgFile, err := image.OpenDimgFile(diffDimg)
+	imgs, err := openImages(c, diffDimg, c.String("baseDimg"), false)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer closeImages(imgs)
+
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
 	}
-	defer dimgFile.Close()
-	dimgHeader := dimgFile.DimgHeader()
 
 	start := time.Now()
-	err = image.ApplyPatch(baseDir, outDir, &dimgHeader.FileEntry, dimgFile, dimgHeader.ParentId == "", pm)
+	pc := image.PatchConfig{
+		ThreadNum: c.Int("threadNum"),
+		Progress:  progress,
+	}
+	err = applyPatch(c, baseDir, outDir, imgs, pm, pc)
 	if err != nil {
 		panic(err)
 	}
@@ -126,12 +183,12 @@ func CdimgCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:     "outDir",
 				Usage:    "path to output directory",
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "diffCdimg",
 				Usage:    "path to diff cdimg",
-				Required: true,
+				Required: false,
 			},
 			&cli.BoolFlag{
 				Name:     "benchmark",
@@ -139,6 +196,42 @@ func CdimgCommand() *cli.Command {
 				Value:    false,
 				Required: false,
 			},
+			&cli.IntFlag{
+				Name:     "threadNum",
+				Usage:    "The number of threads to process",
+				Value:    8,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "inPlace",
+				Usage:    "patch baseDir in place instead of writing to outDir",
+				Value:    false,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "recover",
+				Usage:    "recover interrupted in-place patch in baseDir and exit",
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "chain",
+				Usage:    "comma-separated paths to diff cdimgs applied in order (lower to upper) instead of diffCdimg",
+				Value:    "",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "outTar",
+				Usage:    "path to output tar instead of outDir ('-' for stdout)",
+				Value:    "",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "baseCdimg",
+				Usage:    "path to base cdimg used instead of baseDir (only with outTar)",
+				Value:    "",
+				Required: false,
+			},
 		},
 	}
 
@@ -157,7 +250,16 @@ func cdimgAction(c *cli.Context) error {
 		"diffCdimg": diffCdimg,
 	}).Info("starting to patch")
 
-	os.RemoveAll(outDir)
+	if c.Bool("recover") {
+		return recoverInPlace(baseDir)
+	}
+	err := validateFlags(c, diffCdimg, c.String("baseCdimg"))
+	if err != nil {
+		return err
+	}
+	if writesOutDir(c) {
+		os.RemoveAll(outDir)
+	}
 
 	pm, err := bsdiffx.LoadOrDefaultPlugins("")
 	if err != nil {
@@ -173,16 +275,23 @@ func cdimgAction(c *cli.Context) error {
 		defer b.Close()
 	}
 
-	cdimgFile, err := image.OpenCdimgFile(diffCdimg)
+	imgs, err := openImages(c, diffCdimg, c.String("baseCdimg"), true)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer closeImages(imgs)
+
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
 	}
-	defer cdimgFile.Close()
-	dimgFile := cdimgFile.Dimg
-	dimgHeader := dimgFile.DimgHeader()
 
 	start := time.Now()
-	err = image.ApplyPatch(baseDir, outDir, &dimgHeader.FileEntry, dimgFile, dimgHeader.ParentId == "", pm)
+	pc := image.PatchConfig{
+		ThreadNum: c.Int("threadNum"),
+		Progress:  progress,
+	}
+	err = applyPatch(c, baseDir, outDir, imgs, pm, pc)
 	if err != nil {
 		panic(err)
 	}
@@ -205,3 +314,126 @@ func cdimgAction(c *cli.Context) error {
 	logger.Info("patch done")
 	return nil
 }
+
+func validateFlags(c *cli.Context, diffImage, baseImage string) error {
+	if diffImage == "" && c.String("chain") == "" {
+		return fmt.Errorf("diff image is not specified")
+	}
+	if diffImage != "" && c.String("chain") != "" {
+		return fmt.Errorf("diff image and chain cannot be specified at the same time")
+	}
+	if c.String("outDir") != "" && !writesOutDir(c) {
+		return fmt.Errorf("outDir cannot be used with outTar or inPlace")
+	}
+	if c.String("outTar") != "" {
+		if c.Bool("inPlace") {
+			return fmt.Errorf("outTar cannot be used with inPlace")
+		}
+		if baseImage != "" && c.String("baseDir") != "" {
+			return fmt.Errorf("base image and baseDir cannot be specified at the same time")
+		}
+	} else if baseImage != "" {
+		return fmt.Errorf("base image is only used with outTar")
+	} else if c.Bool("inPlace") {
+		if c.String("chain") != "" {
+			return fmt.Errorf("chain cannot be patched in place")
+		}
+		if c.String("baseDir") == "" {
+			return fmt.Errorf("baseDir is required to patch in place")
+		}
+	} else if c.String("outDir") == "" {
+		return fmt.Errorf("outDir is required")
+	}
+
+	return nil
+}
+
+// writesOutDir returns true if the patched tree is written to outDir
+func writesOutDir(c *cli.Context) bool {
+	return c.String("outTar") == "" && !c.Bool("inPlace")
+}
+
+func recoverInPlace(baseDir string) error {
+	if baseDir == "" {
+		return fmt.Errorf("baseDir is required to recover")
+	}
+	rolledForward, err := image.RecoverPatchInPlace(baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to recover %s: %v", baseDir, err)
+	}
+	logger.Warnf("recovered %s (rolledForward=%v)", baseDir, rolledForward)
+
+	return nil
+}
+
+// openImages opens diffImage or images in the chain ordered from lower to upper.
+// baseImage is opened as the lowest if specified.
+func openImages(c *cli.Context, diffImage, baseImage string, isCdimg bool) ([]*image.DimgFile, error) {
+	paths := []string{diffImage}
+	if chain := c.String("chain"); chain != "" {
+		paths = strings.Split(chain, ",")
+	}
+	if baseImage != "" {
+		paths = append([]string{baseImage}, paths...)
+	}
+
+	imgs := []*image.DimgFile{}
+	for _, p := range paths {
+		var img *image.DimgFile
+		if isCdimg {
+			cdimgFile, err := image.OpenCdimgFile(p)
+			if err != nil {
+				closeImages(imgs)
+				return nil, fmt.Errorf("failed to open %s: %v", p, err)
+			}
+			img = cdimgFile.Dimg
+		} else {
+			dimgFile, err := image.OpenDimgFile(p)
+			if err != nil {
+				closeImages(imgs)
+				return nil, fmt.Errorf("failed to open %s: %v", p, err)
+			}
+			img = dimgFile
+		}
+		imgs = append(imgs, img)
+	}
+
+	return imgs, nil
+}
+
+func closeImages(imgs []*image.DimgFile) {
+	for _, img := range imgs {
+		img.Close()
+	}
+}
+
+func applyPatch(c *cli.Context, baseDir, outDir string, imgs []*image.DimgFile, pm *bsdiffx.PluginManager, pc image.PatchConfig) error {
+	if outTar := c.String("outTar"); outTar != "" {
+		var w io.Writer = os.Stdout
+		if outTar != "-" {
+			f, err := os.Create(outTar)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		bw := bufio.NewWriter(w)
+		err := image.ApplyPatchToTar(c.Context, baseDir, imgs, pm, bw)
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if c.String("chain") != "" {
+		return image.ApplyPatchChain(c.Context, baseDir, outDir, imgs, pm, pc)
+	}
+
+	img := imgs[0]
+	header := img.DimgHeader()
+	if c.Bool("inPlace") {
+		return image.ApplyPatchInPlace(c.Context, baseDir, &header.FileEntry, img, pm, pc)
+	}
+	return image.ApplyPatch(c.Context, baseDir, outDir, &header.FileEntry, img, header.ParentId == "", pm, pc)
+}
@@ -20,8 +20,6 @@ import (
 	"github.com/naoki9911/fuse-diff-containerd/pkg/server"
 	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
-	"github.com/opencontainers/go-digest"
-	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -45,6 +43,12 @@ var (
 			Usage:    "server host",
 			Required: true,
 		},
+		&cli.StringFlag{
+			Name:     "pathObjective",
+			Usage:    "cost minimized by the server when selecting dimgs (hops, bytes, mergeTime, bytesAndMergeTime). the server's default if empty",
+			Value:    "",
+			Required: false,
+		},
 		&cli.IntFlag{
 			Name:     "expectedDimgsNum",
 			Usage:    "Expected selected dimgs num",
@@ -97,6 +101,10 @@ func pullImage(c *cli.Context, host string, imageNameWithVersion string, bench b
 		}
 		defer b.Close()
 	}
+	progress, err := image.NewProgressReporter(c.String("progress"), os.Stderr)
+	if err != nil {
+		return err
+	}
 	start := time.Now()
 	snClient, err := sns.NewClient()
 	if err != nil {
@@ -110,46 +118,10 @@ func pullImage(c *cli.Context, host string, imageNameWithVersion string, bench b
 	reqImgName := reqImgNames[0]
 	reqImgVersion := reqImgNames[1]
 
-	imgStore := snClient.CtrClient.ImageService()
-	images, err := imgStore.List(context.TODO())
+	localDimgs, err := load.GetLocalDimgIds(context.TODO(), snClient)
 	if err != nil {
 		return err
 	}
-
-	contentStore := snClient.CtrClient.ContentStore()
-
-	localDimgs := make([]digest.Digest, 0)
-	for _, img := range images {
-		targetSns, ok := img.Labels[sns.TargetSnapshotLabel]
-		if !ok {
-			continue
-		}
-		if targetSns != "di3fs" {
-			continue
-		}
-		manReader, err := contentStore.ReaderAt(context.TODO(), img.Target)
-		if err != nil {
-			logger.Errorf("failed to reade target %s from content store: %v", img.Target.Digest, err)
-			continue
-		}
-		defer manReader.Close()
-
-		manifestBytes := make([]byte, manReader.Size())
-		_, err = manReader.ReadAt(manifestBytes, 0)
-		if err != nil {
-			logger.Errorf("failed to ReadAll from manifest reader: %v", err)
-			continue
-		}
-
-		manifest := v1.Manifest{}
-		err = json.Unmarshal(manifestBytes, &manifest)
-		if err != nil {
-			logger.Errorf("failed to unmarshal manifest: %v", err)
-			continue
-		}
-
-		localDimgs = append(localDimgs, manifest.Layers[0].Digest)
-	}
 	logger.WithField("localDimgs", localDimgs).Debug("local images collected")
 
 	reqBody := server.UpdateDataRequest{
@@ -157,7 +129,8 @@ func pullImage(c *cli.Context, host string, imageNameWithVersion string, bench b
 			Name:    reqImgName,
 			Version: reqImgVersion,
 		},
-		LocalDimgs: localDimgs,
+		LocalDimgs:    localDimgs,
+		PathObjective: c.String("pathObjective"),
 	}
 
 	reqBodyBytes, err := json.Marshal(reqBody)
@@ -214,10 +187,16 @@ func pullImage(c *cli.Context, host string, imageNameWithVersion string, bench b
 	if err != nil {
 		return fmt.Errorf("failed to create dimg at %s: %v", dimgPath, err)
 	}
-	dimgSize, err := io.Copy(dimgFile, resp.Body)
+	pt := image.NewProgressTracker(progress, "pull")
+	pt.AddTotal(1)
+	pt.SetPhase(image.PROGRESS_PHASE_PROCESS)
+	pw := pt.Writer(dimgFile)
+	dimgSize, err := io.Copy(pw, resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to copy dimg: %v", err)
 	}
+	pw.FileDone(dimgPath)
+	pt.SetPhase(image.PROGRESS_PHASE_DONE)
 	if dimgSize != header.Head.DimgSize {
 		return fmt.Errorf("invalid dimg (expected=%d actual=%d)", header.Head.DimgSize, dimgSize)
 	}
@@ -239,7 +218,7 @@ func pullImage(c *cli.Context, host string, imageNameWithVersion string, bench b
 		}
 	}
 
-	err = load.LoadImage(snClient, context.TODO(), reqImgName, reqImgVersion, header, dimgPath)
+	err = load.LoadImage(snClient, context.TODO(), reqImgName, reqImgVersion, header, dimgPath, progress)
 	if err != nil {
 		return fmt.Errorf("failed to load image: %v", err)
 	}
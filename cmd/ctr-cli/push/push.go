@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/server"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -30,7 +31,12 @@ func Command() *cli.Command {
 			&cli.StringFlag{
 				Name:     "cdimg",
 				Usage:    "path to cdimg to push",
-				Required: true,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "manifest",
+				Usage:    "path to manifest generated by 'cdimg diff-matrix'. all listed cdimgs are pushed",
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "imageTag",
@@ -48,12 +54,24 @@ func Action(c *cli.Context) error {
 	serverHost := c.String("serverHost")
 	cdimg := c.String("cdimg")
 	imageTag := c.String("imageTag")
+	manifestPath := c.String("manifest")
 	logger.WithFields(logrus.Fields{
 		"serverHost": serverHost,
 		"cdimg":      cdimg,
 		"imageTag":   imageTag,
+		"manifest":   manifestPath,
 	}).Info("starting to push")
 
+	if (cdimg == "") == (manifestPath == "") {
+		return fmt.Errorf("either cdimg or manifest must be specified")
+	}
+	if manifestPath != "" {
+		if imageTag != "" {
+			return fmt.Errorf("imageTag cannot be used with manifest")
+		}
+		return pushManifest(server.NewDiffClient(serverHost), manifestPath)
+	}
+
 	var imgTag *server.ImageTag = nil
 	if imageTag != "" {
 		ss := strings.SplitN(imageTag, ":", 2)
@@ -81,3 +99,25 @@ func Action(c *cli.Context) error {
 	logger.Info("push done")
 	return nil
 }
+
+func pushManifest(client *server.DiffClient, manifestPath string) error {
+	manifest, err := image.LoadDiffMatrixManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest %s: %v", manifestPath, err)
+	}
+
+	for _, d := range manifest.Deltas {
+		logger.WithFields(logrus.Fields{
+			"parentId": d.ParentId,
+			"id":       d.Id,
+			"size":     d.Size,
+		}).Infof("pushing %s", d.Path)
+		err = client.PushImage(d.Path, nil)
+		if err != nil {
+			return fmt.Errorf("failed to push image %s: %v", d.Path, err)
+		}
+	}
+
+	logger.Infof("push done (%d images)", len(manifest.Deltas))
+	return nil
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var logger = log.G(context.TODO())
+
+func Command() *cli.Command {
+	cmd := cli.Command{
+		Name:  "store",
+		Usage: "DimgStore related commands",
+		Subcommands: []*cli.Command{
+			gcCommand(),
+			compactCommand(),
+		},
+	}
+	return &cmd
+}
+
+func gcCommand() *cli.Command {
+	cmd := cli.Command{
+		Name:  "gc",
+		Usage: "Remove dimgs not required by images in the snapshotter or the server",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "host",
+				Usage:    "server host. the snapshotter's store is collected if not specified",
+				Value:    "",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "dryRun",
+				Usage:    "only report dimgs to be removed",
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "gracePeriod",
+				Usage:    "keep dimgs added within the period",
+				Value:    image.GC_DEFAULT_GRACE_PERIOD,
+				Required: false,
+			},
+		},
+		Action: gcAction,
+	}
+	return &cmd
+}
+
+// newClient returns the client to the host or to the snapshotter if host is empty
+func newClient(host string) (*http.Client, string) {
+	client := &http.Client{}
+	if host == "" {
+		// the snapshotter serves admin requests on the unix socket
+		host = "di3fs-snapshotter"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sns.AdminSocketPath)
+			},
+		}
+	}
+	return client, host
+}
+
+func gcAction(c *cli.Context) error {
+	logger.Logger.SetLevel(logrus.InfoLevel)
+
+	q := url.Values{}
+	q.Set("dryRun", fmt.Sprintf("%v", c.Bool("dryRun")))
+	q.Set("gracePeriod", c.Duration("gracePeriod").String())
+
+	client, host := newClient(c.String("host"))
+	req, err := http.NewRequestWithContext(c.Context, "POST", "http://"+host+"/gc?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to gc: status=%d", resp.StatusCode)
+	}
+
+	res, err := utils.UnmarshalJsonFromReader[image.GCResult](resp.Body)
+	if err != nil {
+		return err
+	}
+	for _, d := range res.RemovedDimgs {
+		logger.Infof("removed dimg %s", d)
+	}
+	for _, f := range res.RemovedFiles {
+		logger.Infof("removed file %s", f)
+	}
+	logger.Infof("%d dimgs and %d files removed (dryRun=%v freed=%d bytes)", len(res.RemovedDimgs), len(res.RemovedFiles), c.Bool("dryRun"), res.FreedBytes)
+
+	return nil
+}
+
+func compactCommand() *cli.Command {
+	cmd := cli.Command{
+		Name:  "compact",
+		Usage: "Merge the chain of dimgs to mount the image into a new base dimg in the snapshotter",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "id",
+				Usage:    "image id (dimg id) to be compacted",
+				Required: true,
+			},
+			&cli.DurationFlag{
+				Name:     "gracePeriod",
+				Usage:    "keep dimgs added within the period when removing the old chain",
+				Value:    image.GC_DEFAULT_GRACE_PERIOD,
+				Required: false,
+			},
+		},
+		Action: compactAction,
+	}
+	return &cmd
+}
+
+func compactAction(c *cli.Context) error {
+	logger.Logger.SetLevel(logrus.InfoLevel)
+
+	q := url.Values{}
+	q.Set("id", c.String("id"))
+	q.Set("gracePeriod", c.Duration("gracePeriod").String())
+
+	client, host := newClient("")
+	req, err := http.NewRequestWithContext(c.Context, "POST", "http://"+host+"/compact?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to compact: status=%d", resp.StatusCode)
+	}
+
+	res, err := utils.UnmarshalJsonFromReader[sns.CompactResponse](resp.Body)
+	if err != nil {
+		return err
+	}
+	if res.Compacted == nil {
+		logger.Infof("%s is already a single dimg", c.String("id"))
+	} else {
+		logger.Infof("compacted into dimg %s (size=%d)", res.Compacted.Digest(), res.Compacted.Size)
+	}
+	for _, d := range res.GC.RemovedDimgs {
+		logger.Infof("removed dimg %s", d)
+	}
+	logger.Infof("%d dimgs removed (freed=%d bytes)", len(res.GC.RemovedDimgs), res.GC.FreedBytes)
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/archivex"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+)
+
+func Info() string {
+	return "plugin for gzip and zip files compressed by Go's compress/flate"
+}
+
+func Diff(oldBytes, newBytes []byte, patchWriter io.Writer, mode bsdiffx.CompressionMode) error {
+	return archivex.Diff(oldBytes, newBytes, patchWriter, mode)
+}
+
+func Patch(oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+	return archivex.Patch(oldBytes, patchReader)
+}
+
+func Merge(lowerDiff, upperDiff io.Reader, mergedDiff io.Writer) error {
+	return archivex.Merge(lowerDiff, upperDiff, mergedDiff)
+}
+
+func Compare(a, b []byte) bool {
+	return bytes.Equal(a, b)
+}
+
+func ID() uuid.UUID {
+	return uuid.MustParse("8f3b6d0e-6a3c-4c55-9e0b-2f4d1a7c9b61")
+}
+
+func init() {
+}
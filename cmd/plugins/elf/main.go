@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/elfx"
+)
+
+func Info() string {
+	return "plugin for ELF executables and shared libraries"
+}
+
+func Diff(oldBytes, newBytes []byte, patchWriter io.Writer, mode bsdiffx.CompressionMode) error {
+	return elfx.Diff(oldBytes, newBytes, patchWriter, mode)
+}
+
+func Patch(oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+	return elfx.Patch(oldBytes, patchReader)
+}
+
+func Merge(lowerDiff, upperDiff io.Reader, mergedDiff io.Writer) error {
+	return elfx.Merge(lowerDiff, upperDiff, mergedDiff)
+}
+
+func Compare(a, b []byte) bool {
+	return bytes.Equal(a, b)
+}
+
+func ID() uuid.UUID {
+	return uuid.MustParse("5d2c8a47-1e9f-4b6a-8c3d-7a0e9f2b4c18")
+}
+
+func init() {
+}
@@ -14,6 +14,10 @@ var logger = log.G(context.TODO())
 
 func main() {
 	threadNum := flag.Int("threadNum", 1, "Te number of threads to merge diffs")
+	mergeCacheQuota := flag.Int64("mergeCacheQuotaMiB", 1024, "Disk quota in MiB for cached merged dimgs (0 disables cache)")
+	verifyMerge := flag.Bool("verifyMerge", false, "Verify merged diffs against full images in the store")
+	pathObjective := flag.String("pathObjective", "bytes", "Cost minimized when selecting dimgs to send (hops, bytes, mergeTime, bytesAndMergeTime)")
+	dedup := flag.Bool("dedup", false, "Store bodies of new files once in the image store and let dimgs reference them")
 	flag.Parse()
 	mc := image.MergeConfig{
 		ThreadNum:              *threadNum,
@@ -25,7 +29,12 @@ func main() {
 		logger.Errorf("failed to load plugins: %v", err)
 	}
 
-	ds, err := server.NewDiffServer(mc, pm)
+	objective, err := image.GetPathObjective(*pathObjective)
+	if err != nil {
+		logger.Fatalf("invalid pathObjective %s: %v", *pathObjective, err)
+	}
+
+	ds, err := server.NewDiffServer(mc, pm, *mergeCacheQuota*1024*1024, *verifyMerge, objective, image.DimgStoreOptions{Dedup: *dedup})
 	if err != nil {
 		logger.Errorf("failed to create DiffServer: %v", err)
 	}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// startAdminServer serves administrative requests (e.g. gc) on sns.AdminSocketPath
+func (c *Client) startAdminServer(mgr *Di3FSManager) error {
+	socketDir := filepath.Dir(sns.AdminSocketPath)
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %q", socketDir)
+	}
+	if err := os.RemoveAll(sns.AdminSocketPath); err != nil {
+		return errors.Wrapf(err, "failed to remove %q", sns.AdminSocketPath)
+	}
+	l, err := net.Listen("unix", sns.AdminSocketPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %q", sns.AdminSocketPath)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		c.handleGC(mgr, w, r)
+	})
+	mux.HandleFunc("/compact", func(w http.ResponseWriter, r *http.Request) {
+		c.handleCompact(mgr, w, r)
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.G(c.ctx).WithError(err).Errorf("failed to serve admin server")
+		}
+	}()
+
+	return nil
+}
+
+func (c *Client) handleGC(mgr *Di3FSManager, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		log.G(c.ctx).Errorf("invalid method %s", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	gc, err := image.ParseGCQuery(r.URL.Query())
+	if err != nil {
+		log.G(c.ctx).Errorf("invalid request err=%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	gc.Roots, err = c.gcRoots(c.ctx)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to get gc roots: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res, err := mgr.GarbageCollect(gc)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to gc: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.G(c.ctx).Infof("gc removed %d dimgs (dryRun=%v freed=%d)", len(res.RemovedDimgs), gc.DryRun, res.FreedBytes)
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to marshal json err=%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBytes)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to send response json err=%v", err)
+	}
+}
+
+// handleCompact compacts the chain of the image id into a new base dimg
+// and removes dimgs no longer required.
+func (c *Client) handleCompact(mgr *Di3FSManager, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		log.G(c.ctx).Errorf("invalid method %s", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	id, err := digest.Parse(q.Get("id"))
+	if err != nil {
+		log.G(c.ctx).Errorf("invalid id %s: %v", q.Get("id"), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	gc, err := image.ParseGCQuery(q)
+	if err != nil {
+		log.G(c.ctx).Errorf("invalid request err=%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res := sns.CompactResponse{}
+	res.Compacted, err = mgr.Compact(id)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to compact %s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if res.Compacted != nil {
+		log.G(c.ctx).Infof("compacted %s into %s (size=%d)", id, res.Compacted.Digest(), res.Compacted.Size)
+	}
+
+	gc.Roots, err = c.gcRoots(c.ctx)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to get gc roots: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res.GC, err = mgr.GarbageCollect(gc)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to gc: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to marshal json err=%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBytes)
+	if err != nil {
+		log.G(c.ctx).Errorf("failed to send response json err=%v", err)
+	}
+}
+
+// gcRoots returns dimg ids referenced by di3fs images in containerd and by snapshots.
+// Snapshots keep the dimgs of mounted images even after the images are removed.
+func (c *Client) gcRoots(ctx context.Context) ([]digest.Digest, error) {
+	roots := []digest.Digest{}
+	err := c.snSnapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if d, ok := info.Labels[sns.SnapshotLabelRefDimgId]; ok {
+			roots = append(roots, digest.Digest(d))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk snapshots: %v", err)
+	}
+
+	imgs, err := c.ctr.ImageService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+	cs := c.ctr.ContentStore()
+	for _, img := range imgs {
+		if img.Labels[sns.TargetSnapshotLabel] != "di3fs" {
+			continue
+		}
+		manifestBytes, err := content.ReadBlob(ctx, cs, img.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest of %s: %v", img.Name, err)
+		}
+		manifest := v1.Manifest{}
+		err = json.Unmarshal(manifestBytes, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal manifest of %s: %v", img.Name, err)
+		}
+		for _, layer := range manifest.Layers {
+			roots = append(roots, layer.Digest)
+		}
+	}
+
+	return roots, nil
+}
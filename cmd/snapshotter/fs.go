@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/di3fs"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
 	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
@@ -15,19 +19,55 @@ import (
 )
 
 type Di3FSManager struct {
+	storePath string
 	dimgStore *image.DimgStore
-	mounts    map[string]struct{}
+	// dimgs are not evicted if storeQuota is 0
+	storeQuota       int64
+	patchedFileCache *di3fs.PatchedFileCache
+	// access profiles are not used if profileDir is empty
+	profileDir string
+	profile    di3fs.ProfileConfig
+	// used to compact chains
+	mergeConfig image.MergeConfig
+	pm          *bsdiffx.PluginManager
+
+	// dimgs are looked up and pinned in mounts while evictLock is held,
+	// so that eviction and GC do not remove dimgs which are about to be mounted.
+	// lock must be acquired after evictLock.
+	evictLock sync.Mutex
+	lock      sync.Mutex
+	// mountpoint -> digests of mounted dimgs
+	mounts map[string][]digest.Digest
 }
 
-func NewDi3FSManager(storePath string) (*Di3FSManager, error) {
-	store, err := image.NewDimgStore(storePath)
+func NewDi3FSManager(storePath string, storeQuota int64, storeOpts image.DimgStoreOptions, patchedFilesCacheDir string, patchedFilesQuota int64, profileDir string, profile di3fs.ProfileConfig, mc image.MergeConfig, pm *bsdiffx.PluginManager) (*Di3FSManager, error) {
+	store, err := image.NewDimgStore(storePath, storeOpts)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := di3fs.NewPatchedFileCache(patchedFilesCacheDir, patchedFilesQuota)
 	if err != nil {
 		return nil, err
 	}
+	if profileDir != "" {
+		err = os.MkdirAll(profileDir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dir %s: %v", profileDir, err)
+		}
+	}
 
 	dm := &Di3FSManager{
-		dimgStore: store,
-		mounts:    map[string]struct{}{},
+		storePath:        storePath,
+		dimgStore:        store,
+		storeQuota:       storeQuota,
+		patchedFileCache: cache,
+		profileDir:       profileDir,
+		profile:          profile,
+		mergeConfig:      mc,
+		pm:               pm,
+		evictLock:        sync.Mutex{},
+		lock:             sync.Mutex{},
+		mounts:           map[string][]digest.Digest{},
 	}
 
 	return dm, nil
@@ -38,6 +78,9 @@ func (f *Di3FSManager) UpdateStore() error {
 }
 
 func (f *Di3FSManager) UnmountAll() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	for m := range f.mounts {
 		err := exec.Command("fusermount3", "-u", m).Run()
 		if err != nil {
@@ -47,7 +90,7 @@ func (f *Di3FSManager) UnmountAll() {
 		log.G(context.TODO()).Infof("unmounted %s", m)
 	}
 
-	f.mounts = map[string]struct{}{}
+	f.mounts = map[string][]digest.Digest{}
 }
 
 func (f *Di3FSManager) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -59,39 +102,108 @@ func (f *Di3FSManager) Mount(ctx context.Context, mountpoint string, labels map[
 	if !ok {
 		return errdefs.ErrNotFound
 	}
-	err := f.dimgStore.AddDimg(tempDimgPath)
-	if err != nil {
-		return fmt.Errorf("failed to add dimg %s to DimgStore: %v", tempDimgPath, err)
-	}
-
 	d, ok := labels[sns.SnapshotLabelRefDimgId]
 	if !ok {
 		return errdefs.ErrNotFound
 	}
 
-	dimgPaths, err := f.dimgStore.GetDimgPathsWithDimgId(digest.Digest(d))
+	dimgPaths, dimgDigests, err := f.addAndPinDimgs(mountpoint, tempDimgPath, digest.Digest(d))
 	if err != nil {
-		return fmt.Errorf("failed to get dimg paths for %s: %v", d, err)
+		return err
 	}
 	log.G(ctx).Infof("dimg paths: %v", dimgPaths)
 
-	err = f.mountDImg(ctx, mountpoint, dimgPaths)
+	err = f.dimgStore.TouchDimgs(dimgDigests)
 	if err != nil {
+		log.G(ctx).Warnf("failed to record mount of %s: %v", d, err)
+	}
+	f.enforceStoreQuota(ctx)
+
+	err = f.mountDImg(ctx, mountpoint, dimgPaths, f.profileConfig(digest.Digest(d)))
+	if err != nil {
+		f.lock.Lock()
+		delete(f.mounts, mountpoint)
+		f.lock.Unlock()
 		return err
 	}
-	f.mounts[mountpoint] = struct{}{}
 	log.G(ctx).Infof("success to mount %q", d)
 	return nil
 }
 
-func (f *Di3FSManager) mountDImg(ctx context.Context, mountpoint string, dimgPaths []string) error {
+// addAndPinDimgs adds the dimg to the store and pins the chain of dimgs to mount the image id
+func (f *Di3FSManager) addAndPinDimgs(mountpoint, dimgPath string, id digest.Digest) ([]string, []digest.Digest, error) {
+	f.evictLock.Lock()
+	defer f.evictLock.Unlock()
+
+	err := f.dimgStore.AddDimg(dimgPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add dimg %s to DimgStore: %v", dimgPath, err)
+	}
+
+	dimgs, err := f.dimgStore.GetDimgEntriesWithDimgIds(id, []digest.Digest{""})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get dimg paths for %s: %v", id, err)
+	}
+	dimgPaths := []string{}
+	dimgDigests := []digest.Digest{}
+	for _, dimg := range dimgs {
+		dimgPaths = append(dimgPaths, dimg.Path)
+		dimgDigests = append(dimgDigests, dimg.Digest())
+	}
+
+	f.lock.Lock()
+	f.mounts[mountpoint] = dimgDigests
+	f.lock.Unlock()
+	return dimgPaths, dimgDigests, nil
+}
+
+// mountedDimgs returns digests of dimgs used by mounts
+func (f *Di3FSManager) mountedDimgs() []digest.Digest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	dimgs := []digest.Digest{}
+	for _, ds := range f.mounts {
+		dimgs = append(dimgs, ds...)
+	}
+	return dimgs
+}
+
+func (f *Di3FSManager) enforceStoreQuota(ctx context.Context) {
+	if f.storeQuota == 0 {
+		return
+	}
+	f.evictLock.Lock()
+	defer f.evictLock.Unlock()
+	res, err := f.dimgStore.EvictLRU(f.storeQuota, f.mountedDimgs())
+	if err != nil {
+		log.G(ctx).Errorf("failed to evict dimgs: %v", err)
+		return
+	}
+	if len(res.RemovedDimgs) != 0 {
+		log.G(ctx).Infof("evicted %d dimgs (freed=%d)", len(res.RemovedDimgs), res.FreedBytes)
+	}
+}
+
+// profileConfig returns the config for the access profile of the image id.
+// Profiles are shared by mounts of the same image regardless of the chain of dimgs.
+func (f *Di3FSManager) profileConfig(id digest.Digest) *di3fs.ProfileConfig {
+	if f.profileDir == "" {
+		return nil
+	}
+	pc := f.profile
+	pc.Path = filepath.Join(f.profileDir, fmt.Sprintf("%s.json", id.Encoded()))
+	return &pc
+}
+
+func (f *Di3FSManager) mountDImg(ctx context.Context, mountpoint string, dimgPaths []string, profile *di3fs.ProfileConfig) error {
 	log.G(ctx).WithFields(logrus.Fields{
 		"mountpoint": mountpoint,
 		"dimgPaths":  dimgPaths,
 	}).Info("start to mount DImg")
 	mountDoneChan := make(chan bool)
 	go func() {
-		err := di3fs.Do(dimgPaths, mountpoint, mountDoneChan)
+		err := di3fs.Do(dimgPaths, mountpoint, mountDoneChan, f.patchedFileCache, profile)
 		if err != nil {
 			log.G(ctx).WithFields(logrus.Fields{
 				"dimgPaths": dimgPaths,
@@ -116,7 +228,9 @@ func (f *Di3FSManager) Unmount(ctx context.Context, mountpoint string) error {
 		"mountpoint": mountpoint,
 	}).Info("DummyFS Unmount called")
 
+	f.lock.Lock()
 	delete(f.mounts, mountpoint)
+	f.lock.Unlock()
 	err := exec.Command("fusermount3", "-u", mountpoint).Run()
 	if err != nil {
 		log.G(ctx).Errorf("failed to unmount %s", mountpoint)
@@ -124,3 +238,28 @@ func (f *Di3FSManager) Unmount(ctx context.Context, mountpoint string) error {
 	}
 	return nil
 }
+
+// GarbageCollect keeps dimgs to mount gc.Roots and mounted dimgs
+func (f *Di3FSManager) GarbageCollect(gc image.GCConfig) (*image.GCResult, error) {
+	f.evictLock.Lock()
+	defer f.evictLock.Unlock()
+	gc.Pinned = append(gc.Pinned, f.mountedDimgs()...)
+	gc.ShortestChainOnly = true
+	return f.dimgStore.GarbageCollect(gc)
+}
+
+// Compact merges the chain to mount the image id into a new base dimg.
+// Dimgs in the old chain are freed by the next GarbageCollect if they are not required.
+func (f *Di3FSManager) Compact(id digest.Digest) (*image.DimgEntry, error) {
+	// dimgs in the chain must not be evicted while they are merged
+	f.evictLock.Lock()
+	defer f.evictLock.Unlock()
+
+	tmpDir, err := os.MkdirTemp(f.storePath, "compact-tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	return f.dimgStore.CompactChain(id, tmpDir, f.mergeConfig, f.pm)
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net"
 	"os"
 	"os/exec"
@@ -12,12 +13,16 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/di3fs"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
 	sns "github.com/naoki9911/fuse-diff-containerd/pkg/snapshotter"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -101,6 +106,18 @@ func NewClient() (*Client, error) {
 }
 
 func main() {
+	storeQuota := flag.Int64("storeQuotaMiB", 0, "Disk quota in MiB for dimgs. Least recently mounted dimgs are evicted (0 disables quota)")
+	patchedFilesCacheDir := flag.String("patchedFilesCacheDir", "/tmp/di3fs/patched", "Directory to cache patched files shared by mounts")
+	patchedFilesQuota := flag.Int64("patchedFilesQuotaMiB", 0, "Disk quota in MiB for cached patched files (0 disables quota)")
+	profileDir := flag.String("profileDir", "/tmp/di3fs/profiles", "Directory to keep access profiles of images (empty disables profiles)")
+	profileSeconds := flag.Int("profileSeconds", 0, "Record files opened in the first seconds of the first mount of an image as its profile (0 disables recording)")
+	prefetchConcurrency := flag.Int("prefetchConcurrency", 4, "Number of files in the profile prefetched concurrently on mount")
+	metricsAddr := flag.String("metricsAddr", "", "Address to serve Prometheus metrics on /metrics (e.g. 127.0.0.1:9400, empty disables metrics)")
+	dedup := flag.Bool("dedup", false, "Store bodies of new files once in the image store and let dimgs reference them")
+	mergeThreadNum := flag.Int("mergeThreadNum", 8, "The number of threads to merge diffs in compaction")
+	mergeDimgConcurrentNum := flag.Int("mergeDimgConcurrentNum", 4, "The number of dimgs merged concurrently in compaction")
+	flag.Parse()
+
 	log.GetLogger(context.TODO()).Logger.SetLevel(logrus.DebugLevel)
 	err := unmountDi3FS()
 	if err != nil {
@@ -118,7 +135,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	di3fsMgr, err := NewDi3FSManager(filepath.Join(client.snRootPath, "images"))
+	pm, err := bsdiffx.LoadOrDefaultPlugins("")
+	if err != nil {
+		log.G(context.TODO()).WithError(err).Error("failed to load plugins")
+		os.Exit(1)
+	}
+	mc := image.MergeConfig{
+		ThreadNum:              *mergeThreadNum,
+		MergeDimgConcurrentNum: *mergeDimgConcurrentNum,
+	}
+	di3fsMgr, err := NewDi3FSManager(filepath.Join(client.snRootPath, "images"), *storeQuota*1024*1024, image.DimgStoreOptions{Dedup: *dedup}, *patchedFilesCacheDir, *patchedFilesQuota*1024*1024, *profileDir, di3fs.ProfileConfig{
+		RecordDuration:      time.Duration(*profileSeconds) * time.Second,
+		PrefetchConcurrency: *prefetchConcurrency,
+	}, mc, pm)
 	if err != nil {
 		log.G(context.TODO()).WithError(err).Error("failed to create Di3FSManager")
 		os.Exit(1)
@@ -139,6 +168,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = client.startAdminServer(di3fsMgr)
+	if err != nil {
+		log.G(client.ctx).WithError(err).Error("failed to start admin server")
+		os.Exit(1)
+	}
+
+	if *metricsAddr != "" {
+		err = client.startMetricsServer(*metricsAddr, di3fsMgr)
+		if err != nil {
+			log.G(client.ctx).WithError(err).Error("failed to start metrics server")
+			os.Exit(1)
+		}
+	}
+
 	client.startSnapshotter()
 }
 
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/di3fs"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	descActiveMounts = prometheus.NewDesc(
+		prometheus.BuildFQName(di3fs.METRICS_NAMESPACE, "", "active_mounts"),
+		"Number of di3fs mounts",
+		nil, nil,
+	)
+	descMountChainDepth = prometheus.NewDesc(
+		prometheus.BuildFQName(di3fs.METRICS_NAMESPACE, "", "mount_chain_depth"),
+		"Number of dimgs in the chain mounted",
+		[]string{"mountpoint"}, nil,
+	)
+)
+
+// Di3FSManager exports metrics of mounts
+var _ prometheus.Collector = (*Di3FSManager)(nil)
+
+func (f *Di3FSManager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descActiveMounts
+	ch <- descMountChainDepth
+}
+
+func (f *Di3FSManager) Collect(ch chan<- prometheus.Metric) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(descActiveMounts, prometheus.GaugeValue, float64(len(f.mounts)))
+	for m, dimgs := range f.mounts {
+		ch <- prometheus.MustNewConstMetric(descMountChainDepth, prometheus.GaugeValue, float64(len(dimgs)), m)
+	}
+}
+
+// startMetricsServer serves Prometheus metrics on addr at /metrics
+func (c *Client) startMetricsServer(addr string, mgr *Di3FSManager) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	reg.MustRegister(mgr)
+	err := di3fs.RegisterMetrics(reg)
+	if err != nil {
+		return errors.Wrap(err, "failed to register di3fs metrics")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %q", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.G(c.ctx).WithError(err).Errorf("failed to serve metrics server")
+		}
+	}()
+	log.G(c.ctx).WithField("addr", addr).Info("metrics server started")
+
+	return nil
+}
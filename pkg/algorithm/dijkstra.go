@@ -93,7 +93,13 @@ func (self *DirectedGraph) ShortestPath(start string, goal string) (ret []*Node,
 // スタートとゴールを指定して最短経路を求める
 func (self *DirectedGraph) ShortestPathWithMultipleGoals(start string, goals []string) (ret []*Node, via []*Edge, err error) {
 	// 名前からスタート地点のノードを取得する
-	startNode := self.nodes[start]
+	startNode, ok := self.nodes[start]
+	if !ok {
+		return nil, nil, fmt.Errorf("start node %s not found", start)
+	}
+
+	// Reset all nodes after the search even if the goal is not found
+	defer self.reset()
 
 	// スタートのコストを 0 に設定することで処理対象にする
 	startNode.cost = 0
@@ -139,15 +145,16 @@ func (self *DirectedGraph) ShortestPathWithMultipleGoals(start string, goals []s
 		via = append(via, viaEdgesRev[len(viaEdgesRev)-i-1])
 	}
 
-	// Reset all nodes
+	return ret, via, nil
+}
+
+func (self *DirectedGraph) reset() {
 	for i := range self.nodes {
 		self.nodes[i].done = false
 		self.nodes[i].cost = -1
 		self.nodes[i].prev = nil
 		self.nodes[i].via = nil
 	}
-
-	return ret, via, nil
 }
 
 // つながっているノードのコストを計算する
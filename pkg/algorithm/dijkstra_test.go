@@ -46,3 +46,20 @@ func TestDijkstraWithMultipleGoals(t *testing.T) {
 	assert.Equal(t, 1, len(via))
 	assert.Equal(t, "hoge3", via[0].GetName())
 }
+
+func TestDijkstraGoalNotFound(t *testing.T) {
+	g := algorithm.NewDirectedGraph()
+
+	g.Add("1.23.2", "1.23.1", "hoge1", 1)
+	g.Add("1.23.3", "1.23.2", "hoge2", 1)
+
+	_, _, err := g.ShortestPath("1.23.1", "1.23.3")
+	assert.NotEqual(t, nil, err)
+	_, _, err = g.ShortestPath("1.23.5", "1.23.1")
+	assert.NotEqual(t, nil, err)
+
+	// nodes are reset after the failed search
+	path, _, err := g.ShortestPath("1.23.3", "1.23.1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(path))
+}
@@ -0,0 +1,349 @@
+package archivex
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+)
+
+// Archive-aware delta encoding.
+//
+// A compressed archive is converted into an "expanded" form where every
+// deflate stream that can be reproduced bit-exactly by compress/flate is
+// stored decompressed together with the level used to recompress it.
+// Streams that cannot be reproduced are kept as raw bytes, so expanding never
+// fails and contracting the expanded form always yields the original bytes.
+//
+// Only streams produced by compress/flate itself can be reproduced. Other
+// deflate implementations such as zlib, which produces most gzip, jar and
+// whl files, choose different matches and block boundaries, so their streams
+// never match and are kept raw. Such archives are still diffed correctly, but
+// the delta is computed between compressed bytes and is not smaller than
+// plain bsdiffx. A delta from the recompressed stream to the original one is
+// not stored either, because the two bit streams diverge from the first
+// different match and the delta is as large as the stream itself.
+//
+// Because expansion is a deterministic function of the input, the delta
+// between two archives is just the bsdiffx delta between their expanded forms,
+// and two such deltas can be merged with bsdiffx.DeltaMergingBytes.
+//
+// Expanded format
+// [ magic "D4CX" (4byte) ][ version (1byte) ]
+// [ segment kind (1byte) ][ deflate level (1byte) ][ length (8byte) ][ data ]
+// ...
+
+var (
+	ErrInvalidExpanded = errors.New("invalid expanded archive")
+
+	expandedMagic   = []byte("D4CX")
+	expandedVersion = byte(1)
+	sizeEncoding    = binary.BigEndian
+
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zipMagic  = []byte("PK\x03\x04")
+
+	// levels tried to reproduce deflate streams, most common first
+	deflateLevels = []int{6, 9, 1, 5, 4, 3, 2, 7, 8, 0}
+)
+
+const (
+	segmentRaw     = byte(0)
+	segmentDeflate = byte(1)
+)
+
+type segment struct {
+	kind  byte
+	level int
+	data  []byte
+}
+
+func IsGzip(b []byte) bool {
+	return bytes.HasPrefix(b, gzipMagic)
+}
+
+func IsZip(b []byte) bool {
+	return bytes.HasPrefix(b, zipMagic)
+}
+
+func IsArchive(b []byte) bool {
+	return IsGzip(b) || IsZip(b)
+}
+
+// Expand returns expanded form of b.
+// If b is not supported archive, b is stored as a single raw segment.
+func Expand(b []byte) []byte {
+	var segs []segment
+	var err error
+	switch {
+	case IsGzip(b):
+		segs, err = expandGzip(b)
+	case IsZip(b):
+		segs, err = expandZip(b)
+	}
+	if err != nil || segs == nil {
+		segs = []segment{{kind: segmentRaw, data: b}}
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(expandedMagic)
+	out.WriteByte(expandedVersion)
+	for _, s := range segs {
+		out.WriteByte(s.kind)
+		out.WriteByte(byte(s.level))
+		lenBytes := make([]byte, 8)
+		sizeEncoding.PutUint64(lenBytes, uint64(len(s.data)))
+		out.Write(lenBytes)
+		out.Write(s.data)
+	}
+
+	return out.Bytes()
+}
+
+// Contract restores original bytes from expanded form.
+func Contract(e []byte) ([]byte, error) {
+	if !bytes.HasPrefix(e, expandedMagic) || len(e) < len(expandedMagic)+1 {
+		return nil, ErrInvalidExpanded
+	}
+	pos := len(expandedMagic)
+	if e[pos] != expandedVersion {
+		return nil, fmt.Errorf("unsupported expanded version %d", e[pos])
+	}
+	pos += 1
+
+	out := &bytes.Buffer{}
+	for pos < len(e) {
+		if len(e)-pos < 10 {
+			return nil, ErrInvalidExpanded
+		}
+		kind := e[pos]
+		level := int(int8(e[pos+1]))
+		length := sizeEncoding.Uint64(e[pos+2 : pos+10])
+		pos += 10
+		if uint64(len(e)-pos) < length {
+			return nil, ErrInvalidExpanded
+		}
+		data := e[pos : pos+int(length)]
+		pos += int(length)
+
+		switch kind {
+		case segmentRaw:
+			out.Write(data)
+		case segmentDeflate:
+			w, err := flate.NewWriter(out, level)
+			if err != nil {
+				return nil, err
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected segment kind %d", kind)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func Diff(oldBytes, newBytes []byte, patchWriter io.Writer, mode bsdiffx.CompressionMode) error {
+	return bsdiffx.Diff(Expand(oldBytes), Expand(newBytes), patchWriter, mode)
+}
+
+func Patch(oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+	expanded, err := bsdiffx.Patch(Expand(oldBytes), patchReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return Contract(expanded)
+}
+
+func Merge(lowerDiff, upperDiff io.Reader, mergedDiff io.Writer) error {
+	return bsdiffx.DeltaMergingBytes(lowerDiff, upperDiff, mergedDiff)
+}
+
+// matchWriter fails as soon as written bytes differ from expected
+type matchWriter struct {
+	expected []byte
+	pos      int
+}
+
+var errUnmatched = errors.New("unmatched")
+
+func (mw *matchWriter) Write(b []byte) (int, error) {
+	if len(mw.expected)-mw.pos < len(b) || !bytes.Equal(mw.expected[mw.pos:mw.pos+len(b)], b) {
+		return 0, errUnmatched
+	}
+	mw.pos += len(b)
+	return len(b), nil
+}
+
+// findDeflateLevel returns the level with which compress/flate reproduces compressed from raw.
+// Streams compressed by other implementations (e.g. zlib) are not found.
+func findDeflateLevel(raw, compressed []byte) (int, bool) {
+	for _, level := range deflateLevels {
+		mw := &matchWriter{expected: compressed}
+		w, err := flate.NewWriter(mw, level)
+		if err != nil {
+			continue
+		}
+		_, err = w.Write(raw)
+		if err != nil {
+			continue
+		}
+		err = w.Close()
+		if err != nil {
+			continue
+		}
+		if mw.pos == len(compressed) {
+			return level, true
+		}
+	}
+
+	return 0, false
+}
+
+// inflate decompresses a deflate stream at the head of b and returns the
+// decompressed bytes and the length of the stream.
+func inflate(b []byte) ([]byte, int, error) {
+	// bytes.Reader implements io.ByteReader, so flate does not read ahead.
+	r := bytes.NewReader(b)
+	fr := flate.NewReader(r)
+	defer fr.Close()
+	data, err := io.ReadAll(fr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, len(b) - r.Len(), nil
+}
+
+func deflateSegment(compressed []byte) segment {
+	raw, _, err := inflate(compressed)
+	if err == nil {
+		if level, ok := findDeflateLevel(raw, compressed); ok {
+			return segment{kind: segmentDeflate, level: level, data: raw}
+		}
+	}
+
+	return segment{kind: segmentRaw, data: compressed}
+}
+
+func gzipHeaderLen(b []byte) (int, error) {
+	if len(b) < 10 || !IsGzip(b) {
+		return 0, fmt.Errorf("invalid gzip header")
+	}
+	flg := b[3]
+	pos := 10
+	if flg&0x04 != 0 { // FEXTRA
+		if len(b) < pos+2 {
+			return 0, fmt.Errorf("invalid gzip FEXTRA")
+		}
+		pos += 2 + int(binary.LittleEndian.Uint16(b[pos:pos+2]))
+	}
+	for _, f := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flg&f == 0 {
+			continue
+		}
+		idx := bytes.IndexByte(b[min(pos, len(b)):], 0)
+		if idx < 0 {
+			return 0, fmt.Errorf("invalid gzip string field")
+		}
+		pos += idx + 1
+	}
+	if flg&0x02 != 0 { // FHCRC
+		pos += 2
+	}
+	if pos > len(b) {
+		return 0, fmt.Errorf("invalid gzip header length")
+	}
+
+	return pos, nil
+}
+
+func expandGzip(b []byte) ([]segment, error) {
+	segs := []segment{}
+	pos := 0
+	for pos < len(b) && IsGzip(b[pos:]) {
+		headerLen, err := gzipHeaderLen(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, segment{kind: segmentRaw, data: b[pos : pos+headerLen]})
+		pos += headerLen
+
+		_, streamLen, err := inflate(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, deflateSegment(b[pos:pos+streamLen]))
+		pos += streamLen
+
+		// CRC32 and ISIZE
+		trailerLen := min(8, len(b)-pos)
+		segs = append(segs, segment{kind: segmentRaw, data: b[pos : pos+trailerLen]})
+		pos += trailerLen
+	}
+	if pos < len(b) {
+		segs = append(segs, segment{kind: segmentRaw, data: b[pos:]})
+	}
+
+	return segs, nil
+}
+
+func expandZip(b []byte) ([]segment, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*zip.File, 0, len(zr.File))
+	offsets := map[*zip.File]int64{}
+	for _, f := range zr.File {
+		off, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		offsets[f] = off
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return offsets[files[i]] < offsets[files[j]]
+	})
+
+	segs := []segment{}
+	pos := int64(0)
+	for _, f := range files {
+		off := offsets[f]
+		end := off + int64(f.CompressedSize64)
+		if off < pos || end > int64(len(b)) {
+			// overlapping or broken entries are kept as they are
+			continue
+		}
+		if off > pos {
+			segs = append(segs, segment{kind: segmentRaw, data: b[pos:off]})
+		}
+		if f.Method == zip.Deflate {
+			segs = append(segs, deflateSegment(b[off:end]))
+		} else {
+			segs = append(segs, segment{kind: segmentRaw, data: b[off:end]})
+		}
+		pos = end
+	}
+	if pos < int64(len(b)) {
+		segs = append(segs, segment{kind: segmentRaw, data: b[pos:]})
+	}
+
+	return segs, nil
+}
@@ -0,0 +1,108 @@
+package archivex_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/archivex"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(b []byte) []byte {
+	out := &bytes.Buffer{}
+	w, _ := gzip.NewWriterLevel(out, gzip.DefaultCompression)
+	w.Name = "file.txt"
+	_, _ = w.Write(b)
+	_ = w.Close()
+	return out.Bytes()
+}
+
+func zipBytes(b []byte) []byte {
+	out := &bytes.Buffer{}
+	w := zip.NewWriter(out)
+	f, _ := w.Create("a.txt")
+	_, _ = f.Write(b)
+	f, _ = w.Create("b.txt")
+	_, _ = f.Write([]byte("hello"))
+	_ = w.Close()
+	return out.Bytes()
+}
+
+func TestDiffAndPatch(t *testing.T) {
+	oldInner := bytes.Repeat([]byte("hello world "), 4096)
+	newInner := append([]byte{}, oldInner...)
+	newInner[100] = 'X'
+
+	for _, c := range []struct {
+		name string
+		pack func([]byte) []byte
+	}{
+		{"gzip", gzipBytes},
+		{"zip", zipBytes},
+		{"raw", func(b []byte) []byte { return b }},
+	} {
+		oldBytes := c.pack(oldInner)
+		newBytes := c.pack(newInner)
+
+		contracted, err := archivex.Contract(archivex.Expand(newBytes))
+		assert.Equal(t, nil, err, c.name)
+		assert.Equal(t, newBytes, contracted, c.name)
+
+		patch := &bytes.Buffer{}
+		err = archivex.Diff(oldBytes, newBytes, patch, bsdiffx.CompressionModeZstd)
+		assert.Equal(t, nil, err, c.name)
+
+		patched, err := archivex.Patch(oldBytes, patch)
+		assert.Equal(t, nil, err, c.name)
+		assert.Equal(t, newBytes, patched, c.name)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	v1 := bytes.Repeat([]byte("hello world "), 4096)
+	v2 := append([]byte{}, v1...)
+	v2[100] = 'X'
+	v3 := append([]byte{}, v2...)
+	v3[2000] = 'Y'
+
+	lower := &bytes.Buffer{}
+	err := archivex.Diff(gzipBytes(v1), gzipBytes(v2), lower, bsdiffx.CompressionModeZstd)
+	assert.Equal(t, nil, err)
+	upper := &bytes.Buffer{}
+	err = archivex.Diff(gzipBytes(v2), gzipBytes(v3), upper, bsdiffx.CompressionModeZstd)
+	assert.Equal(t, nil, err)
+
+	merged := &bytes.Buffer{}
+	err = archivex.Merge(lower, upper, merged)
+	assert.Equal(t, nil, err)
+
+	patched, err := archivex.Patch(gzipBytes(v1), merged)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, gzipBytes(v3), patched)
+}
+
+// testdata/zlib-*.txt.gz are generated by Python's gzip module (zlib 1.2.13, level 6)
+func TestZlibGzip(t *testing.T) {
+	oldBytes, err := os.ReadFile("testdata/zlib-old.txt.gz")
+	assert.Equal(t, nil, err)
+	newBytes, err := os.ReadFile("testdata/zlib-new.txt.gz")
+	assert.Equal(t, nil, err)
+
+	// zlib streams are not reproduced by compress/flate and are kept compressed
+	expanded := archivex.Expand(newBytes)
+	assert.Less(t, len(expanded), 2*len(newBytes))
+	contracted, err := archivex.Contract(expanded)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, newBytes, contracted)
+
+	patch := &bytes.Buffer{}
+	err = archivex.Diff(oldBytes, newBytes, patch, bsdiffx.CompressionModeZstd)
+	assert.Equal(t, nil, err)
+	patched, err := archivex.Patch(oldBytes, patch)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, newBytes, patched)
+}
@@ -0,0 +1,186 @@
+package bsdiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Chain plugin is a built-in plugin to keep patches generated by different plugins.
+// When two diffs with different plugins are merged, the merged diff is a list of
+// the patches and they are applied in order with their own plugins.
+//
+// Chain patch format
+// [ magic "D4CC" (4byte) ][ the number of patches (uvarint) ]
+// [ plugin uuid (16byte) ][ patch length (uvarint) ][ patch ]
+// ...
+
+var (
+	ChainPluginUuid = uuid.MustParse("0c6e2f8a-3d41-4b7e-9a52-d81f6c0b3e97")
+
+	ErrInvalidChain = errors.New("invalid chain patch")
+
+	chainMagic = []byte("D4CC")
+)
+
+type chainedPatch struct {
+	pluginUuid uuid.UUID
+	patch      []byte
+}
+
+func encodeChain(patches []chainedPatch) []byte {
+	out := &bytes.Buffer{}
+	out.Write(chainMagic)
+	out.Write(binary.AppendUvarint(nil, uint64(len(patches))))
+	for _, p := range patches {
+		out.Write(p.pluginUuid[:])
+		out.Write(binary.AppendUvarint(nil, uint64(len(p.patch))))
+		out.Write(p.patch)
+	}
+
+	return out.Bytes()
+}
+
+func decodeChain(r io.Reader) ([]chainedPatch, error) {
+	// lengths in the patch are bounded by the remaining input before allocation
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(data)
+	magic := make([]byte, len(chainMagic))
+	_, err = io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, chainMagic) {
+		return nil, ErrInvalidChain
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil || count > uint64(br.Len()) {
+		return nil, ErrInvalidChain
+	}
+
+	patches := []chainedPatch{}
+	for i := uint64(0); i < count; i++ {
+		p := chainedPatch{}
+		_, err = io.ReadFull(br, p.pluginUuid[:])
+		if err != nil {
+			return nil, ErrInvalidChain
+		}
+		length, err := binary.ReadUvarint(br)
+		if err != nil || length > uint64(br.Len()) {
+			return nil, ErrInvalidChain
+		}
+		p.patch = make([]byte, length)
+		_, err = io.ReadFull(br, p.patch)
+		if err != nil {
+			return nil, ErrInvalidChain
+		}
+		patches = append(patches, p)
+	}
+
+	return patches, nil
+}
+
+// flatten returns patches of the diff. chain patches are expanded.
+func flatten(pluginUuid uuid.UUID, diff []byte) ([]chainedPatch, error) {
+	if pluginUuid != ChainPluginUuid {
+		return []chainedPatch{{pluginUuid: pluginUuid, patch: diff}}, nil
+	}
+
+	return decodeChain(bytes.NewReader(diff))
+}
+
+// ComposePatches merges lowerDiff and upperDiff generated by any plugins.
+// The result is a chain patch to be applied with the chain plugin.
+// Adjacent patches with the same plugin are merged with the plugin.
+func (pm *PluginManager) ComposePatches(lowerUuid uuid.UUID, lowerDiff []byte, upperUuid uuid.UUID, upperDiff []byte) ([]byte, error) {
+	lower, err := flatten(lowerUuid, lowerDiff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode lower: %v", err)
+	}
+	upper, err := flatten(upperUuid, upperDiff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode upper: %v", err)
+	}
+
+	if len(lower) > 0 && len(upper) > 0 && lower[len(lower)-1].pluginUuid == upper[0].pluginUuid {
+		last := lower[len(lower)-1]
+		p := pm.GetPluginByUuid(last.pluginUuid)
+		if p == nil {
+			return nil, fmt.Errorf("plugin for %s not found", last.pluginUuid)
+		}
+		merged := &bytes.Buffer{}
+		err = p.Merge(bytes.NewBuffer(last.patch), bytes.NewBuffer(upper[0].patch), merged)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge with %s: %v", last.pluginUuid, err)
+		}
+		lower[len(lower)-1].patch = merged.Bytes()
+		upper = upper[1:]
+	}
+
+	return encodeChain(append(lower, upper...)), nil
+}
+
+func newChainPlugin(pm *PluginManager) *Plugin {
+	p := &Plugin{}
+
+	p.info = func() string {
+		return "Built-in plugin to chain patches of different plugins"
+	}
+	p.diff = func(oldBytes, newBytes []byte, patchWriter io.Writer, mode CompressionMode) error {
+		return fmt.Errorf("chain plugin does not support diff")
+	}
+	p.patch = func(oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+		patches, err := decodeChain(patchReader)
+		if err != nil {
+			return nil, err
+		}
+		data := oldBytes
+		for _, cp := range patches {
+			plugin := pm.GetPluginByUuid(cp.pluginUuid)
+			if plugin == nil {
+				return nil, fmt.Errorf("plugin for %s not found", cp.pluginUuid)
+			}
+			data, err = plugin.Patch(data, bytes.NewBuffer(cp.patch))
+			if err != nil {
+				return nil, fmt.Errorf("failed to patch with %s: %v", cp.pluginUuid, err)
+			}
+		}
+		return data, nil
+	}
+	p.merge = func(lowerDiff, upperDiff io.Reader, mergedDiff io.Writer) error {
+		lowerBytes, err := io.ReadAll(lowerDiff)
+		if err != nil {
+			return err
+		}
+		upperBytes, err := io.ReadAll(upperDiff)
+		if err != nil {
+			return err
+		}
+		merged, err := pm.ComposePatches(ChainPluginUuid, lowerBytes, ChainPluginUuid, upperBytes)
+		if err != nil {
+			return err
+		}
+		_, err = mergedDiff.Write(merged)
+		return err
+	}
+	p.compare = defaultCompare
+	p.id = func() uuid.UUID {
+		return ChainPluginUuid
+	}
+
+	return p
+}
+
+func chainPluginEntry(pm *PluginManager) PluginEntry {
+	return PluginEntry{
+		Name: "chain",
+		Uuid: ChainPluginUuid,
+		Size: math.MaxInt, // never selected by size
+		p:    newChainPlugin(pm),
+	}
+}
@@ -0,0 +1,36 @@
+package bsdiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeChain(t *testing.T) {
+	patches := []chainedPatch{
+		{pluginUuid: uuid.New(), patch: []byte("first")},
+		{pluginUuid: uuid.New(), patch: []byte{}},
+	}
+	decoded, err := decodeChain(bytes.NewReader(encodeChain(patches)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, patches, decoded)
+
+	// lengths larger than the remaining input are rejected before allocation
+	huge := append([]byte{}, chainMagic...)
+	huge = binary.AppendUvarint(huge, 1)
+	huge = append(huge, make([]byte, 16)...)
+	huge = binary.AppendUvarint(huge, 1<<62)
+	_, err = decodeChain(bytes.NewReader(huge))
+	assert.Equal(t, ErrInvalidChain, err)
+
+	huge = binary.AppendUvarint(append([]byte{}, chainMagic...), 1<<62)
+	_, err = decodeChain(bytes.NewReader(huge))
+	assert.Equal(t, ErrInvalidChain, err)
+
+	encoded := encodeChain(patches)
+	_, err = decodeChain(bytes.NewReader(encoded[:len(encoded)-1]))
+	assert.Equal(t, ErrInvalidChain, err)
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"plugin"
+	"slices"
 
 	"github.com/google/uuid"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	log "github.com/sirupsen/logrus"
 )
 
 type PluginEntry struct {
@@ -19,7 +22,13 @@ type PluginEntry struct {
 	Ext  string    `json:"ext"`
 	Size int       `json:"size"`
 
+	// Exts and Magics are used to route files to content-specific plugins
+	Exts   []string `json:"exts,omitempty"`
+	Magics []string `json:"magics,omitempty"`
+
 	p *Plugin `json:"-"`
+	// missing optional plugins are skipped
+	optional bool `json:"-"`
 }
 
 type PluginManager struct {
@@ -34,6 +43,8 @@ func LoadOrDefaultPlugins(path string) (*PluginManager, error) {
 	}
 	xdelta3Plugin := filepath.Join(filepath.Dir(d4cBinPath), "plugin_xdelta3.so")
 	bsdiffxPlugin := filepath.Join(filepath.Dir(d4cBinPath), "plugin_bsdiffx.so")
+	archivePlugin := filepath.Join(filepath.Dir(d4cBinPath), "plugin_archive.so")
+	elfPlugin := filepath.Join(filepath.Dir(d4cBinPath), "plugin_elf.so")
 	_ = xdelta3Plugin
 	mgr := &PluginManager{
 		defaultPlugin: DefaultPluigin(),
@@ -47,18 +58,39 @@ func LoadOrDefaultPlugins(path string) (*PluginManager, error) {
 				Name: "bsdiffx",
 				Path: bsdiffxPlugin,
 			},
+			{
+				Name:     "archive",
+				Path:     archivePlugin,
+				Size:     math.MaxInt, // never selected by size
+				Exts:     []string{".gz", ".tgz", ".zip", ".jar", ".war", ".whl", ".egg", ".apk"},
+				Magics:   []string{"\x1f\x8b\x08", "PK\x03\x04"},
+				optional: true,
+			},
+			{
+				Name:     "elf",
+				Path:     elfPlugin,
+				Size:     math.MaxInt, // never selected by size
+				Magics:   []string{"\x7fELF"},
+				optional: true,
+			},
 		},
 	}
 	if path == "" {
-		for i := range mgr.plugins {
-			pe := &mgr.plugins[i]
+		plugins := []PluginEntry{}
+		for _, pe := range mgr.plugins {
 			p, err := OpenPlugin(pe.Path)
 			if err != nil {
+				if pe.optional {
+					log.Warnf("skipped optional plugin %s (%s): %v", pe.Name, pe.Path, err)
+					continue
+				}
 				return nil, fmt.Errorf("failed to open %s (%s): %v", pe.Name, pe.Path, err)
 			}
 			pe.p = p
 			pe.Uuid = p.ID()
+			plugins = append(plugins, pe)
 		}
+		mgr.plugins = append(plugins, chainPluginEntry(mgr))
 		return mgr, nil
 	}
 
@@ -76,6 +108,7 @@ func LoadOrDefaultPlugins(path string) (*PluginManager, error) {
 		pe.p = p
 		mgr.plugins = append(mgr.plugins, pe)
 	}
+	mgr.plugins = append(mgr.plugins, chainPluginEntry(mgr))
 
 	return mgr, nil
 }
@@ -91,6 +124,25 @@ func (pm *PluginManager) GetPluginByExt(ext string) *Plugin {
 	return pm.defaultPlugin
 }
 
+// GetPluginByFile returns the plugin matched with the file's extension or magic bytes.
+// If no plugin matches, it returns nil.
+func (pm *PluginManager) GetPluginByFile(name string, head []byte) *Plugin {
+	ext := filepath.Ext(name)
+	for i := range pm.plugins {
+		pe := pm.plugins[i]
+		if ext != "" && slices.Contains(pe.Exts, ext) {
+			return pe.p
+		}
+		for _, magic := range pe.Magics {
+			if bytes.HasPrefix(head, []byte(magic)) {
+				return pe.p
+			}
+		}
+	}
+
+	return nil
+}
+
 func (pm *PluginManager) GetPluginByName(name string) *Plugin {
 	for i := range pm.plugins {
 		pe := pm.plugins[i]
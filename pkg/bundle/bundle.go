@@ -0,0 +1,353 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var logger = log.G(context.TODO())
+
+// Bundle format (tar)
+// manifest.json
+// blobs/<sha256 of dimg or config>
+
+const (
+	BUNDLE_VERSION       = 1
+	BUNDLE_MANIFEST_NAME = "manifest.json"
+	BUNDLE_BLOBS_DIR     = "blobs"
+)
+
+type Manifest struct {
+	Version int `json:"version"`
+	// the image id required on the target node. empty if the lowest dimg is a base image
+	BaseId digest.Digest `json:"baseId"`
+	// ordered from the lowest to the top
+	Dimgs []Dimg `json:"dimgs"`
+}
+
+type Dimg struct {
+	// name:version
+	Tag          string        `json:"tag"`
+	Id           digest.Digest `json:"id"`
+	ParentId     digest.Digest `json:"parentId"`
+	HeaderDigest digest.Digest `json:"headerDigest"`
+	Blob         Blob          `json:"blob"`
+	Config       Blob          `json:"config"`
+}
+
+type Blob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+func blobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, BUNDLE_BLOBS_DIR, d.Encoded())
+}
+
+// Create writes the bundle with dimgs to reconstruct toTag from the image fromId.
+// If fromId is empty or a cheaper path from a base image exists, the bundle includes the base image.
+// Untagged dimgs in the path are merged into the upper dimg so that every dimg in the bundle can be loaded.
+func Create(store *image.DimgStore, fromId digest.Digest, toTag string, tmpDir string, mc image.MergeConfig, pm *bsdiffx.PluginManager, out io.Writer) (*Manifest, error) {
+	toId, ok := store.GetTag(toTag)
+	if !ok {
+		return nil, fmt.Errorf("tag %s not found", toTag)
+	}
+	goals := []digest.Digest{""}
+	if fromId != "" {
+		goals = append(goals, fromId)
+	}
+	chain, err := store.GetDimgEntriesWithObjective(toId, goals, image.PathObjectiveBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dimgs from %s to %v: %v", toId, goals, err)
+	}
+
+	toName := strings.Split(toTag, ":")[0]
+	tags := map[digest.Digest]string{}
+	for tag, id := range store.Tags() {
+		// prefer tags of the same image
+		if existing, ok := tags[id]; ok && strings.HasPrefix(existing, toName+":") {
+			continue
+		}
+		tags[id] = tag
+	}
+	tags[toId] = toTag
+
+	manifest := &Manifest{
+		Version: BUNDLE_VERSION,
+		BaseId:  chain[len(chain)-1].ParentId,
+		Dimgs:   []Dimg{},
+	}
+	dimgs := []*image.DimgEntry{}
+	// chain[0] is the top
+	group := []*image.DimgEntry{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		group = append([]*image.DimgEntry{chain[i]}, group...)
+		tag, ok := tags[chain[i].Id]
+		if !ok {
+			continue
+		}
+
+		dimg := group[0]
+		if len(group) > 1 {
+			logger.Infof("merging %d dimgs for %s", len(group), tag)
+			dimg, err = image.MergeDimgsWithPlan(group, tmpDir, mc, false, pm)
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge dimgs for %s: %v", tag, err)
+			}
+		}
+		group = []*image.DimgEntry{}
+		if dimg.ConfigBytes == nil {
+			return nil, fmt.Errorf("config for %s not found", tag)
+		}
+
+		blob, err := dimgBlob(dimg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get digest of %s: %v", dimg.Path, err)
+		}
+		manifest.Dimgs = append(manifest.Dimgs, Dimg{
+			Tag:          tag,
+			Id:           dimg.Id,
+			ParentId:     dimg.ParentId,
+			HeaderDigest: dimg.Digest(),
+			Blob:         blob,
+			Config: Blob{
+				Digest: digest.FromBytes(dimg.ConfigBytes),
+				Size:   int64(len(dimg.ConfigBytes)),
+			},
+		})
+		dimgs = append(dimgs, dimg)
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(out)
+	err = writeTarFile(tw, BUNDLE_MANIFEST_NAME, int64(len(manifestBytes)), bytes.NewReader(manifestBytes))
+	if err != nil {
+		return nil, err
+	}
+	written := map[digest.Digest]struct{}{}
+	for i, d := range manifest.Dimgs {
+		// dimgs may share the config
+		if _, ok := written[d.Config.Digest]; !ok {
+			err = writeTarFile(tw, filepath.Join(BUNDLE_BLOBS_DIR, d.Config.Digest.Encoded()), d.Config.Size, bytes.NewReader(dimgs[i].ConfigBytes))
+			if err != nil {
+				return nil, err
+			}
+			written[d.Config.Digest] = struct{}{}
+		}
+		err = writeDimg(tw, filepath.Join(BUNDLE_BLOBS_DIR, d.Blob.Digest.Encoded()), d.Blob.Size, dimgs[i].Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, tw.Close()
+}
+
+// dimgBlob returns the blob of the self-contained dimg even if the dimg in the store is deduplicated
+func dimgBlob(path string) (Blob, error) {
+	f, err := image.OpenDimgFile(path)
+	if err != nil {
+		return Blob{}, err
+	}
+	defer f.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := f.WriteAll(digester.Hash())
+	if err != nil {
+		return Blob{}, err
+	}
+	return Blob{Digest: digester.Digest(), Size: size}, nil
+}
+
+func writeDimg(tw *tar.Writer, name string, size int64, path string) error {
+	f, err := image.OpenDimgFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := f.WriteAll(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	return writeTarFile(tw, name, size, pr)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write header of %s: %v", name, err)
+	}
+	_, err = io.Copy(tw, r)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// Extract extracts the bundle from r into dir and verifies it.
+func Extract(r io.Reader, dir string) (*Manifest, error) {
+	err := os.MkdirAll(filepath.Join(dir, BUNDLE_BLOBS_DIR), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *Manifest
+	blobs := map[digest.Digest]Blob{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %v", err)
+		}
+
+		if h.Name == BUNDLE_MANIFEST_NAME {
+			manifest = &Manifest{}
+			err = json.NewDecoder(tr).Decode(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode manifest: %v", err)
+			}
+			if manifest.Version != BUNDLE_VERSION {
+				return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+			}
+			for _, d := range manifest.Dimgs {
+				blobs[d.Blob.Digest] = d.Blob
+				blobs[d.Config.Digest] = d.Config
+			}
+			continue
+		}
+		if manifest == nil {
+			return nil, fmt.Errorf("manifest must be the first entry")
+		}
+
+		d := digest.NewDigestFromEncoded(digest.Canonical, filepath.Base(h.Name))
+		blob, ok := blobs[d]
+		if !ok || filepath.Dir(h.Name) != BUNDLE_BLOBS_DIR {
+			return nil, fmt.Errorf("unexpected entry %s", h.Name)
+		}
+		err = extractBlob(tr, blobPath(dir, d), blob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %v", h.Name, err)
+		}
+		delete(blobs, d)
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("manifest not found")
+	}
+	if len(blobs) != 0 {
+		return nil, fmt.Errorf("%d blobs not found", len(blobs))
+	}
+
+	err = verify(manifest, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify bundle: %v", err)
+	}
+
+	return manifest, nil
+}
+
+func extractBlob(r io.Reader, path string, blob Blob) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), r)
+	if err != nil {
+		return err
+	}
+	if size != blob.Size || digester.Digest() != blob.Digest {
+		return fmt.Errorf("blob is broken (expected=%s size=%d actual=%s size=%d)", blob.Digest, blob.Size, digester.Digest(), size)
+	}
+	return nil
+}
+
+// verify checks dimgs and configs in dir are consistent with the manifest
+func verify(manifest *Manifest, dir string) error {
+	if len(manifest.Dimgs) == 0 {
+		return fmt.Errorf("no dimgs")
+	}
+	parentId := manifest.BaseId
+	for _, d := range manifest.Dimgs {
+		if d.ParentId != parentId {
+			return fmt.Errorf("dimg for %s does not follow %s (parentId=%s)", d.Tag, parentId, d.ParentId)
+		}
+		parentId = d.Id
+
+		dimgFile, err := image.OpenDimgFile(DimgPath(dir, d))
+		if err != nil {
+			return fmt.Errorf("failed to open dimg for %s: %v", d.Tag, err)
+		}
+		header := dimgFile.DimgHeader()
+		dimgFile.Close()
+		if header.Id != d.Id || header.ParentId != d.ParentId || header.Digest() != d.HeaderDigest {
+			return fmt.Errorf("header of dimg for %s does not match the manifest", d.Tag)
+		}
+
+		cdimgHeader, err := CdimgHeader(dir, d)
+		if err != nil {
+			return fmt.Errorf("failed to read config for %s: %v", d.Tag, err)
+		}
+		config := cdimgHeader.Config
+		if len(config.RootFS.DiffIDs) == 0 || config.RootFS.DiffIDs[0] != d.Id {
+			return fmt.Errorf("config for %s does not refer %s", d.Tag, d.Id)
+		}
+	}
+	return nil
+}
+
+func DimgPath(dir string, d Dimg) string {
+	return blobPath(dir, d.Blob.Digest)
+}
+
+// CdimgHeader returns the header to load the dimg as a cdimg
+func CdimgHeader(dir string, d Dimg) (*image.CdimgHeader, error) {
+	configBytes, err := os.ReadFile(blobPath(dir, d.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+	config := v1.Image{}
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &image.CdimgHeader{
+		Head: image.CdimgHeadHeader{
+			ConfigSize: d.Config.Size,
+			DimgSize:   d.Blob.Size,
+			DimgDigest: d.HeaderDigest,
+		},
+		Config:      config,
+		ConfigBytes: configBytes,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package bundle_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bundle"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPluginManager returns PluginManager without plugins built as shared objects
+func testPluginManager(t *testing.T) *bsdiffx.PluginManager {
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	err := os.WriteFile(path, []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := bsdiffx.LoadOrDefaultPlugins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
+
+func packVersion(t *testing.T, version int) string {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "version"), []byte(fmt.Sprintf("v%d", version)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "common"), []byte("common"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "image.dimg")
+	err = image.PackDir(context.Background(), dir, out, 4, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func diffDimg(t *testing.T, oldDimg, newDimg string, pm *bsdiffx.PluginManager) string {
+	out := filepath.Join(t.TempDir(), "diff.dimg")
+	dc := image.DiffConfig{
+		ThreadNum:    4,
+		ScheduleMode: image.DIFF_MULTI_SCHED_NONE,
+	}
+	err := image.GenerateDiffFromDimg(context.Background(), oldDimg, newDimg, out, false, dc, pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func dimgHeader(t *testing.T, path string) *image.DimgHeader {
+	f, err := image.OpenDimgFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header := *f.DimgHeader()
+	return &header
+}
+
+func configBytes(t *testing.T, id digest.Digest) []byte {
+	b, err := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{id}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newTestStore returns the store with app:v1 (base), the untagged diff to v2 and app:v3 (diff from v2)
+func newTestStore(t *testing.T, pm *bsdiffx.PluginManager) (*image.DimgStore, []*image.DimgHeader) {
+	v1Dimg := packVersion(t, 1)
+	v2Dimg := packVersion(t, 2)
+	v3Dimg := packVersion(t, 3)
+
+	store, err := image.NewDimgStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	headers := []*image.DimgHeader{}
+	for _, p := range []string{v1Dimg, diffDimg(t, v1Dimg, v2Dimg, pm), diffDimg(t, v2Dimg, v3Dimg, pm)} {
+		h := dimgHeader(t, p)
+		headers = append(headers, h)
+		err = store.AddDimg(p, configBytes(t, h.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, nil, store.SetTag("app:v1", headers[0].Id))
+	assert.Equal(t, nil, store.SetTag("app:v3", headers[2].Id))
+	return store, headers
+}
+
+func TestCreateAndExtract(t *testing.T) {
+	pm := testPluginManager(t)
+	store, headers := newTestStore(t, pm)
+	mc := image.MergeConfig{ThreadNum: 4, MergeDimgConcurrentNum: 1}
+
+	for _, c := range []struct {
+		name   string
+		fromId digest.Digest
+		tags   []string
+	}{
+		{"from v1", headers[0].Id, []string{"app:v3"}},
+		{"from scratch", "", []string{"app:v1", "app:v3"}},
+	} {
+		out := &bytes.Buffer{}
+		created, err := bundle.Create(store, c.fromId, "app:v3", t.TempDir(), mc, pm, out)
+		assert.Equal(t, nil, err, c.name)
+
+		dir := t.TempDir()
+		extracted, err := bundle.Extract(out, dir)
+		assert.Equal(t, nil, err, c.name)
+		assert.Equal(t, created, extracted, c.name)
+		assert.Equal(t, c.fromId, extracted.BaseId, c.name)
+
+		tags := []string{}
+		for _, d := range extracted.Dimgs {
+			tags = append(tags, d.Tag)
+		}
+		assert.Equal(t, c.tags, tags, c.name)
+
+		// the untagged diff to v2 is merged into the dimg for app:v3
+		top := extracted.Dimgs[len(extracted.Dimgs)-1]
+		header := dimgHeader(t, bundle.DimgPath(dir, top))
+		assert.Equal(t, headers[2].Id, header.Id, c.name)
+		assert.Equal(t, headers[0].Id, header.ParentId, c.name)
+		cdimgHeader, err := bundle.CdimgHeader(dir, top)
+		assert.Equal(t, nil, err, c.name)
+		assert.Equal(t, configBytes(t, headers[2].Id), cdimgHeader.ConfigBytes, c.name)
+	}
+}
+
+func TestExtractBroken(t *testing.T) {
+	pm := testPluginManager(t)
+	store, _ := newTestStore(t, pm)
+	mc := image.MergeConfig{ThreadNum: 4, MergeDimgConcurrentNum: 1}
+
+	out := &bytes.Buffer{}
+	_, err := bundle.Create(store, "", "app:v3", t.TempDir(), mc, pm, out)
+	assert.Equal(t, nil, err)
+
+	// rewrite the bundle with a broken or missing blob
+	rewrite := func(modify func(name string, body []byte) []byte) io.Reader {
+		rewritten := &bytes.Buffer{}
+		tr := tar.NewReader(bytes.NewReader(out.Bytes()))
+		tw := tar.NewWriter(rewritten)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Equal(t, nil, err)
+			body, err := io.ReadAll(tr)
+			assert.Equal(t, nil, err)
+			body = modify(h.Name, body)
+			if body == nil {
+				continue
+			}
+			h.Size = int64(len(body))
+			assert.Equal(t, nil, tw.WriteHeader(h))
+			_, err = tw.Write(body)
+			assert.Equal(t, nil, err)
+		}
+		assert.Equal(t, nil, tw.Close())
+		return rewritten
+	}
+
+	_, err = bundle.Extract(rewrite(func(name string, body []byte) []byte {
+		if name != bundle.BUNDLE_MANIFEST_NAME {
+			body[len(body)-1] ^= 0xff
+		}
+		return body
+	}), t.TempDir())
+	assert.NotEqual(t, nil, err)
+
+	_, err = bundle.Extract(rewrite(func(name string, body []byte) []byte {
+		if name != bundle.BUNDLE_MANIFEST_NAME {
+			return nil
+		}
+		return body
+	}), t.TempDir())
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,219 @@
+package di3fs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+const patchedFileCacheTmpPrefix = "tmp-"
+
+// PatchedFileCache keeps patched files keyed by FileEntry.Digest in a directory shared by mounts.
+// Files are kept after unmount and reused by other mounts or after restart.
+// Least recently used files are removed when the total size exceeds quota,
+// but files opened by mounts are never removed.
+type PatchedFileCache struct {
+	dir string
+	// not limited if quota is 0
+	quota   int64
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[digest.Digest]*list.Element
+	size    int64
+}
+
+type patchedFileCacheEntry struct {
+	digest digest.Digest
+	size   int64
+	refs   int
+}
+
+// NewPatchedFileCache opens the cache in dir with files cached before.
+func NewPatchedFileCache(dir string, quota int64) (*PatchedFileCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", dir, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ReadDir %s: %v", dir, err)
+	}
+
+	c := &PatchedFileCache{
+		dir:     dir,
+		quota:   quota,
+		lock:    sync.Mutex{},
+		lru:     list.New(),
+		entries: map[digest.Digest]*list.Element{},
+	}
+
+	type cachedFile struct {
+		entry   *patchedFileCacheEntry
+		modTime time.Time
+	}
+	cached := []cachedFile{}
+	for _, f := range files {
+		fPath := filepath.Join(dir, f.Name())
+		d := digest.NewDigestFromEncoded(digest.Canonical, f.Name())
+		if strings.HasPrefix(f.Name(), patchedFileCacheTmpPrefix) || !f.Type().IsRegular() || d.Validate() != nil {
+			// interrupted while writing
+			os.RemoveAll(fPath)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		cached = append(cached, cachedFile{
+			entry:   &patchedFileCacheEntry{digest: d, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+	}
+	// the modification time is updated when the file is used
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].modTime.After(cached[j].modTime)
+	})
+	for _, f := range cached {
+		c.entries[f.entry.digest] = c.lru.PushBack(f.entry)
+		c.size += f.entry.size
+	}
+	log.Infof("patched file cache %s is loaded (files=%d size=%d)", dir, len(c.entries), c.size)
+
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+
+	return c, nil
+}
+
+func (c *PatchedFileCache) path(d digest.Digest) string {
+	return filepath.Join(c.dir, d.Encoded())
+}
+
+// Open opens the cached file of d. The file is not removed until Release is called.
+func (c *PatchedFileCache) Open(d digest.Digest) (*os.File, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[d]
+	if !ok {
+		metricCacheMisses.Inc()
+		return nil, false
+	}
+	entry := elem.Value.(*patchedFileCacheEntry)
+	f, err := os.Open(c.path(d))
+	if err != nil {
+		log.Warnf("failed to open cached file %s: %v", d, err)
+		c.lru.Remove(elem)
+		delete(c.entries, d)
+		c.size -= entry.size
+		metricCacheMisses.Inc()
+		return nil, false
+	}
+	metricCacheHits.Inc()
+	entry.refs++
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(c.path(d), now, now)
+	return f, true
+}
+
+// Put writes the file of fe from r into the cache while verifying it, and opens it.
+// The file is not removed until Release is called.
+func (c *PatchedFileCache) Put(fe *image.FileEntry, r io.Reader) (*os.File, error) {
+	digester, err := fe.Digester()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(c.dir, patchedFileCacheTmpPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to creat temporary file: %v", err)
+	}
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), r)
+	if err == nil && digester.Digest() != fe.Digest {
+		err = fmt.Errorf("failed to verify digest")
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// the same file may be put by another mount
+	if elem, ok := c.entries[fe.Digest]; ok {
+		file.Close()
+		os.Remove(file.Name())
+		f, err := os.Open(c.path(fe.Digest))
+		if err != nil {
+			return nil, err
+		}
+		elem.Value.(*patchedFileCacheEntry).refs++
+		c.lru.MoveToFront(elem)
+		return f, nil
+	}
+
+	err = os.Rename(file.Name(), c.path(fe.Digest))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	entry := &patchedFileCacheEntry{digest: fe.Digest, size: size, refs: 1}
+	c.entries[fe.Digest] = c.lru.PushFront(entry)
+	c.size += size
+	c.evict()
+	if c.quota != 0 && c.size > c.quota {
+		log.Warnf("patched files in use (%d bytes) exceed quota %d", c.size, c.quota)
+	}
+	return file, nil
+}
+
+// Release releases the reference taken by Open or Put
+func (c *PatchedFileCache) Release(d digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[d]
+	if !ok {
+		return
+	}
+	elem.Value.(*patchedFileCacheEntry).refs--
+	c.evict()
+}
+
+// evict removes least recently used files not opened until the total size is within quota.
+// must be called with c.lock held
+func (c *PatchedFileCache) evict() {
+	if c.quota == 0 {
+		return
+	}
+	for elem := c.lru.Back(); elem != nil && c.size > c.quota; {
+		prev := elem.Prev()
+		entry := elem.Value.(*patchedFileCacheEntry)
+		if entry.refs == 0 {
+			err := os.Remove(c.path(entry.digest))
+			if err != nil && !os.IsNotExist(err) {
+				log.Errorf("failed to remove cached file %s: %v", entry.digest, err)
+			} else {
+				c.lru.Remove(elem)
+				delete(c.entries, entry.digest)
+				c.size -= entry.size
+				log.Debugf("evicted cached file %s", entry.digest)
+			}
+		}
+		elem = prev
+	}
+}
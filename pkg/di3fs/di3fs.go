@@ -17,6 +17,7 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,7 +36,15 @@ type Di3fsNode struct {
 	patchedFile     *os.File
 	patchedFilePath string
 	root            *Di3fsRoot
-	plugin          *bsdiffx.Plugin
+	// patchedFile is opened from PatchedFileCache
+	cached bool
+
+	// set if the body is read by frames instead of patchedFile
+	frameEntry     *image.FileEntry
+	frameImage     *image.DimgFile
+	frameLock      sync.Mutex
+	cachedFrame    []byte
+	cachedFrameIdx int
 }
 
 var _ = (fs.NodeGetattrer)((*Di3fsNode)(nil))
@@ -63,16 +72,20 @@ func (dn *Di3fsNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.Att
 	return 0
 }
 
+// readBaseFiles returns the body of the file in the upper base image.
+// Bodies in the middle of the chain are read from PatchedFileCache if cached.
 func (dn *Di3fsNode) readBaseFiles() ([]byte, error) {
 	diffIdxs := make([]int, 0)
 	for i := 0; i < len(dn.baseMeta); i++ {
 		baseMeta := dn.baseMeta[i]
 		baseImageOffset := dn.baseMeta[i].Offset
 		baseImageFile := dn.root.baseImageFiles[i]
-		if baseMeta.IsSame() {
+		var data []byte
+		if cached, ok := dn.readCachedFile(baseMeta.Digest); ok {
+			data = cached
+		} else if baseMeta.IsSame() {
 			continue
-		}
-		if baseMeta.IsNew() {
+		} else if baseMeta.IsNew() {
 			zstdBytes := make([]byte, baseMeta.CompressedSize)
 			_, err := baseImageFile.ReadAt(zstdBytes, baseImageOffset)
 			if err != nil {
@@ -83,59 +96,118 @@ func (dn *Di3fsNode) readBaseFiles() ([]byte, error) {
 				return nil, err
 			}
 			defer zstdReader.Close()
-			data, err := io.ReadAll(zstdReader)
+			data, err = io.ReadAll(zstdReader)
 			if err != nil {
 				return nil, err
 			}
-			if len(diffIdxs) == 0 {
-				return data, nil
+			metricDecompressedBytes.Add(float64(len(data)))
+		} else {
+			diffIdxs = append(diffIdxs, i)
+			continue
+		}
+
+		if len(diffIdxs) == 0 {
+			return data, nil
+		}
+		for j := len(diffIdxs) - 1; j >= 0; j -= 1 {
+			diffIdx := diffIdxs[j]
+			patchBytes := make([]byte, dn.baseMeta[diffIdx].CompressedSize)
+			_, err := dn.root.baseImageFiles[diffIdx].ReadAt(patchBytes, dn.baseMeta[diffIdx].Offset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read patch from image: %v", err)
 			}
-			for j := len(diffIdxs) - 1; j >= 0; j -= 1 {
-				diffIdx := diffIdxs[j]
-				patchBytes := make([]byte, dn.baseMeta[diffIdx].CompressedSize)
-				_, err := dn.root.baseImageFiles[diffIdx].ReadAt(patchBytes, dn.baseMeta[diffIdx].Offset)
-				if err != nil {
-					fmt.Println(err)
-					return nil, err
-				}
-				patchReader := bytes.NewBuffer(patchBytes)
-
-				newBytes, err := dn.plugin.Patch(data, patchReader)
-				if err != nil {
-					return nil, err
-				}
-				data = newBytes
+			patchReader := bytes.NewBuffer(patchBytes)
+
+			// each layer may be generated with different plugin
+			p, err := dn.root.getPlugin(dn.baseMeta[diffIdx])
+			if err != nil {
+				return nil, err
 			}
-			return data, nil
+			newBytes, err := patch(p, data, patchReader)
+			if err != nil {
+				return nil, err
+			}
+			data = newBytes
 		}
-		diffIdxs = append(diffIdxs, i)
+
+		// other files patched with the same base are not re-patched
+		if dn.root.PatchedFileCache != nil {
+			f, err := dn.root.PatchedFileCache.Put(dn.baseMeta[0], bytes.NewReader(data))
+			if err != nil {
+				// the base file is served without caching
+				log.Warnf("failed to cache base file %s: %v", dn.baseMeta[0].Digest, err)
+			} else {
+				f.Close()
+				dn.root.PatchedFileCache.Release(dn.baseMeta[0].Digest)
+			}
+		}
+		return data, nil
 	}
 	return nil, fmt.Errorf("not implemented")
 }
 
+func (dn *Di3fsNode) readCachedFile(d digest.Digest) ([]byte, bool) {
+	if dn.root.PatchedFileCache == nil {
+		return nil, false
+	}
+	f, ok := dn.root.PatchedFileCache.Open(d)
+	if !ok {
+		return nil, false
+	}
+	defer dn.root.PatchedFileCache.Release(d)
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		log.Warnf("failed to read cached file %s: %v", d, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// seekableSource returns the entry and the image to read the body by frames
+// without materializing the file. nil is returned if the body is not seekable.
+func (dn *Di3fsNode) seekableSource() (*image.FileEntry, *image.DimgFile) {
+	if dn.meta.IsSeekable() {
+		return dn.meta, dn.root.diffImageFile
+	}
+	if !dn.meta.IsSame() {
+		return nil, nil
+	}
+	for i, baseMeta := range dn.baseMeta {
+		if baseMeta.IsSame() {
+			continue
+		}
+		if baseMeta.IsSeekable() {
+			return baseMeta, dn.root.baseImageFiles[i]
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
 func (dn *Di3fsNode) openFileInImage() (fs.FileHandle, uint32, syscall.Errno) {
 	if dn.patchedFile != nil {
 	} else if dn.patchedFilePath != "" {
 		file, err := os.Open(dn.patchedFilePath)
 		if err != nil {
 			log.Errorf("failed to open existing patched file %s: %v", dn.patchedFilePath, err)
-			return 0, 0, syscall.EIO
+			return 0, 0, eio("open")
 		}
 		dn.patchedFile = file
+	} else if entry, img := dn.seekableSource(); entry != nil {
+		dn.frameEntry = entry
+		dn.frameImage = img
+	} else if file, ok := dn.openCachedFile(); ok {
+		dn.patchedFile = file
+		dn.cached = true
 	} else {
 		var dataReader io.Reader
 		if dn.meta.IsNew() {
-			patchBytes := make([]byte, dn.meta.CompressedSize)
-			_, err := dn.root.diffImageFile.ReadAt(patchBytes, dn.meta.Offset)
-			if err != nil {
-				log.Errorf("failed to read from diffImage offset=%d err=%s", dn.meta.Offset, err)
-				return 0, 0, syscall.EIO
-			}
-			patchBuf := bytes.NewBuffer(patchBytes)
-			patchReader, err := zstd.NewReader(patchBuf)
+			patchReader, err := zstd.NewReader(io.NewSectionReader(dn.root.diffImageFile, dn.meta.Offset, dn.meta.CompressedSize))
 			if err != nil {
 				log.Errorf("failed to create zstd Reader err=%s", err)
-				return 0, 0, syscall.EIO
+				return 0, 0, eio("open")
 			}
 			defer patchReader.Close()
 			dataReader = patchReader
@@ -143,7 +215,7 @@ func (dn *Di3fsNode) openFileInImage() (fs.FileHandle, uint32, syscall.Errno) {
 			data, err := dn.readBaseFiles()
 			if err != nil {
 				log.Errorf("failed to read from base: %v", err)
-				return 0, 0, syscall.EIO
+				return 0, 0, eio("open")
 			}
 			dataReader = bytes.NewReader(data)
 		} else {
@@ -152,48 +224,119 @@ func (dn *Di3fsNode) openFileInImage() (fs.FileHandle, uint32, syscall.Errno) {
 			_, err := dn.root.diffImageFile.ReadAt(patchBytes, dn.meta.Offset)
 			if err != nil {
 				log.Errorf("failed to read from diffImage offset=%d len=%d err=%s", dn.meta.Offset, len(patchBytes), err)
-				return 0, 0, syscall.EIO
+				return 0, 0, eio("open")
 			}
 			patchReader = bytes.NewBuffer(patchBytes)
 			baseData, err := dn.readBaseFiles()
 			if err != nil {
 				log.Errorf("failed to read from base: %v", err)
-				return 0, 0, syscall.EIO
+				return 0, 0, eio("open")
 			}
 
-			newBytes, err := dn.plugin.Patch(baseData, patchReader)
+			p, err := dn.root.getPlugin(dn.meta)
+			if err != nil {
+				log.Errorf("failed to get plugin: %v", err)
+				return 0, 0, eio("open")
+			}
+			newBytes, err := patch(p, baseData, patchReader)
 			if err != nil {
 				log.Errorf("Open failed(bsdiff) err=%v", err)
-				return 0, 0, syscall.EIO
+				return 0, 0, eio("open")
 			}
 			dataReader = bytes.NewReader(newBytes)
 			log.Debugf("Successfully patched %s", dn.meta.Name)
 		}
 
-		data, err := io.ReadAll(dataReader)
+		err := dn.materialize(dataReader)
 		if err != nil {
-			log.Errorf("failed to read all: %v", err)
-			return 0, 0, syscall.EIO
+			log.Errorf("failed to materialize %s(%d): %v", dn.path, dn.meta.Type, err)
+			return 0, 0, eio("open")
 		}
-		err = dn.meta.Verify(data)
-		if err != nil {
-			log.Errorf("failed to verify %s(%d): %v", dn.path, dn.meta.Type, err)
-			return 0, 0, syscall.EIO
+		if dn.meta.IsNew() {
+			metricDecompressedBytes.Add(float64(dn.meta.Size))
 		}
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE | fuse.FOPEN_CACHE_DIR, 0
+}
+
+func (dn *Di3fsNode) openCachedFile() (*os.File, bool) {
+	if dn.root.PatchedFileCache == nil {
+		return nil, false
+	}
+	return dn.root.PatchedFileCache.Open(dn.meta.Digest)
+}
 
-		dn.patchedFile, err = os.CreateTemp(dn.root.PatchedFilesDir, fmt.Sprintf("%s-*", dn.meta.Name))
+// materialize writes the file from r into PatchedFileCache or PatchedFilesDir while verifying it
+func (dn *Di3fsNode) materialize(r io.Reader) error {
+	if dn.root.PatchedFileCache != nil {
+		file, err := dn.root.PatchedFileCache.Put(dn.meta, r)
 		if err != nil {
-			log.Errorf("failed to creat temporary file: %v", err)
-			return 0, 0, syscall.EIO
+			return err
 		}
-		_, err = dn.patchedFile.Write(data)
+		dn.patchedFile = file
+		dn.cached = true
+		return nil
+	}
+
+	digester, err := dn.meta.Digester()
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dn.root.PatchedFilesDir, fmt.Sprintf("%s-*", dn.meta.Name))
+	if err != nil {
+		return fmt.Errorf("failed to creat temporary file: %v", err)
+	}
+	_, err = io.Copy(io.MultiWriter(file, digester.Hash()), r)
+	if err == nil && digester.Digest() != dn.meta.Digest {
+		err = fmt.Errorf("failed to verify digest")
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	dn.patchedFile = file
+	dn.patchedFilePath = file.Name()
+	return nil
+}
+
+// readFrames reads the range of the file by decompressing only the frames containing it
+func (dn *Di3fsNode) readFrames(data []byte, off int64) (int, error) {
+	n := 0
+	for n < len(data) && off+int64(n) < int64(dn.meta.Size) {
+		pos := off + int64(n)
+		idx := int(pos / image.SEEKABLE_FRAME_SIZE)
+		frame, err := dn.getFrame(idx)
 		if err != nil {
-			log.Errorf("failed to write data: %v", err)
-			return 0, 0, syscall.EIO
+			return n, err
 		}
-		dn.patchedFilePath = dn.patchedFile.Name()
+		frameOff := pos - int64(idx)*image.SEEKABLE_FRAME_SIZE
+		if frameOff >= int64(len(frame)) {
+			return n, fmt.Errorf("frame %d is shorter than expected", idx)
+		}
+		n += copy(data[n:], frame[frameOff:])
 	}
-	return nil, fuse.FOPEN_KEEP_CACHE | fuse.FOPEN_CACHE_DIR, 0
+	return n, nil
+}
+
+// getFrame returns the decompressed frame.
+// The last frame is cached because reads are usually smaller than frames.
+func (dn *Di3fsNode) getFrame(idx int) ([]byte, error) {
+	dn.frameLock.Lock()
+	defer dn.frameLock.Unlock()
+
+	if dn.cachedFrame != nil && dn.cachedFrameIdx == idx {
+		return dn.cachedFrame, nil
+	}
+	frame, err := dn.frameEntry.ReadFrame(dn.frameImage, idx)
+	if err != nil {
+		return nil, err
+	}
+	metricDecompressedBytes.Add(float64(len(frame)))
+	dn.cachedFrame = frame
+	dn.cachedFrameIdx = idx
+	return frame, nil
 }
 
 func (dn *Di3fsNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
@@ -206,6 +349,10 @@ func (dn *Di3fsNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uin
 
 	log.Traceln("Open started")
 	defer log.Traceln("Open finished")
+	metricOpens.Inc()
+	if dn.root.recorder != nil {
+		dn.root.recorder.record(dn.path)
+	}
 	if dn.openCount == 0 {
 		return dn.openFileInImage()
 	}
@@ -220,8 +367,17 @@ func (dn *Di3fsNode) Release(ctx context.Context) syscall.Errno {
 	dn.openCount -= 1
 	if dn.openCount == 0 {
 		// close patched file
-		dn.patchedFile.Close()
-		dn.patchedFile = nil
+		if dn.patchedFile != nil {
+			dn.patchedFile.Close()
+			dn.patchedFile = nil
+		}
+		if dn.cached {
+			dn.root.PatchedFileCache.Release(dn.meta.Digest)
+			dn.cached = false
+		}
+		dn.frameLock.Lock()
+		dn.cachedFrame = nil
+		dn.frameLock.Unlock()
 	}
 	return 0
 }
@@ -234,10 +390,18 @@ func (dn *Di3fsNode) Read(ctx context.Context, f fs.FileHandle, data []byte, off
 	log.Debugf("READ STARTED file=%s offset=%d len=%d", dn.meta.Name, off, len(data))
 	defer log.Debugf("READ FINISHED file=%s offset=%d len=%d", dn.meta.Name, off, (end - off))
 	length := end - off
+	if dn.frameEntry != nil {
+		readLen, err := dn.readFrames(data[0:length], off)
+		if err != nil {
+			log.Errorf("failed to read frames of %s: %v", dn.path, err)
+			return nil, eio("read")
+		}
+		return fuse.ReadResultData(data[0:readLen]), 0
+	}
 	readLen, err := dn.patchedFile.ReadAt(data[0:length], off)
 	if err != nil && err != io.EOF {
 		log.Errorf("failed to read from patched file: %v", err)
-		return nil, syscall.EIO
+		return nil, eio("read")
 	}
 	return fuse.ReadResultData(data[0:readLen]), 0
 }
@@ -340,22 +504,34 @@ type Di3fsRoot struct {
 	hardlinks       []*hardlinkNode
 	pm              *bsdiffx.PluginManager
 	PatchedFilesDir string
+	// patched files are written to PatchedFilesDir if nil
+	PatchedFileCache *PatchedFileCache
+	// not nil while files opened are recorded
+	recorder *accessRecorder
 }
 
 func (dr *Di3fsRoot) IsBase() bool {
 	return dr.baseImageFiles == nil
 }
 
+func (dr *Di3fsRoot) getPlugin(fe *image.FileEntry) (*bsdiffx.Plugin, error) {
+	p := dr.pm.GetPluginByUuid(fe.PluginUuid)
+	if p == nil {
+		return nil, fmt.Errorf("plugin for %s not found", fe.PluginUuid)
+	}
+	return p, nil
+}
+
 func newNode(fe *image.FileEntry, baseFE []*image.FileEntry, root *Di3fsRoot) *Di3fsNode {
-	var p *bsdiffx.Plugin = nil
+	// files with missing plugins are still listed and Open returns EIO for them
 	if root != nil {
 		for _, f := range append([]*image.FileEntry{fe}, baseFE...) {
-			if f.Type == image.FILE_ENTRY_FILE_DIFF {
-				p = root.pm.GetPluginByUuid(f.PluginUuid)
-				if p == nil {
-					panic(fmt.Sprintf("plugin for %s not found", fe.PluginUuid))
-				}
-				break
+			if f.Type != image.FILE_ENTRY_FILE_DIFF {
+				continue
+			}
+			_, err := root.getPlugin(f)
+			if err != nil {
+				log.Errorf("%s cannot be patched: %v", fe.Name, err)
 			}
 		}
 	}
@@ -366,7 +542,6 @@ func newNode(fe *image.FileEntry, baseFE []*image.FileEntry, root *Di3fsRoot) *D
 		meta:      fe,
 		baseMeta:  baseFE,
 		root:      root,
-		plugin:    p,
 	}
 	return node
 }
@@ -403,7 +578,7 @@ func NewDi3fsRoot(opts *fs.Options, baseImages []*image.DimgFile, diffImage *ima
 	return root, nil
 }
 
-func Do(dimgPaths []string, mountPath string, mountDone chan bool) error {
+func Do(dimgPaths []string, mountPath string, mountDone chan bool, cache *PatchedFileCache, profile *ProfileConfig) error {
 	start := time.Now()
 	customFormatter := new(log.TextFormatter)
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
@@ -415,7 +590,7 @@ func Do(dimgPaths []string, mountPath string, mountDone chan bool) error {
 
 	diffImageFile, err := image.OpenDimgFile(dimgPaths[0])
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to open %s: %v", dimgPaths[0], err)
 	}
 	defer diffImageFile.Close()
 	log.Infof("diffImage %s is loaded", diffImageFile.DimgHeader().Id)
@@ -423,9 +598,12 @@ func Do(dimgPaths []string, mountPath string, mountDone chan bool) error {
 	dimgIdx := 1
 	parentImageId := diffImageFile.DimgHeader().ParentId
 	for parentImageId != "" {
+		if dimgIdx >= len(dimgPaths) {
+			return fmt.Errorf("parent image %s is not specified", parentImageId)
+		}
 		parentImageFile, err := image.OpenDimgFile(dimgPaths[dimgIdx])
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("failed to open %s: %v", dimgPaths[dimgIdx], err)
 		}
 		defer parentImageFile.Close()
 		parentImageFiles = append(parentImageFiles, parentImageFile)
@@ -454,15 +632,34 @@ func Do(dimgPaths []string, mountPath string, mountDone chan bool) error {
 	if err != nil {
 		log.Fatalf("creating Di3fsRoot failed: %v\n", err)
 	}
+	di3fsRoot.PatchedFileCache = cache
+	var prefetchProfile *image.AccessProfile
+	if profile != nil {
+		prefetchProfile = di3fsRoot.loadProfile(profile)
+	}
 
 	server, err := fs.Mount(mountPath, di3fsRoot.RootNode, opts)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
 	log.Infof("Mounted!")
-	fmt.Printf("elapsed = %v\n", (time.Since(start).Milliseconds()))
+	log.Debugf("mounted in %dms", time.Since(start).Milliseconds())
 	mountDone <- true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prefetchDone := make(chan struct{})
+	if prefetchProfile != nil {
+		go func() {
+			di3fsRoot.Prefetch(ctx, prefetchProfile, profile.PrefetchConcurrency)
+			close(prefetchDone)
+		}()
+	} else {
+		close(prefetchDone)
+	}
 	server.Wait()
+	cancel()
+	<-prefetchDone
+	di3fsRoot.StopRecording()
 
 	os.RemoveAll(di3fsRoot.PatchedFilesDir)
 	log.Infof("patched files dir %s has been cleanuuped", di3fsRoot.PatchedFilesDir)
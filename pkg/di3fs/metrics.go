@@ -0,0 +1,81 @@
+package di3fs
+
+import (
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const METRICS_NAMESPACE = "di3fs"
+
+var (
+	metricOpens = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "file_opens_total",
+		Help:      "Number of files opened",
+	})
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "patched_file_cache_hits_total",
+		Help:      "Number of lookups found in the patched file cache",
+	})
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "patched_file_cache_misses_total",
+		Help:      "Number of lookups not found in the patched file cache",
+	})
+	metricPatchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "patch_duration_seconds",
+		Help:      "Time to patch a file",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 9),
+	}, []string{"plugin"})
+	metricDecompressedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "decompressed_bytes_total",
+		Help:      "Bytes of file bodies decompressed from dimgs",
+	})
+	metricEIO = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "eio_total",
+		Help:      "Number of EIO returned to the kernel",
+	}, []string{"op"})
+)
+
+// RegisterMetrics registers metrics of di3fs mounts in this process
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		metricOpens,
+		metricCacheHits,
+		metricCacheMisses,
+		metricPatchDuration,
+		metricDecompressedBytes,
+		metricEIO,
+	} {
+		err := r.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eio counts EIO returned by op
+func eio(op string) syscall.Errno {
+	metricEIO.WithLabelValues(op).Inc()
+	return syscall.EIO
+}
+
+// patch applies the patch with p and observes the latency
+func patch(p *bsdiffx.Plugin, oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+	start := time.Now()
+	newBytes, err := p.Patch(oldBytes, patchReader)
+	if err != nil {
+		return nil, err
+	}
+	metricPatchDuration.WithLabelValues(p.ID().String()).Observe(time.Since(start).Seconds())
+	return newBytes, nil
+}
@@ -0,0 +1,149 @@
+package di3fs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	log "github.com/sirupsen/logrus"
+)
+
+type ProfileConfig struct {
+	// the profile is loaded from Path, or recorded into Path if it does not exist
+	Path string
+	// files opened in RecordDuration after mount are recorded (recording is disabled if 0)
+	RecordDuration time.Duration
+	// number of files prefetched concurrently
+	PrefetchConcurrency int
+}
+
+type accessRecorder struct {
+	lock      sync.Mutex
+	path      string
+	recording bool
+	seen      map[string]struct{}
+	files     []string
+	timer     *time.Timer
+}
+
+func (ar *accessRecorder) record(path string) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	if !ar.recording {
+		return
+	}
+	if _, ok := ar.seen[path]; ok {
+		return
+	}
+	ar.seen[path] = struct{}{}
+	ar.files = append(ar.files, path)
+}
+
+// finish stops recording and writes the profile once
+func (ar *accessRecorder) finish() {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	if !ar.recording {
+		return
+	}
+	ar.recording = false
+	ar.timer.Stop()
+
+	profile := &image.AccessProfile{Files: ar.files}
+	err := profile.Write(ar.path)
+	if err != nil {
+		log.Errorf("failed to write profile %s: %v", ar.path, err)
+		return
+	}
+	log.Infof("profile %s is recorded (files=%d)", ar.path, len(ar.files))
+}
+
+// StartRecording records files opened in duration and writes the profile into path.
+func (dr *Di3fsRoot) StartRecording(path string, duration time.Duration) {
+	ar := &accessRecorder{
+		lock:      sync.Mutex{},
+		path:      path,
+		recording: true,
+		seen:      map[string]struct{}{},
+		files:     []string{},
+	}
+	ar.timer = time.AfterFunc(duration, ar.finish)
+	dr.recorder = ar
+}
+
+// StopRecording writes the profile if it is still being recorded
+func (dr *Di3fsRoot) StopRecording() {
+	if dr.recorder != nil {
+		dr.recorder.finish()
+	}
+}
+
+// Prefetch opens files in the profile so that they are patched before accessed.
+// Files are patched in the order of the profile with concurrency goroutines.
+func (dr *Di3fsRoot) Prefetch(ctx context.Context, profile *image.AccessProfile, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	start := time.Now()
+	paths := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range paths {
+				dr.prefetchFile(ctx, p)
+			}
+		}()
+	}
+
+	prefetched := 0
+loop:
+	for _, p := range profile.Files {
+		select {
+		case <-ctx.Done():
+			break loop
+		case paths <- p:
+			prefetched++
+		}
+	}
+	close(paths)
+	wg.Wait()
+	log.Infof("prefetched %d/%d files (elapsed=%v)", prefetched, len(profile.Files), time.Since(start))
+}
+
+func (dr *Di3fsRoot) prefetchFile(ctx context.Context, path string) {
+	node, ok := dr.nodes[path]
+	if !ok || !node.meta.IsFile() {
+		log.Debugf("%s in profile is not a file in the image. ignored", path)
+		return
+	}
+	_, _, errno := node.Open(ctx, 0)
+	if errno != 0 {
+		log.Warnf("failed to prefetch %s: %v", path, errno)
+		return
+	}
+	node.Release(ctx)
+}
+
+// loadProfile returns the profile to prefetch.
+// If the profile does not exist, recording starts and nil is returned.
+// This must be called before mount.
+func (dr *Di3fsRoot) loadProfile(pc *ProfileConfig) *image.AccessProfile {
+	profile, err := image.LoadAccessProfile(pc.Path)
+	if err == nil {
+		return profile
+	}
+	if !os.IsNotExist(err) {
+		log.Warnf("failed to load profile %s: %v", pc.Path, err)
+		return nil
+	}
+	if pc.RecordDuration > 0 {
+		dr.StartRecording(pc.Path, pc.RecordDuration)
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package elfx
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Executable-aware delta encoding (Courgette-style).
+//
+// When a program is rebuilt, inserting a few bytes of code moves every
+// function after it, so almost all relative branch displacements and
+// absolute pointers change. These changes defeat plain bsdiff.
+//
+// Disassemble() decodes instructions in executable sections to find branches
+// and reads RELATIVE relocations. Their targets are collected as labels and
+// every target is replaced with the index of its label. Moved code then changes label indices
+// by a small constant which bsdiff encodes well. Positions of rewritten
+// fields ("sites") and the label table are stored so that Assemble() restores
+// the original bytes exactly.
+//
+// Because disassembling is a deterministic function of the input, the delta
+// between two executables is the bsdiffx delta between their disassembled
+// forms, and two such deltas can be merged with bsdiffx.DeltaMergingBytes.
+//
+// Disassembled format
+// [ magic "D4CE" (4byte) ][ version (1byte) ][ mode (1byte) ]
+// mode == modeRaw:
+// [ original bytes ]
+// mode == modeNormalized:
+// [ byte order (1byte) ]
+// [ section maps (offset, size, addr) ]
+// [ labels (delta encoded) ]
+// [ sites (delta encoded offset, kind) ]
+// [ normalized bytes ]
+
+var (
+	ErrInvalidDisassembled = errors.New("invalid disassembled executable")
+
+	disassembledMagic   = []byte("D4CE")
+	disassembledVersion = byte(1)
+	elfMagic            = []byte(elf.ELFMAG)
+)
+
+const (
+	modeRaw        = byte(0)
+	modeNormalized = byte(1)
+
+	byteOrderLittle = byte(0)
+	byteOrderBig    = byte(1)
+)
+
+type siteKind byte
+
+const (
+	// x86 call/jmp/jcc rel32 displacement
+	siteRel32 siteKind = iota + 1
+	// absolute 64bit pointer (RELATIVE relocation addend)
+	siteAbs64
+	// 64bit value encoded as the difference from the previous siteDelta64 (RELATIVE relocation offset)
+	siteDelta64
+	// arm64 b/bl imm26
+	siteBranch26
+)
+
+type site struct {
+	offset uint64
+	kind   siteKind
+}
+
+// sectionMap maps file offsets in an executable section to virtual addresses
+type sectionMap struct {
+	offset uint64
+	size   uint64
+	addr   uint64
+}
+
+type program struct {
+	order  binary.ByteOrder
+	maps   []sectionMap
+	labels []uint64
+	sites  []site
+	body   []byte
+}
+
+func IsElf(b []byte) bool {
+	return bytes.HasPrefix(b, elfMagic)
+}
+
+func (p *program) vaddr(offset uint64) (uint64, bool) {
+	for _, m := range p.maps {
+		if m.offset <= offset && offset < m.offset+m.size {
+			return m.addr + (offset - m.offset), true
+		}
+	}
+	return 0, false
+}
+
+func (p *program) isExecAddr(addr uint64) bool {
+	for _, m := range p.maps {
+		if m.addr <= addr && addr < m.addr+m.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Disassemble returns disassembled form of b.
+// If b is not supported executable, b is stored as it is.
+func Disassemble(b []byte) []byte {
+	if IsElf(b) {
+		p, err := parseElf(b)
+		if err == nil {
+			normalized, err := p.encode()
+			if err == nil {
+				// make sure that the original bytes can be restored
+				restored, err := Assemble(normalized)
+				if err == nil && bytes.Equal(restored, b) {
+					return normalized
+				}
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(disassembledMagic)
+	out.WriteByte(disassembledVersion)
+	out.WriteByte(modeRaw)
+	out.Write(b)
+	return out.Bytes()
+}
+
+func parseElf(b []byte) (*program, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &program{
+		order: f.ByteOrder,
+		maps:  []sectionMap{},
+		sites: []site{},
+	}
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_EXECINSTR == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		if s.Offset+s.Size > uint64(len(b)) {
+			return nil, fmt.Errorf("section %s is out of file", s.Name)
+		}
+		p.maps = append(p.maps, sectionMap{offset: s.Offset, size: s.Size, addr: s.Addr})
+	}
+
+	for _, m := range p.maps {
+		switch f.Machine {
+		case elf.EM_X86_64:
+			p.scanX86(b, m, 64)
+		case elf.EM_386:
+			p.scanX86(b, m, 32)
+		case elf.EM_AARCH64:
+			p.scanArm64(b, m)
+		}
+	}
+
+	if f.Class == elf.ELFCLASS64 {
+		var relative uint32
+		switch f.Machine {
+		case elf.EM_X86_64:
+			relative = uint32(elf.R_X86_64_RELATIVE)
+		case elf.EM_AARCH64:
+			relative = uint32(elf.R_AARCH64_RELATIVE)
+		}
+		for _, s := range f.Sections {
+			if s.Type != elf.SHT_RELA || relative == 0 {
+				continue
+			}
+			p.scanRela64(b, s, relative)
+		}
+	}
+
+	sort.Slice(p.sites, func(i, j int) bool {
+		return p.sites[i].offset < p.sites[j].offset
+	})
+	for i := 1; i < len(p.sites); i++ {
+		if p.sites[i-1].offset+uint64(p.sites[i-1].kind.width()) > p.sites[i].offset {
+			return nil, fmt.Errorf("overlapped sites at 0x%x", p.sites[i].offset)
+		}
+	}
+
+	p.body = append([]byte{}, b...)
+	return p, nil
+}
+
+func (k siteKind) width() int {
+	switch k {
+	case siteRel32, siteBranch26:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// scanX86 decodes instructions from the head of the section (linear sweep).
+// Bytes which are not decoded as instructions, such as data in the section, are skipped one by one.
+func (p *program) scanX86(b []byte, m sectionMap, mode int) {
+	end := m.offset + m.size
+	for off := m.offset; off < end; {
+		inst, err := x86asm.Decode(b[off:end], mode)
+		if err != nil || inst.Len == 0 {
+			off += 1
+			continue
+		}
+		next := off + uint64(inst.Len)
+		// call, jmp and jcc with rel32 displacement at the end of the instruction
+		if _, ok := inst.Args[0].(x86asm.Rel); !ok || inst.PCRel != 4 || inst.PCRelOff+inst.PCRel != inst.Len {
+			off = next
+			continue
+		}
+		fieldOff := off + uint64(inst.PCRelOff)
+		disp := int32(p.order.Uint32(b[fieldOff : fieldOff+4]))
+		target := m.addr + (next - m.offset) + uint64(int64(disp))
+		if p.isExecAddr(target) {
+			p.sites = append(p.sites, site{offset: fieldOff, kind: siteRel32})
+		}
+		off = next
+	}
+}
+
+func (p *program) scanArm64(b []byte, m sectionMap) {
+	end := m.offset + m.size
+	for off := m.offset; off+4 <= end; off += 4 {
+		insn := p.order.Uint32(b[off : off+4])
+		// b (0x14000000) and bl (0x94000000)
+		if insn&0x7c000000 != 0x14000000 {
+			continue
+		}
+		imm := int64(insn&0x03ffffff) << 38 >> 36
+		target := m.addr + (off - m.offset) + uint64(imm)
+		if !p.isExecAddr(target) {
+			continue
+		}
+		p.sites = append(p.sites, site{offset: off, kind: siteBranch26})
+	}
+}
+
+func (p *program) scanRela64(b []byte, s *elf.Section, relative uint32) {
+	const entSize = 24
+	if s.Offset+s.Size > uint64(len(b)) {
+		return
+	}
+	for off := s.Offset; off+entSize <= s.Offset+s.Size; off += entSize {
+		info := p.order.Uint64(b[off+8 : off+16])
+		if uint32(info) != relative {
+			continue
+		}
+		p.sites = append(p.sites, site{offset: off, kind: siteDelta64})
+		p.sites = append(p.sites, site{offset: off + 16, kind: siteAbs64})
+	}
+}
+
+// target returns the address referenced by the site in original bytes
+func (p *program) target(s site) (uint64, bool) {
+	switch s.kind {
+	case siteRel32:
+		addr, ok := p.vaddr(s.offset)
+		if !ok {
+			return 0, false
+		}
+		disp := int32(p.order.Uint32(p.body[s.offset : s.offset+4]))
+		return addr + 4 + uint64(int64(disp)), true
+	case siteBranch26:
+		addr, ok := p.vaddr(s.offset)
+		if !ok {
+			return 0, false
+		}
+		insn := p.order.Uint32(p.body[s.offset : s.offset+4])
+		imm := int64(insn&0x03ffffff) << 38 >> 36
+		return addr + uint64(imm), true
+	case siteAbs64:
+		return p.order.Uint64(p.body[s.offset : s.offset+8]), true
+	}
+	return 0, false
+}
+
+func (p *program) encode() ([]byte, error) {
+	// collect labels
+	targets := map[uint64]struct{}{}
+	for _, s := range p.sites {
+		if t, ok := p.target(s); ok {
+			targets[t] = struct{}{}
+		}
+	}
+	p.labels = make([]uint64, 0, len(targets))
+	for t := range targets {
+		p.labels = append(p.labels, t)
+	}
+	sort.Slice(p.labels, func(i, j int) bool { return p.labels[i] < p.labels[j] })
+	labelIdx := make(map[uint64]uint64, len(p.labels))
+	for i, l := range p.labels {
+		labelIdx[l] = uint64(i)
+	}
+
+	// normalize
+	prevDelta := uint64(0)
+	for _, s := range p.sites {
+		field := p.body[s.offset : s.offset+uint64(s.kind.width())]
+		switch s.kind {
+		case siteRel32:
+			t, ok := p.target(s)
+			if !ok {
+				return nil, fmt.Errorf("site 0x%x is not in executable section", s.offset)
+			}
+			p.order.PutUint32(field, uint32(labelIdx[t]))
+		case siteBranch26:
+			t, ok := p.target(s)
+			if !ok || labelIdx[t] > 0x03ffffff {
+				return nil, fmt.Errorf("invalid branch site 0x%x", s.offset)
+			}
+			insn := p.order.Uint32(field)
+			p.order.PutUint32(field, insn&0xfc000000|uint32(labelIdx[t]))
+		case siteAbs64:
+			t, _ := p.target(s)
+			p.order.PutUint64(field, labelIdx[t])
+		case siteDelta64:
+			v := p.order.Uint64(field)
+			p.order.PutUint64(field, v-prevDelta)
+			prevDelta = v
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(disassembledMagic)
+	out.WriteByte(disassembledVersion)
+	out.WriteByte(modeNormalized)
+	if p.order == binary.ByteOrder(binary.BigEndian) {
+		out.WriteByte(byteOrderBig)
+	} else {
+		out.WriteByte(byteOrderLittle)
+	}
+
+	writeUvarint(out, uint64(len(p.maps)))
+	for _, m := range p.maps {
+		writeUvarint(out, m.offset)
+		writeUvarint(out, m.size)
+		writeUvarint(out, m.addr)
+	}
+
+	writeUvarint(out, uint64(len(p.labels)))
+	prev := uint64(0)
+	for _, l := range p.labels {
+		writeUvarint(out, l-prev)
+		prev = l
+	}
+
+	writeUvarint(out, uint64(len(p.sites)))
+	prev = 0
+	for _, s := range p.sites {
+		writeUvarint(out, s.offset-prev)
+		out.WriteByte(byte(s.kind))
+		prev = s.offset
+	}
+
+	out.Write(p.body)
+	return out.Bytes(), nil
+}
+
+func writeUvarint(w *bytes.Buffer, v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	w.Write(buf[:n])
+}
+
+// Assemble restores original bytes from disassembled form.
+func Assemble(d []byte) ([]byte, error) {
+	headerLen := len(disassembledMagic) + 2
+	if len(d) < headerLen || !bytes.HasPrefix(d, disassembledMagic) {
+		return nil, ErrInvalidDisassembled
+	}
+	if d[len(disassembledMagic)] != disassembledVersion {
+		return nil, fmt.Errorf("unsupported disassembled version %d", d[len(disassembledMagic)])
+	}
+	mode := d[len(disassembledMagic)+1]
+	r := bytes.NewReader(d[headerLen:])
+	switch mode {
+	case modeRaw:
+		return d[headerLen:], nil
+	case modeNormalized:
+	default:
+		return nil, fmt.Errorf("unexpected mode %d", mode)
+	}
+
+	p := &program{}
+	order, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidDisassembled
+	}
+	if order == byteOrderBig {
+		p.order = binary.BigEndian
+	} else {
+		p.order = binary.LittleEndian
+	}
+
+	mapNum, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrInvalidDisassembled
+	}
+	for i := uint64(0); i < mapNum; i++ {
+		m := sectionMap{}
+		for _, v := range []*uint64{&m.offset, &m.size, &m.addr} {
+			*v, err = binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrInvalidDisassembled
+			}
+		}
+		p.maps = append(p.maps, m)
+	}
+
+	labelNum, err := binary.ReadUvarint(r)
+	if err != nil || labelNum > uint64(r.Len()) {
+		return nil, ErrInvalidDisassembled
+	}
+	p.labels = make([]uint64, labelNum)
+	prev := uint64(0)
+	for i := range p.labels {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, ErrInvalidDisassembled
+		}
+		p.labels[i] = prev + delta
+		prev = p.labels[i]
+	}
+
+	siteNum, err := binary.ReadUvarint(r)
+	if err != nil || siteNum > uint64(r.Len()) {
+		return nil, ErrInvalidDisassembled
+	}
+	p.sites = make([]site, siteNum)
+	prev = 0
+	for i := range p.sites {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, ErrInvalidDisassembled
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidDisassembled
+		}
+		p.sites[i] = site{offset: prev + delta, kind: siteKind(kind)}
+		prev = p.sites[i].offset
+	}
+
+	p.body, err = io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	prevDelta := uint64(0)
+	for _, s := range p.sites {
+		end := s.offset + uint64(s.kind.width())
+		if end > uint64(len(p.body)) {
+			return nil, ErrInvalidDisassembled
+		}
+		field := p.body[s.offset:end]
+		switch s.kind {
+		case siteRel32:
+			idx := uint64(p.order.Uint32(field))
+			addr, ok := p.vaddr(s.offset)
+			if !ok || idx >= uint64(len(p.labels)) {
+				return nil, ErrInvalidDisassembled
+			}
+			p.order.PutUint32(field, uint32(p.labels[idx]-(addr+4)))
+		case siteBranch26:
+			insn := p.order.Uint32(field)
+			idx := uint64(insn & 0x03ffffff)
+			addr, ok := p.vaddr(s.offset)
+			if !ok || idx >= uint64(len(p.labels)) {
+				return nil, ErrInvalidDisassembled
+			}
+			imm := uint32((p.labels[idx]-addr)>>2) & 0x03ffffff
+			p.order.PutUint32(field, insn&0xfc000000|imm)
+		case siteAbs64:
+			idx := p.order.Uint64(field)
+			if idx >= uint64(len(p.labels)) {
+				return nil, ErrInvalidDisassembled
+			}
+			p.order.PutUint64(field, p.labels[idx])
+		case siteDelta64:
+			v := p.order.Uint64(field) + prevDelta
+			p.order.PutUint64(field, v)
+			prevDelta = v
+		default:
+			return nil, fmt.Errorf("unexpected site kind %d", s.kind)
+		}
+	}
+
+	return p.body, nil
+}
+
+func Diff(oldBytes, newBytes []byte, patchWriter io.Writer, mode bsdiffx.CompressionMode) error {
+	return bsdiffx.Diff(Disassemble(oldBytes), Disassemble(newBytes), patchWriter, mode)
+}
+
+func Patch(oldBytes []byte, patchReader io.Reader) ([]byte, error) {
+	disassembled, err := bsdiffx.Patch(Disassemble(oldBytes), patchReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return Assemble(disassembled)
+}
+
+func Merge(lowerDiff, upperDiff io.Reader, mergedDiff io.Writer) error {
+	return bsdiffx.DeltaMergingBytes(lowerDiff, upperDiff, mergedDiff)
+}
@@ -0,0 +1,126 @@
+package elfx_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/elfx"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	modeRaw        = byte(0)
+	modeNormalized = byte(1)
+
+	textAddr = 0x401000
+)
+
+// tinyElf returns x86-64 ELF with functions calling each other.
+// extraNops are inserted into the first function to move the following functions.
+func tinyElf(funcNum, extraNops int) []byte {
+	sizes := make([]int, funcNum)
+	starts := make([]int, funcNum)
+	pos := 0
+	for i := range sizes {
+		// nops, call rel32 and ret
+		sizes[i] = 8 + i%5 + 5 + 1
+		if i == 0 {
+			sizes[i] += extraNops
+		}
+		starts[i] = pos
+		pos += sizes[i]
+	}
+
+	text := &bytes.Buffer{}
+	for i := range sizes {
+		text.Write(bytes.Repeat([]byte{0x90}, sizes[i]-6))
+		callee := (i*7 + 3) % funcNum
+		disp := int32(starts[callee] - (text.Len() + 5))
+		text.WriteByte(0xe8)
+		_ = binary.Write(text, binary.LittleEndian, disp)
+		text.WriteByte(0xc3)
+	}
+
+	const ehSize = 64
+	shstrtab := []byte("\x00.text\x00.shstrtab\x00")
+	textOff := uint64(ehSize)
+	shstrtabOff := textOff + uint64(text.Len())
+	shOff := shstrtabOff + uint64(len(shstrtab))
+
+	out := &bytes.Buffer{}
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     textAddr,
+		Shoff:     shOff,
+		Ehsize:    ehSize,
+		Shentsize: 64,
+		Shnum:     3,
+		Shstrndx:  2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	_ = binary.Write(out, binary.LittleEndian, hdr)
+	out.Write(text.Bytes())
+	out.Write(shstrtab)
+	for _, sh := range []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: textAddr, Off: textOff, Size: uint64(text.Len()), Addralign: 16},
+		{Name: 7, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	} {
+		_ = binary.Write(out, binary.LittleEndian, sh)
+	}
+
+	return out.Bytes()
+}
+
+// disassembledMode returns mode of the disassembled form
+func disassembledMode(d []byte) byte {
+	return d[len("D4CE")+1]
+}
+
+func TestDisassembleAndAssemble(t *testing.T) {
+	b := tinyElf(1000, 0)
+	assert.True(t, elfx.IsElf(b))
+
+	disassembled := elfx.Disassemble(b)
+	assert.Equal(t, modeNormalized, disassembledMode(disassembled))
+	restored, err := elfx.Assemble(disassembled)
+	assert.Equal(t, nil, err)
+	assert.True(t, bytes.Equal(b, restored))
+
+	// truncated ELF can not be parsed and is stored as it is
+	disassembled = elfx.Disassemble(b[:len(b)/2])
+	assert.Equal(t, modeRaw, disassembledMode(disassembled))
+	restored, err = elfx.Assemble(disassembled)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, b[:len(b)/2], restored)
+
+	notElf := []byte("not an executable")
+	disassembled = elfx.Disassemble(notElf)
+	assert.Equal(t, modeRaw, disassembledMode(disassembled))
+	restored, err = elfx.Assemble(disassembled)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, notElf, restored)
+}
+
+func TestDiffAndPatch(t *testing.T) {
+	oldBytes := tinyElf(1000, 0)
+	newBytes := tinyElf(1000, 3)
+	assert.Equal(t, modeNormalized, disassembledMode(elfx.Disassemble(oldBytes)))
+	assert.Equal(t, modeNormalized, disassembledMode(elfx.Disassemble(newBytes)))
+
+	patch := &bytes.Buffer{}
+	err := elfx.Diff(oldBytes, newBytes, patch, bsdiffx.CompressionModeZstd)
+	assert.Equal(t, nil, err)
+
+	patched, err := elfx.Patch(oldBytes, patch)
+	assert.Equal(t, nil, err)
+	assert.True(t, bytes.Equal(newBytes, patched))
+}
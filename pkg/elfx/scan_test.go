@@ -0,0 +1,32 @@
+package elfx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanX86(t *testing.T) {
+	text := &bytes.Buffer{}
+	// mov eax, 0x5e8 and add [rax], al. 0xe8 in the immediate is not a call
+	text.Write([]byte{0xb8, 0xe8, 0x05, 0x00, 0x00, 0x00, 0x00})
+	// call rel32 to the head of the section
+	text.WriteByte(0xe8)
+	_ = binary.Write(text, binary.LittleEndian, int32(-(text.Len() + 4)))
+	// jne rel32 to the head of the section
+	text.Write([]byte{0x0f, 0x85})
+	_ = binary.Write(text, binary.LittleEndian, int32(-(text.Len() + 4)))
+	// call rel32 out of the section
+	text.WriteByte(0xe8)
+	_ = binary.Write(text, binary.LittleEndian, int32(0x1000))
+	text.Write(bytes.Repeat([]byte{0x90}, 8))
+	text.WriteByte(0xc3)
+
+	b := text.Bytes()
+	m := sectionMap{offset: 0, size: uint64(len(b)), addr: 0x401000}
+	p := &program{order: binary.LittleEndian, maps: []sectionMap{m}, sites: []site{}}
+	p.scanX86(b, m, 64)
+	assert.Equal(t, []site{{offset: 8, kind: siteRel32}, {offset: 14, kind: siteRel32}}, p.sites)
+}
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Bodies are written by pipelines in the order of completion,
+// which depends on thread scheduling.
+// To make output reproducible, bodies are written to a spool first and
+// then copied in the canonical order (depth-first, sorted by name).
+// Bodies of files in the access profile are placed at the front in the order of the profile
+// so that files read at startup are in a small contiguous range.
+
+func sortedChildNames(entry *FileEntry) []string {
+	names := make([]string, 0, len(entry.Childs))
+	for name := range entry.Childs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// canonicalizeBody copies bodies of written entries from spool to out in the canonical order.
+// Offsets of written entries are updated to ones in out.
+// profile can be nil.
+func canonicalizeBody(root *FileEntry, written map[*FileEntry]struct{}, spool io.ReaderAt, out io.Writer, profile *AccessProfile) error {
+	offset := int64(0)
+	copyBody := func(entry *FileEntry) error {
+		if _, ok := written[entry]; !ok {
+			return nil
+		}
+		// entries may be shared among directories
+		delete(written, entry)
+		_, err := io.Copy(out, io.NewSectionReader(spool, entry.Offset, entry.CompressedSize))
+		if err != nil {
+			return fmt.Errorf("failed to copy body of %s: %v", entry.Name, err)
+		}
+		entry.Offset = offset
+		offset += entry.CompressedSize
+		return nil
+	}
+
+	if profile != nil {
+		for _, path := range profile.Files {
+			// files not in the image or without bodies are ignored
+			entry, err := root.Lookup(path)
+			if err != nil {
+				continue
+			}
+			err = copyBody(entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var walk func(entry *FileEntry) error
+	walk = func(entry *FileEntry) error {
+		err := copyBody(entry)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedChildNames(entry) {
+			err := walk(entry.Childs[name])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(root)
+	if err != nil {
+		return err
+	}
+	if len(written) != 0 {
+		return fmt.Errorf("%d bodies are not reachable from root", len(written))
+	}
+	return nil
+}
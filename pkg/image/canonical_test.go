@@ -0,0 +1,84 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// canonicalTestFiles returns enough files for threads to finish out of order
+func canonicalTestFiles(version int) map[string]testFile {
+	files := map[string]testFile{}
+	for d := 0; d < 4; d++ {
+		files[fmt.Sprintf("d%d", d)] = testFile{mode: os.ModeDir | 0755}
+		for f := 0; f < 50; f++ {
+			body := strings.Repeat(fmt.Sprintf("%d-%d ", d, f), (d*50+f)*37%2000+1)
+			if f%3 == 0 {
+				body += fmt.Sprintf("v%d", version)
+			}
+			files[fmt.Sprintf("d%d/f%d", d, f)] = testFile{body: body, mode: 0644}
+		}
+	}
+	return files
+}
+
+func assertSameBytes(t *testing.T, expectedPath, actualPath string) {
+	expected, err := os.ReadFile(expectedPath)
+	assert.Equal(t, nil, err)
+	actual, err := os.ReadFile(actualPath)
+	assert.Equal(t, nil, err)
+	assert.True(t, bytes.Equal(expected, actual), "%s and %s differ", expectedPath, actualPath)
+}
+
+func TestPackAndDiffReproducible(t *testing.T) {
+	oldDir := writeTestDir(t, canonicalTestFiles(1))
+	newDir := writeTestDir(t, canonicalTestFiles(2))
+
+	oldDimg := packTestDir(t, oldDir)
+	assertSameBytes(t, oldDimg, packTestDir(t, oldDir))
+	newDimg := packTestDir(t, newDir)
+	assertSameBytes(t, newDimg, packTestDir(t, newDir))
+
+	assertSameBytes(t, diffTestDimg(t, oldDimg, newDimg), diffTestDimg(t, oldDimg, newDimg))
+}
+
+func mergeTestDimg(t *testing.T, lowerDimg, upperDimg string) string {
+	out := filepath.Join(t.TempDir(), "merged.dimg")
+	merged := &bytes.Buffer{}
+	_, err := MergeDimg(lowerDimg, upperDimg, merged, MergeConfig{ThreadNum: 4, MergeDimgConcurrentNum: 1}, testPluginManager(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(out, merged.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMergeReproducible(t *testing.T) {
+	v1Dir := writeTestDir(t, canonicalTestFiles(1))
+	v2Dir := writeTestDir(t, canonicalTestFiles(2))
+	v3Dir := writeTestDir(t, canonicalTestFiles(3))
+	v1Dimg := packTestDir(t, v1Dir)
+	v2Dimg := packTestDir(t, v2Dir)
+	v3Dimg := packTestDir(t, v3Dir)
+	lower := diffTestDimg(t, v1Dimg, v2Dimg)
+	upper := diffTestDimg(t, v2Dimg, v3Dimg)
+
+	merged := mergeTestDimg(t, lower, upper)
+	assertSameBytes(t, merged, mergeTestDimg(t, lower, upper))
+
+	img, err := OpenDimgFile(merged)
+	assert.Equal(t, nil, err)
+	defer img.Close()
+	err = ApplyPatchInPlace(context.Background(), v1Dir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4})
+	assert.Equal(t, nil, err)
+	assertSameTree(t, v3Dir, v1Dir)
+}
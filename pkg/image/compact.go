@@ -0,0 +1,42 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/opencontainers/go-digest"
+)
+
+// CompactChain merges the chain of dimgs to mount the image id into a new base dimg and adds it to the store.
+// Dimgs in the old chain are left in the store and freed by GC with ShortestChainOnly or EvictLRU.
+// It returns nil if the image is already mounted with a single dimg.
+func (ds *DimgStore) CompactChain(id digest.Digest, tmpDir string, mc MergeConfig, pm *bsdiffx.PluginManager) (*DimgEntry, error) {
+	chain, err := ds.GetDimgEntriesWithDimgIds(id, []digest.Digest{""})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain for %s: %v", id, err)
+	}
+	if len(chain) == 1 {
+		return nil, nil
+	}
+
+	logger.Infof("compacting %d dimgs for %s", len(chain), id)
+	configBytes := chain[0].ConfigBytes
+	merged, err := MergeDimgsWithPlan(chain, tmpDir, mc, false, pm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge chain for %s: %v", id, err)
+	}
+	if merged.ParentId != "" {
+		return nil, fmt.Errorf("merged dimg for %s is not a base image (parentId=%s)", id, merged.ParentId)
+	}
+
+	d := merged.Digest()
+	err = ds.AddDimg(merged.Path, configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add compacted dimg for %s: %v", id, err)
+	}
+	entry, ok := ds.GetDimgEntry(d)
+	if !ok {
+		return nil, fmt.Errorf("compacted dimg %s not found", d)
+	}
+	return entry, nil
+}
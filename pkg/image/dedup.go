@@ -0,0 +1,304 @@
+package image
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	"github.com/opencontainers/go-digest"
+)
+
+// Deduplicated dimg format
+// [ 0 (4bit) ]
+// [ length of compressed dedupInfo (4bit) ]
+// [ compressed dedupInfo ]
+// [ length of compressed image header (4bit) ]
+// [ compressed image header ]
+// [ content body without deduplicated bodies ]
+//
+// Bodies of FILE_NEW entries are stored in DIMG_STORE_BLOBS_DIR next to the dimg,
+// named with the encoded FileEntry.Digest.
+// The image header is the same as the self-contained dimg, so is the digest.
+
+const DIMG_STORE_BLOBS_DIR = "blobs"
+
+type dedupInfo struct {
+	// size of the body in the self-contained dimg
+	BodySize int64 `json:"bodySize"`
+	// sorted by Offset
+	Blobs []dedupBlob `json:"blobs"`
+}
+
+type dedupBlob struct {
+	// offset in the body of the self-contained dimg
+	Offset int64         `json:"offset"`
+	Size   int64         `json:"size"`
+	Digest digest.Digest `json:"digest"`
+}
+
+type dedupReader struct {
+	info     *dedupInfo
+	blobsDir string
+	// removed[i] is the total size of Blobs[:i]
+	removed []int64
+}
+
+// loadDedupReader returns nil and 0 if the file is a self-contained dimg.
+// The file is seeked at the head of the image header.
+func loadDedupReader(f *os.File, path string) (*dedupReader, int64, error) {
+	bs := make([]byte, 4)
+	_, err := io.ReadFull(f, bs)
+	if err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(bs) != 0 {
+		_, err = f.Seek(0, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, nil
+	}
+
+	_, err = io.ReadFull(f, bs)
+	if err != nil {
+		return nil, 0, err
+	}
+	compressedInfo := make([]byte, binary.LittleEndian.Uint32(bs))
+	_, err = io.ReadFull(f, compressedInfo)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := UnmarshalJsonFromCompressed[dedupInfo](compressedInfo)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal dedupInfo: %v", err)
+	}
+
+	dr := &dedupReader{
+		info:     info,
+		blobsDir: filepath.Join(filepath.Dir(path), DIMG_STORE_BLOBS_DIR),
+		removed:  make([]int64, len(info.Blobs)+1),
+	}
+	for i, b := range info.Blobs {
+		dr.removed[i+1] = dr.removed[i] + b.Size
+	}
+	return dr, int64(8 + len(compressedInfo)), nil
+}
+
+func (dr *dedupReader) readAt(f *os.File, bodyOffset int64, b []byte, off int64) (int, error) {
+	blobs := dr.info.Blobs
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= dr.info.BodySize {
+			return n, io.EOF
+		}
+
+		// the first blob which ends after pos
+		i := sort.Search(len(blobs), func(i int) bool {
+			return blobs[i].Offset+blobs[i].Size > pos
+		})
+		var m int
+		var err error
+		if i < len(blobs) && blobs[i].Offset <= pos {
+			end := min(len(b), n+int(blobs[i].Offset+blobs[i].Size-pos))
+			m, err = dr.readBlob(blobs[i].Digest, b[n:end], pos-blobs[i].Offset)
+			if err == io.EOF && m == end-n {
+				err = nil
+			}
+		} else {
+			limit := dr.info.BodySize
+			if i < len(blobs) {
+				limit = blobs[i].Offset
+			}
+			end := min(len(b), n+int(limit-pos))
+			m, err = f.ReadAt(b[n:end], bodyOffset+pos-dr.removed[i])
+			if err == io.EOF && m == end-n {
+				err = nil
+			}
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (dr *dedupReader) readBlob(d digest.Digest, b []byte, off int64) (int, error) {
+	f, err := os.Open(filepath.Join(dr.blobsDir, d.Encoded()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open blob %s: %v", d, err)
+	}
+	defer f.Close()
+	return f.ReadAt(b, off)
+}
+
+// dedupDimg rewrites the self-contained dimg at dimgPath into the deduplicated format
+// and stores bodies of FILE_NEW entries into blobsDir.
+// It returns the number of bodies deduplicated with existing blobs.
+func dedupDimg(dimgPath, blobsDir string) (int, error) {
+	df, err := OpenDimgFile(dimgPath)
+	if err != nil {
+		return 0, err
+	}
+	defer df.Close()
+	if df.dedup != nil {
+		return 0, nil
+	}
+	err = os.MkdirAll(blobsDir, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := []*FileEntry{}
+	collectNewFileEntries(&df.header.FileEntry, &entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Offset < entries[j].Offset
+	})
+
+	info := &dedupInfo{
+		Blobs: []dedupBlob{},
+	}
+	shared := 0
+	for _, fe := range entries {
+		if len(info.Blobs) != 0 {
+			// bodies shared by entries are deduplicated once
+			last := info.Blobs[len(info.Blobs)-1]
+			if fe.Offset < last.Offset+last.Size {
+				continue
+			}
+		}
+		blobPath := filepath.Join(blobsDir, fe.Digest.Encoded())
+		if stat, err := os.Stat(blobPath); err == nil {
+			// the body can be compressed differently
+			if stat.Size() != fe.CompressedSize {
+				continue
+			}
+			shared++
+		} else {
+			err = putBlob(df, fe, blobPath)
+			if err != nil {
+				return 0, fmt.Errorf("failed to put blob %s: %v", fe.Digest, err)
+			}
+		}
+		info.Blobs = append(info.Blobs, dedupBlob{
+			Offset: fe.Offset,
+			Size:   fe.CompressedSize,
+			Digest: fe.Digest,
+		})
+	}
+
+	size, err := df.Size()
+	if err != nil {
+		return 0, err
+	}
+	info.BodySize = size - df.bodyOffset
+
+	out, err := os.CreateTemp(filepath.Dir(dimgPath), "dedup-tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	err = writeDedupDimg(out, df, info)
+	out.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(out.Name(), dimgPath)
+	if err != nil {
+		return 0, err
+	}
+	return shared, nil
+}
+
+func collectNewFileEntries(fe *FileEntry, entries *[]*FileEntry) {
+	// empty files do not have body
+	if fe.Type == FILE_ENTRY_FILE_NEW && fe.CompressedSize != 0 {
+		*entries = append(*entries, fe)
+	}
+	for _, c := range fe.Childs {
+		collectNewFileEntries(c, entries)
+	}
+}
+
+// putBlob verifies the body of fe and writes it to blobPath
+func putBlob(df *DimgFile, fe *FileEntry, blobPath string) error {
+	compressed := make([]byte, fe.CompressedSize)
+	_, err := df.ReadAt(compressed, fe.Offset)
+	if err != nil {
+		return err
+	}
+	body, err := utils.DecompressWithZstd(compressed)
+	if err != nil {
+		return err
+	}
+	err = fe.Verify(body)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), "blob-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(compressed)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+func writeDedupDimg(out io.Writer, df *DimgFile, info *dedupInfo) error {
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	compressedInfo, err := CompressWithZstd(infoBytes)
+	if err != nil {
+		return err
+	}
+	bs := make([]byte, 8)
+	binary.LittleEndian.PutUint32(bs[4:], uint32(len(compressedInfo)))
+	_, err = out.Write(append(bs, compressedInfo...))
+	if err != nil {
+		return err
+	}
+
+	// the image header is copied as is
+	_, err = io.Copy(out, io.NewSectionReader(df.file, 0, df.bodyOffset))
+	if err != nil {
+		return err
+	}
+
+	pos := int64(0)
+	for _, b := range info.Blobs {
+		_, err = io.Copy(out, io.NewSectionReader(df.file, df.bodyOffset+pos, b.Offset-pos))
+		if err != nil {
+			return err
+		}
+		pos = b.Offset + b.Size
+	}
+	_, err = io.Copy(out, io.NewSectionReader(df.file, df.bodyOffset+pos, info.BodySize-pos))
+	return err
+}
+
+// referencedBlobs returns digests of FILE_NEW entries of the dimgs
+func referencedBlobs(dimgs []*DimgEntry) map[digest.Digest]struct{} {
+	refs := map[digest.Digest]struct{}{}
+	for _, dimg := range dimgs {
+		entries := []*FileEntry{}
+		collectNewFileEntries(&dimg.FileEntry, &entries)
+		for _, fe := range entries {
+			refs[fe.Digest] = struct{}{}
+		}
+	}
+	return refs
+}
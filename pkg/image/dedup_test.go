@@ -0,0 +1,88 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupReaderReadAt(t *testing.T) {
+	files := map[string]testFile{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("f%d", i)] = testFile{body: strings.Repeat(fmt.Sprintf("%d ", i%15), i*97+1), mode: 0644}
+	}
+	packed := packTestDir(t, writeTestDir(t, files))
+	storeDir := t.TempDir()
+	dedupPath := copyTestFile(t, packed, storeDir)
+	blobsDir := filepath.Join(storeDir, DIMG_STORE_BLOBS_DIR)
+
+	expected, err := OpenDimgFile(packed)
+	assert.Equal(t, nil, err)
+	defer expected.Close()
+
+	// the body of f5 is kept in the dimg because the existing blob has a different size
+	assert.Equal(t, nil, os.MkdirAll(blobsDir, 0755))
+	f5 := expected.DimgHeader().FileEntry.Childs["f5"]
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(blobsDir, f5.Digest.Encoded()), []byte("x"), 0644))
+
+	_, err = dedupDimg(dedupPath, blobsDir)
+	assert.Equal(t, nil, err)
+	actual, err := OpenDimgFile(dedupPath)
+	assert.Equal(t, nil, err)
+	defer actual.Close()
+	if !assert.NotNil(t, actual.dedup) {
+		return
+	}
+	assert.Equal(t, expected.DimgHeader().Digest(), actual.DimgHeader().Digest())
+	assert.Equal(t, len(files)-1, len(actual.dedup.info.Blobs))
+
+	bodySize := actual.dedup.info.BodySize
+	ranges := [][2]int64{{0, bodySize}, {0, bodySize + 10}, {bodySize - 1, 5}, {bodySize, 1}}
+	// reads across boundaries of blobs
+	for _, b := range actual.dedup.info.Blobs {
+		for _, off := range []int64{b.Offset - 1, b.Offset, b.Offset + b.Size - 1} {
+			if off >= 0 {
+				ranges = append(ranges, [2]int64{off, 2}, [2]int64{off, b.Size + 2})
+			}
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		ranges = append(ranges, [2]int64{r.Int63n(bodySize), r.Int63n(bodySize/4) + 1})
+	}
+
+	for _, rg := range ranges {
+		e := make([]byte, rg[1])
+		en, eErr := expected.ReadAt(e, rg[0])
+		a := make([]byte, rg[1])
+		an, aErr := actual.ReadAt(a, rg[0])
+		assert.Equal(t, en, an, "off=%d len=%d", rg[0], rg[1])
+		assert.Equal(t, eErr, aErr, "off=%d len=%d", rg[0], rg[1])
+		assert.True(t, bytes.Equal(e[:en], a[:an]), "off=%d len=%d", rg[0], rg[1])
+	}
+
+	expectedSize, err := expected.Size()
+	assert.Equal(t, nil, err)
+	actualSize, err := actual.Size()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expectedSize, actualSize)
+
+	// the self-contained dimg is restored
+	packedBytes, err := os.ReadFile(packed)
+	assert.Equal(t, nil, err)
+	restored := &bytes.Buffer{}
+	_, err = actual.WriteAll(restored)
+	assert.Equal(t, nil, err)
+	assert.True(t, bytes.Equal(packedBytes, restored.Bytes()))
+
+	// blobs are shared with the same dimg
+	shared, err := dedupDimg(copyTestFile(t, packed, storeDir), blobsDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(actual.dedup.info.Blobs), shared)
+}
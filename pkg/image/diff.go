@@ -2,6 +2,8 @@ package image
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,6 +15,8 @@ import (
 	"github.com/naoki9911/fuse-diff-containerd/pkg/benchmark"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
 )
 
 func getFileSize(path string) (int, error) {
@@ -34,7 +38,20 @@ func readFileAll(path string) ([]byte, error) {
 	return io.ReadAll(file)
 }
 
-func GenerateDiffFromDimg(oldDimgPath, newDimgPath, diffDimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) error {
+func GenerateDiffFromDimg(ctx context.Context, oldDimgPath, newDimgPath, diffDimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) error {
+	pt := newProgressTracker(dc.Progress, "diff")
+	err := generateDiffFromDimg(ctx, oldDimgPath, newDimgPath, diffDimgPath, isBinaryDiff, dc, pm, pt)
+	if err != nil {
+		// remove partial output
+		os.Remove(diffDimgPath)
+		return err
+	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
+
+	return nil
+}
+
+func generateDiffFromDimg(ctx context.Context, oldDimgPath, newDimgPath, diffDimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager, pt *progressTracker) error {
 	oldDimg, err := OpenDimgFile(oldDimgPath)
 	if err != nil {
 		return err
@@ -60,10 +77,11 @@ func GenerateDiffFromDimg(oldDimgPath, newDimgPath, diffDimgPath string, isBinar
 	defer os.Remove(diffTmpFile.Name())
 	defer diffTmpFile.Close()
 
-	err = generateDiffMultithread(oldDimg, newDimg, &oldDimg.DimgHeader().FileEntry, &newDimg.DimgHeader().FileEntry, diffTmpFile, isBinaryDiff, dc, pm)
+	err = generateDiffMultithread(ctx, oldDimg, newDimg, &oldDimg.DimgHeader().FileEntry, &newDimg.DimgHeader().FileEntry, diffTmpFile, isBinaryDiff, dc, pm, pt)
 	if err != nil {
 		return err
 	}
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 
 	header := DimgHeader{
 		Id:              newDimg.DimgHeader().Id,
@@ -84,7 +102,20 @@ func GenerateDiffFromDimg(oldDimgPath, newDimgPath, diffDimgPath string, isBinar
 	return nil
 }
 
-func GenerateDiffFromCdimg(oldCdimgPath, newCdimgPath, diffCdimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) error {
+func GenerateDiffFromCdimg(ctx context.Context, oldCdimgPath, newCdimgPath, diffCdimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) error {
+	pt := newProgressTracker(dc.Progress, "diff")
+	err := generateDiffFromCdimg(ctx, oldCdimgPath, newCdimgPath, diffCdimgPath, isBinaryDiff, dc, pm, pt)
+	if err != nil {
+		// remove partial output
+		os.Remove(diffCdimgPath)
+		return err
+	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
+
+	return nil
+}
+
+func generateDiffFromCdimg(ctx context.Context, oldCdimgPath, newCdimgPath, diffCdimgPath string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager, pt *progressTracker) error {
 	oldCdimg, err := OpenCdimgFile(oldCdimgPath)
 	if err != nil {
 		return err
@@ -112,10 +143,11 @@ func GenerateDiffFromCdimg(oldCdimgPath, newCdimgPath, diffCdimgPath string, isB
 	defer os.Remove(diffTmpFile.Name())
 	defer diffTmpFile.Close()
 
-	err = generateDiffMultithread(oldDimg, newDimg, &oldDimg.DimgHeader().FileEntry, &newDimg.DimgHeader().FileEntry, diffTmpFile, isBinaryDiff, dc, pm)
+	err = generateDiffMultithread(ctx, oldDimg, newDimg, &oldDimg.DimgHeader().FileEntry, &newDimg.DimgHeader().FileEntry, diffTmpFile, isBinaryDiff, dc, pm, pt)
 	if err != nil {
 		return err
 	}
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 
 	diffDimgOut := bytes.Buffer{}
 	header := DimgHeader{
@@ -164,6 +196,117 @@ type DiffConfig struct {
 	BenchmarkPerFile bool
 	Benchmarker      *benchmark.Benchmark
 	DeltaEncoding    string
+	Progress         ProgressReporter
+	// bodies of files in Profile are placed at the front of the diff body if not nil
+	Profile *AccessProfile
+
+	// bytes of decompressed bodies shared among diffs in GenerateDiffMatrixFromCdimg (0 disables the cache)
+	BodyCacheQuota int64
+
+	// shared among diffs in GenerateDiffMatrixFromCdimg
+	bodyCache *bodyCache
+}
+
+// bodyCache keeps decompressed file bodies to be reused across diffs.
+// Least recently used bodies are evicted when the total size exceeds quota.
+// nil bodyCache is valid and reads bodies without caching.
+type bodyCache struct {
+	mu      sync.Mutex
+	quota   int64
+	size    int64
+	lru     *list.List
+	entries map[bodyCacheKey]*list.Element
+}
+
+type bodyCacheKey struct {
+	imageId digest.Digest
+	offset  int64
+}
+
+type bodyCacheEntry struct {
+	key  bodyCacheKey
+	body []byte
+}
+
+func newBodyCache(quota int64) *bodyCache {
+	return &bodyCache{
+		quota:   quota,
+		lru:     list.New(),
+		entries: map[bodyCacheKey]*list.Element{},
+	}
+}
+
+func (bc *bodyCache) readBody(img *DimgFile, entry *FileEntry) ([]byte, error) {
+	key := bodyCacheKey{
+		imageId: img.DimgHeader().Id,
+		offset:  entry.Offset,
+	}
+	if bc != nil {
+		bc.mu.Lock()
+		elem, ok := bc.entries[key]
+		if ok {
+			bc.lru.MoveToFront(elem)
+		}
+		bc.mu.Unlock()
+		if ok {
+			return elem.Value.(*bodyCacheEntry).body, nil
+		}
+	}
+
+	compressed := make([]byte, entry.CompressedSize)
+	_, err := img.ReadAt(compressed, entry.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read at 0x%x: %v", entry.Offset, err)
+	}
+	body, err := utils.DecompressWithZstd(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+
+	if bc != nil {
+		bc.put(key, body)
+	}
+	return body, nil
+}
+
+func (bc *bodyCache) put(key bodyCacheKey, body []byte) {
+	if int64(len(body)) > bc.quota {
+		return
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	// the body may be read by another diff at the same time
+	if _, ok := bc.entries[key]; ok {
+		return
+	}
+	bc.entries[key] = bc.lru.PushFront(&bodyCacheEntry{key: key, body: body})
+	bc.size += int64(len(body))
+	for bc.size > bc.quota {
+		bc.removeElement(bc.lru.Back())
+	}
+}
+
+// must be called with bc.mu held
+func (bc *bodyCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*bodyCacheEntry)
+	bc.lru.Remove(elem)
+	delete(bc.entries, entry.key)
+	bc.size -= int64(len(entry.body))
+}
+
+// evict drops all bodies of the image
+func (bc *bodyCache) evict(imageId digest.Digest) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for k, elem := range bc.entries {
+		if k.imageId == imageId {
+			bc.removeElement(elem)
+		}
+	}
 }
 
 func (dc *DiffConfig) Validate() error {
@@ -182,22 +325,26 @@ type diffTaskQueue struct {
 	taskChan  chan diffTask
 	taskArray []diffTask
 	wgQ       sync.WaitGroup
+	progress  *progressTracker
 }
 
-func newDiffTaskQueue() *diffTaskQueue {
+func newDiffTaskQueue(pt *progressTracker) *diffTaskQueue {
 	dq := &diffTaskQueue{
-		wgQ: sync.WaitGroup{},
+		wgQ:      sync.WaitGroup{},
+		progress: pt,
 	}
 	dq.wgQ.Add(1)
 	return dq
 }
 
-func (dq *diffTaskQueue) Enqueue(dt diffTask) {
+func (dq *diffTaskQueue) Enqueue(ctx context.Context, dt diffTask) error {
+	dq.progress.AddTotal(1)
 	if dq.taskChan != nil {
-		dq.taskChan <- dt
-	} else {
-		dq.taskArray = append(dq.taskArray, dt)
+		return sendTask(ctx, dq.taskChan, dt)
 	}
+
+	dq.taskArray = append(dq.taskArray, dt)
+	return nil
 }
 
 func (dq *diffTaskQueue) Close() {
@@ -207,91 +354,107 @@ func (dq *diffTaskQueue) Close() {
 	}
 }
 
-func generateDiffMultithread(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEntry *FileEntry, diffWriter io.Writer, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) error {
+func generateDiffMultithread(ctx context.Context, oldDimgFile, newDimgFile *DimgFile, oldEntry, newEntry *FileEntry, diffWriter io.Writer, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager, pt *progressTracker) error {
 	diffTasks := make(chan diffTask, 10)
 	writeTasks := make(chan diffTask, 10)
-	wg := sync.WaitGroup{}
+	eg, ctx := errgroup.WithContext(ctx)
+
+	spool, err := os.CreateTemp("", "*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	written := map[*FileEntry]struct{}{}
 
-	diffTaskQueue := newDiffTaskQueue()
+	pt.SetPhase(PROGRESS_PHASE_SCAN)
+	diffTaskQueue := newDiffTaskQueue(pt)
 	if dc.ScheduleMode == DIFF_MULTI_SCHED_NONE {
 		diffTaskQueue.taskChan = diffTasks
 	} else if dc.ScheduleMode == DIFF_MULTI_SCHED_SIZE_ORDERED {
 		diffTaskQueue.taskArray = make([]diffTask, 0)
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
+	eg.Go(func() error {
+		defer diffTaskQueue.Close()
 		logger.Info("started diff task enqueu thread")
-		err := enqueueDiffTaskToQueue(oldDimgFile, newDimgFile, oldEntry, newEntry, diffTaskQueue)
+		err := enqueueDiffTaskToQueue(ctx, oldDimgFile, newDimgFile, oldEntry, newEntry, diffTaskQueue)
 		if err != nil {
-			logger.Errorf("failed to enque: %v", err)
+			return fmt.Errorf("failed to enqueue: %v", err)
 		}
-		diffTaskQueue.Close()
 		logger.Info("finished diff task enqueu thread")
-	}()
+		pt.SetPhase(PROGRESS_PHASE_PROCESS)
+		return nil
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	eg.Go(func() error {
 		diffTaskQueue.wgQ.Wait()
 		if diffTaskQueue.taskArray == nil {
-			return
+			return nil
 		}
+		defer close(diffTasks)
 		if dc.ScheduleMode == DIFF_MULTI_SCHED_SIZE_ORDERED {
 			// process larger file first
 			sort.Slice(diffTaskQueue.taskArray, func(i int, j int) bool {
 				return diffTaskQueue.taskArray[i].newEntry.Size > diffTaskQueue.taskArray[j].newEntry.Size
 			})
-			//logger.Infof("%d %d %d", diffTaskQueue.taskArray[0].newEntry.Size, diffTaskQueue.taskArray[1].newEntry.Size, diffTaskQueue.taskArray[2].newEntry.Size)
 			logger.Infof("task was ordered in size")
 		}
 
 		for i, t := range diffTaskQueue.taskArray {
 			// files to generate diffs first
 			if t.oldEntry != nil {
-				diffTasks <- diffTaskQueue.taskArray[i]
+				err := sendTask(ctx, diffTasks, diffTaskQueue.taskArray[i])
+				if err != nil {
+					return err
+				}
 			}
 		}
 
 		for i, t := range diffTaskQueue.taskArray {
 			if t.oldEntry == nil {
-				diffTasks <- diffTaskQueue.taskArray[i]
+				err := sendTask(ctx, diffTasks, diffTaskQueue.taskArray[i])
+				if err != nil {
+					return err
+				}
 			}
 		}
-		close(diffTasks)
 		logger.Info("all task was sent to diff channel")
-	}()
+		return nil
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	eg.Go(func() error {
 		logger.Info("started diff write thread")
 		diffCount := 0
 		newCount := 0
 		sameCount := 0
 		offset := int64(0)
-		for {
-			wt, more := <-writeTasks
-			if !more {
-				break
-			}
-			len := int64(len(wt.data))
-			wt.newEntry.Offset = offset
-			_, err := diffWriter.Write(wt.data)
-			offset += len
-			if err != nil {
-				logger.Errorf("failed to write to diffBody: %v", err)
-				return
-			}
-			switch wt.newEntry.Type {
-			case FILE_ENTRY_FILE_DIFF:
-				diffCount += 1
-			case FILE_ENTRY_FILE_NEW:
-				newCount += 1
-			case FILE_ENTRY_FILE_SAME:
-				sameCount += 1
+		for cont := true; cont; {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case wt, more := <-writeTasks:
+				if !more {
+					cont = false
+					break
+				}
+				len := int64(len(wt.data))
+				wt.newEntry.Offset = offset
+				_, err := spool.Write(wt.data)
+				if err != nil {
+					return fmt.Errorf("failed to write to spool: %v", err)
+				}
+				offset += len
+				written[wt.newEntry] = struct{}{}
+				pt.FileDone(wt.newEntry.Name, int64(wt.newEntry.Size), len)
+				switch wt.newEntry.Type {
+				case FILE_ENTRY_FILE_DIFF:
+					diffCount += 1
+				case FILE_ENTRY_FILE_NEW:
+					newCount += 1
+				case FILE_ENTRY_FILE_SAME:
+					sameCount += 1
+				}
 			}
 		}
 
@@ -306,134 +469,150 @@ func generateDiffMultithread(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEn
 			}
 			err := dc.Benchmarker.AppendResult(metric)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("failed to append benchmark result: %v", err)
 			}
 		}
 		logger.Info("finished diff write thread")
-	}()
+		return nil
+	})
 
-	compWg := sync.WaitGroup{}
+	diffWg := sync.WaitGroup{}
 	for i := 0; i < dc.ThreadNum; i++ {
-		wg.Add(1)
-		compWg.Add(1)
-		go func(threadId int) {
+		diffWg.Add(1)
+		threadId := i
+		eg.Go(func() error {
 			logger.Infof("started diff thread idx=%d", threadId)
-			defer wg.Done()
-			defer compWg.Done()
+			defer diffWg.Done()
 			for {
-				dt, more := <-diffTasks
-				if !more {
-					break
-				}
-				//logger.Infof("[thread %d] diffTask %s size=%d", threadId, dt.newEntry.Name, dt.newEntry.Size)
-
-				if dt.oldEntry == nil {
-					dt.data = make([]byte, dt.newEntry.CompressedSize)
-					_, err := newDimgFile.ReadAt(dt.data, dt.newEntry.Offset)
-					if err != nil {
-						logger.Errorf("failed to read from newDimgFile at 0x%x: %v", dt.newEntry.Offset, err)
-						break
-					}
-				} else {
-					start := time.Now()
-					newCompressedBytes := make([]byte, dt.newEntry.CompressedSize)
-					_, err := newDimgFile.ReadAt(newCompressedBytes, dt.newEntry.Offset)
-					if err != nil {
-						logger.Errorf("failed to read from newDimgFile at 0x%x: %v", dt.newEntry.Offset, err)
-						break
-					}
-					newBytes, err := utils.DecompressWithZstd(newCompressedBytes)
-					if err != nil {
-						logger.Errorf("failed to decompress newBytes: %v", err)
-						break
-					}
-
-					oldCompressedBytes := make([]byte, dt.oldEntry.CompressedSize)
-					_, err = oldDimgFile.ReadAt(oldCompressedBytes, dt.oldEntry.Offset)
-					if err != nil {
-						logger.Errorf("failed to read from oldDimgFile at 0x%x: %v", dt.oldEntry.Offset, err)
-						break
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case dt, more := <-diffTasks:
+					if !more {
+						logger.Infof("finished diff thread idx=%d", threadId)
+						return nil
 					}
-					oldBytes, err := utils.DecompressWithZstd(oldCompressedBytes)
+					hasBody, err := processDiffTask(&dt, oldDimgFile, newDimgFile, isBinaryDiff, dc, pm)
 					if err != nil {
-						logger.Errorf("failed to decompress oldBytes: %v", err)
-						break
+						return fmt.Errorf("failed to process %s: %v", dt.newEntry.Name, err)
 					}
-					isSame := bytes.Equal(newBytes, oldBytes)
-					if isSame {
-						dt.newEntry.Type = FILE_ENTRY_FILE_SAME
-						dt.newEntry.CompressedSize = 0
+					if !hasBody {
+						pt.FileDone(dt.newEntry.Name, int64(dt.newEntry.Size), 0)
 						continue
 					}
-					if len(oldBytes) > 0 && isBinaryDiff {
-						var p *bsdiffx.Plugin = nil
-						switch dc.DeltaEncoding {
-						case "mixed":
-							p = pm.GetPluginBySize(dt.newEntry.Size)
-						default:
-							p = pm.GetPluginByName(dc.DeltaEncoding)
-						}
-						if p == nil {
-							panic(fmt.Sprintf("unknown delta encoding %s", dc.DeltaEncoding))
-						}
-						// old File may be 0-bytes
-						diffWriter := new(bytes.Buffer)
-						//fmt.Printf("oldBytes=%d newBytes=%d old=%v new=%v\n", len(oldBytes), len(newBytes), *oldChildEntry, *newChildEntry)
-						err = p.Diff(oldBytes, newBytes, diffWriter, dc.CompressionMode)
-						if err != nil {
-							logger.Errorf("failed to bsdiff.Diff: %v", err)
-							break
-						}
-						dt.newEntry.Type = FILE_ENTRY_FILE_DIFF
-						dt.newEntry.CompressedSize = int64(diffWriter.Len())
-						dt.data = diffWriter.Bytes()
-						dt.newEntry.PluginUuid = p.ID()
-					} else {
-						dt.newEntry.Type = FILE_ENTRY_FILE_NEW
-						dt.data = make([]byte, dt.newEntry.CompressedSize)
-						_, err := newDimgFile.ReadAt(dt.data, dt.newEntry.Offset)
-						if err != nil {
-							logger.Errorf("failed to read from newDimgFile at 0x%x: %v", dt.newEntry.Offset, err)
-							break
-						}
-					}
-					elapsed := time.Since(start)
-					if dc.BenchmarkPerFile {
-						metric := benchmark.Metric{
-							TaskName:     "diff-per-file",
-							ElapsedMilli: int(elapsed.Milliseconds()),
-							Size:         int64(dt.newEntry.Size),
-							Labels: map[string]string{
-								"type":           EntryTypeToString(dt.newEntry.Type),
-								"compressedSize": strconv.Itoa(int(dt.newEntry.CompressedSize)),
-							},
-						}
-						err = dc.Benchmarker.AppendResult(metric)
-						if err != nil {
-							panic(err)
-						}
+					err = sendTask(ctx, writeTasks, dt)
+					if err != nil {
+						return err
 					}
 				}
-				writeTasks <- dt
 			}
-			logger.Infof("finished diff thread idx=%d", threadId)
-		}(i)
+		})
 	}
 
 	go func() {
-		compWg.Wait()
+		diffWg.Wait()
 		close(writeTasks)
 		logger.Infof("all diff tasks finished")
 	}()
 
-	wg.Wait()
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
 
 	logger.Info("started to update dir entry")
 	updateDirFileEntry(newEntry)
 	logger.Info("finished to update dir entry")
+
+	err = canonicalizeBody(newEntry, written, spool, diffWriter, dc.Profile)
+	if err != nil {
+		return fmt.Errorf("failed to write diffBody: %v", err)
+	}
 	return nil
 }
 
+// processDiffTask fills dt.data and updates dt.newEntry.
+// It returns false when the file does not have body to be written.
+func processDiffTask(dt *diffTask, oldDimgFile, newDimgFile *DimgFile, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) (bool, error) {
+	if dt.oldEntry == nil {
+		dt.data = make([]byte, dt.newEntry.CompressedSize)
+		_, err := newDimgFile.ReadAt(dt.data, dt.newEntry.Offset)
+		if err != nil {
+			return false, fmt.Errorf("failed to read from newDimgFile at 0x%x: %v", dt.newEntry.Offset, err)
+		}
+		return true, nil
+	}
+
+	start := time.Now()
+	newBytes, err := dc.bodyCache.readBody(newDimgFile, dt.newEntry)
+	if err != nil {
+		return false, fmt.Errorf("failed to read new body: %v", err)
+	}
+	oldBytes, err := dc.bodyCache.readBody(oldDimgFile, dt.oldEntry)
+	if err != nil {
+		return false, fmt.Errorf("failed to read old body: %v", err)
+	}
+	isSame := bytes.Equal(newBytes, oldBytes)
+	if isSame {
+		dt.newEntry.Type = FILE_ENTRY_FILE_SAME
+		dt.newEntry.CompressedSize = 0
+		dt.newEntry.Frames = nil
+		return false, nil
+	}
+	if len(oldBytes) > 0 && isBinaryDiff {
+		var p *bsdiffx.Plugin = nil
+		switch dc.DeltaEncoding {
+		case "mixed":
+			// content-specific plugins (e.g. archives) are preferred
+			p = pm.GetPluginByFile(dt.newEntry.Name, newBytes)
+			if p == nil {
+				p = pm.GetPluginBySize(dt.newEntry.Size)
+			}
+		default:
+			p = pm.GetPluginByName(dc.DeltaEncoding)
+		}
+		if p == nil {
+			return false, fmt.Errorf("unknown delta encoding %s", dc.DeltaEncoding)
+		}
+		// old File may be 0-bytes
+		diffWriter := new(bytes.Buffer)
+		err = p.Diff(oldBytes, newBytes, diffWriter, dc.CompressionMode)
+		if err != nil {
+			return false, fmt.Errorf("failed to diff: %v", err)
+		}
+		dt.newEntry.Type = FILE_ENTRY_FILE_DIFF
+		dt.newEntry.CompressedSize = int64(diffWriter.Len())
+		dt.newEntry.Frames = nil
+		dt.data = diffWriter.Bytes()
+		dt.newEntry.PluginUuid = p.ID()
+	} else {
+		dt.newEntry.Type = FILE_ENTRY_FILE_NEW
+		dt.data = make([]byte, dt.newEntry.CompressedSize)
+		_, err := newDimgFile.ReadAt(dt.data, dt.newEntry.Offset)
+		if err != nil {
+			return false, fmt.Errorf("failed to read from newDimgFile at 0x%x: %v", dt.newEntry.Offset, err)
+		}
+	}
+	elapsed := time.Since(start)
+	if dc.BenchmarkPerFile {
+		metric := benchmark.Metric{
+			TaskName:     "diff-per-file",
+			ElapsedMilli: int(elapsed.Milliseconds()),
+			Size:         int64(dt.newEntry.Size),
+			Labels: map[string]string{
+				"type":           EntryTypeToString(dt.newEntry.Type),
+				"compressedSize": strconv.Itoa(int(dt.newEntry.CompressedSize)),
+			},
+		}
+		err = dc.Benchmarker.AppendResult(metric)
+		if err != nil {
+			return false, fmt.Errorf("failed to append benchmark result: %v", err)
+		}
+	}
+
+	return true, nil
+}
+
 // updates FileEntry.Type to FILE_ENTRY_DIR or FILE_ENTRY_DIR_NEW
 func updateDirFileEntry(entry *FileEntry) {
 	if !entry.IsDir() {
@@ -458,8 +637,8 @@ func updateDirFileEntry(entry *FileEntry) {
 	}
 }
 
-func enqueueDiffTaskToQueue(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEntry *FileEntry, taskQ *diffTaskQueue) error {
-	for fName := range newEntry.Childs {
+func enqueueDiffTaskToQueue(ctx context.Context, oldDimgFile, newDimgFile *DimgFile, oldEntry, newEntry *FileEntry, taskQ *diffTaskQueue) error {
+	for _, fName := range sortedChildNames(newEntry) {
 		newChildEntry := newEntry.Childs[fName]
 		if newChildEntry.Type == FILE_ENTRY_FILE_SAME ||
 			newChildEntry.Type == FILE_ENTRY_FILE_DIFF {
@@ -474,15 +653,18 @@ func enqueueDiffTaskToQueue(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEnt
 		// newly created file or directory
 		if oldEntry == nil {
 			if newChildEntry.IsDir() {
-				err := enqueueDiffTaskToQueue(oldDimgFile, newDimgFile, nil, newChildEntry, taskQ)
+				err := enqueueDiffTaskToQueue(ctx, oldDimgFile, newDimgFile, nil, newChildEntry, taskQ)
 				if err != nil {
 					return err
 				}
 			} else {
-				taskQ.Enqueue(diffTask{
+				err := taskQ.Enqueue(ctx, diffTask{
 					oldEntry: nil,
 					newEntry: newChildEntry,
 				})
+				if err != nil {
+					return err
+				}
 			}
 
 			continue
@@ -495,15 +677,18 @@ func enqueueDiffTaskToQueue(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEnt
 			oldChildEntry.Name != newChildEntry.Name ||
 			oldChildEntry.Type != newChildEntry.Type {
 			if newChildEntry.IsDir() {
-				err := enqueueDiffTaskToQueue(oldDimgFile, newDimgFile, nil, newChildEntry, taskQ)
+				err := enqueueDiffTaskToQueue(ctx, oldDimgFile, newDimgFile, nil, newChildEntry, taskQ)
 				if err != nil {
 					return err
 				}
 			} else {
-				taskQ.Enqueue(diffTask{
+				err := taskQ.Enqueue(ctx, diffTask{
 					oldEntry: nil,
 					newEntry: newChildEntry,
 				})
+				if err != nil {
+					return err
+				}
 			}
 
 			continue
@@ -511,7 +696,7 @@ func enqueueDiffTaskToQueue(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEnt
 
 		// if both new and old are directory, recursively generate diff
 		if newChildEntry.IsDir() {
-			err := enqueueDiffTaskToQueue(oldDimgFile, newDimgFile, oldChildEntry, newChildEntry, taskQ)
+			err := enqueueDiffTaskToQueue(ctx, oldDimgFile, newDimgFile, oldChildEntry, newChildEntry, taskQ)
 			if err != nil {
 				return err
 			}
@@ -519,10 +704,13 @@ func enqueueDiffTaskToQueue(oldDimgFile, newDimgFile *DimgFile, oldEntry, newEnt
 			continue
 		}
 
-		taskQ.Enqueue(diffTask{
+		err := taskQ.Enqueue(ctx, diffTask{
 			oldEntry: oldChildEntry,
 			newEntry: newChildEntry,
 		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,37 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyCacheQuota(t *testing.T) {
+	bc := newBodyCache(10)
+	key := func(img string, offset int64) bodyCacheKey {
+		return bodyCacheKey{imageId: digest.FromString(img), offset: offset}
+	}
+
+	bc.put(key("a", 0), []byte("0123"))
+	bc.put(key("a", 4), []byte("4567"))
+	bc.put(key("b", 0), []byte("89"))
+	assert.Equal(t, int64(10), bc.size)
+
+	// the least recently used body is evicted
+	bc.lru.MoveToFront(bc.entries[key("a", 0)])
+	bc.put(key("b", 2), []byte("ab"))
+	assert.Equal(t, int64(8), bc.size)
+	_, ok := bc.entries[key("a", 4)]
+	assert.False(t, ok)
+
+	// bodies larger than quota are not cached
+	bc.put(key("c", 0), make([]byte, 11))
+	_, ok = bc.entries[key("c", 0)]
+	assert.False(t, ok)
+
+	bc.evict(digest.FromString("b"))
+	assert.Equal(t, int64(4), bc.size)
+	assert.Equal(t, 1, len(bc.entries))
+	assert.Equal(t, 1, bc.lru.Len())
+}
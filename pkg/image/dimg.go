@@ -29,9 +29,13 @@ func (dh *DimgHeader) Digest() digest.Digest {
 }
 
 type DimgFile struct {
-	header     *DimgHeader
-	file       *os.File
-	bodyOffset int64
+	header *DimgHeader
+	file   *os.File
+	// offset of the dimg header in file
+	headerOffset int64
+	bodyOffset   int64
+	// not nil if FILE_NEW bodies are deduplicated into blobs
+	dedup *dedupReader
 }
 
 var _ ImageFile = (*DimgFile)(nil)
@@ -42,15 +46,24 @@ func OpenDimgFile(path string) (*DimgFile, error) {
 		return nil, err
 	}
 
+	dedup, headerOffset, err := loadDedupReader(imageFile, path)
+	if err != nil {
+		imageFile.Close()
+		return nil, err
+	}
+
 	header, offset, err := LoadDimgHeader(imageFile)
 	if err != nil {
+		imageFile.Close()
 		return nil, err
 	}
 
 	df := &DimgFile{
-		header:     header,
-		file:       imageFile,
-		bodyOffset: offset,
+		header:       header,
+		file:         imageFile,
+		headerOffset: headerOffset,
+		bodyOffset:   headerOffset + offset,
+		dedup:        dedup,
 	}
 	return df, nil
 }
@@ -93,8 +106,17 @@ func (df *DimgFile) Close() error {
 	return nil
 }
 
+// WriteAll writes the self-contained dimg.
 // This may close myself
 func (df *DimgFile) WriteAll(w io.Writer) (int64, error) {
+	if df.dedup != nil {
+		headerSize := df.bodyOffset - df.headerOffset
+		return io.Copy(w, io.MultiReader(
+			io.NewSectionReader(df.file, df.headerOffset, headerSize),
+			io.NewSectionReader(df, 0, df.dedup.info.BodySize),
+		))
+	}
+
 	_, err := df.file.Seek(0, 0)
 	if err != nil {
 		return 0, err
@@ -103,7 +125,23 @@ func (df *DimgFile) WriteAll(w io.Writer) (int64, error) {
 	return io.Copy(w, df.file)
 }
 
+// Size returns the size of the self-contained dimg
+func (df *DimgFile) Size() (int64, error) {
+	if df.dedup != nil {
+		return df.bodyOffset - df.headerOffset + df.dedup.info.BodySize, nil
+	}
+
+	stat, err := df.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size() - df.headerOffset, nil
+}
+
 func (df *DimgFile) ReadAt(b []byte, off int64) (int, error) {
+	if df.dedup != nil {
+		return df.dedup.readAt(df.file, df.bodyOffset, b, off)
+	}
 	return df.file.ReadAt(b, df.bodyOffset+off)
 }
 
@@ -84,6 +84,8 @@ type FileEntry struct {
 	Offset         int64         `json:"offset,omitempty"`
 	Digest         digest.Digest `json:"digest"`
 	PluginUuid     uuid.UUID     `json:"pluginUuid"`
+	// index of zstd frames in the body of FILE_NEW. empty if the body is a single frame
+	Frames []ZstdFrame `json:"frames,omitempty"`
 }
 
 func (fe *FileEntry) DeepCopy() *FileEntry {
@@ -254,6 +256,26 @@ func (fe *FileEntry) GenerateDigest(body []byte) (digest.Digest, error) {
 	return d, nil
 }
 
+// Digester returns digest.Digester which generates the same digest as GenerateDigest
+// when the body is written to it.
+func (fe *FileEntry) Digester() (digest.Digester, error) {
+	fed, err := fe.feForDigest()
+	if err != nil {
+		return nil, err
+	}
+	feBytes, err := json.Marshal(fed)
+	if err != nil {
+		return nil, err
+	}
+
+	d := digest.Canonical.Digester()
+	_, err = d.Hash().Write(feBytes)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
 func (fe *FileEntry) Verify(body []byte) error {
 	d, err := fe.GenerateDigest(body)
 	if err != nil {
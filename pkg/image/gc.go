@@ -0,0 +1,285 @@
+package image
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+const GC_DEFAULT_GRACE_PERIOD = 10 * time.Minute
+
+type GCConfig struct {
+	// ids of images in use. dimgs required to reconstruct them are kept.
+	Roots []digest.Digest
+	// dimgs and files added within GracePeriod are kept
+	// because they may not be referenced by roots yet.
+	GracePeriod time.Duration
+	DryRun      bool
+	// dimgs (DimgHeader.Digest) kept regardless of roots (e.g. mounted dimgs)
+	Pinned []digest.Digest
+	// keep only the chain with the fewest dimgs from each root to a base image,
+	// which is used to mount the root, instead of every chain.
+	ShortestChainOnly bool
+}
+
+// ParseGCQuery parses GCConfig from the query of GC requests (dryRun and gracePeriod).
+// Roots are not included.
+func ParseGCQuery(q url.Values) (GCConfig, error) {
+	gc := GCConfig{
+		GracePeriod: GC_DEFAULT_GRACE_PERIOD,
+	}
+	var err error
+	if v := q.Get("dryRun"); v != "" {
+		gc.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			return gc, fmt.Errorf("invalid dryRun %s: %v", v, err)
+		}
+	}
+	if v := q.Get("gracePeriod"); v != "" {
+		gc.GracePeriod, err = time.ParseDuration(v)
+		if err != nil {
+			return gc, fmt.Errorf("invalid gracePeriod %s: %v", v, err)
+		}
+	}
+	return gc, nil
+}
+
+type GCResult struct {
+	RemovedDimgs []digest.Digest `json:"removedDimgs"`
+	RemovedFiles []string        `json:"removedFiles"`
+	FreedBytes   int64           `json:"freedBytes"`
+}
+
+// GarbageCollect removes dimgs not reachable from gc.Roots with mark and sweep.
+// A dimg is reachable if its Id is a root or the ParentId of a reachable dimg,
+// so every chain to mount roots is kept unless gc.ShortestChainOnly.
+// Files in the store directory not in the index are also removed.
+// Blobs only referenced by removed dimgs are also removed.
+// Removed dimgs can be still read by mounted filesystems which opened them
+// unless they are deduplicated, so mounted dimgs should be pinned.
+func (ds *DimgStore) GarbageCollect(gc GCConfig) (*GCResult, error) {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	// mark
+	marked := map[digest.Digest]struct{}{}
+	for _, d := range gc.Pinned {
+		marked[d] = struct{}{}
+	}
+	if gc.ShortestChainOnly {
+		ds.markShortestChains(gc.Roots, marked)
+	} else {
+		ds.markAllChains(gc.Roots, marked)
+	}
+
+	// sweep
+	res := &GCResult{
+		RemovedDimgs: []digest.Digest{},
+		RemovedFiles: []string{},
+	}
+	now := time.Now()
+	sweep := []digest.Digest{}
+	sweepSet := map[digest.Digest]struct{}{}
+	indexed := map[string]struct{}{}
+	for d, entry := range ds.dimgDigests {
+		indexed[entry.Path] = struct{}{}
+		if _, ok := marked[d]; ok {
+			continue
+		}
+		if now.Sub(entry.AddedAt) < gc.GracePeriod {
+			continue
+		}
+		sweep = append(sweep, d)
+		sweepSet[d] = struct{}{}
+		res.RemovedDimgs = append(res.RemovedDimgs, d)
+		res.FreedBytes += entry.storedSize()
+	}
+	blobs, blobsSize, err := ds.unreferencedBlobs(sweepSet)
+	if err != nil {
+		return nil, err
+	}
+	res.RemovedFiles = append(res.RemovedFiles, blobs...)
+	res.FreedBytes += blobsSize
+
+	dirs, err := os.ReadDir(ds.storeDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ReadDir %s: %v", ds.storeDir, err)
+	}
+	for _, dir := range dirs {
+		fPath := filepath.Join(ds.storeDir, dir.Name())
+		if dir.Name() == DIMG_STORE_INDEX_NAME || !dir.Type().IsRegular() {
+			continue
+		}
+		if _, ok := indexed[fPath]; ok {
+			continue
+		}
+		info, err := dir.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) < gc.GracePeriod {
+			continue
+		}
+		res.RemovedFiles = append(res.RemovedFiles, fPath)
+		res.FreedBytes += info.Size()
+	}
+
+	if gc.DryRun {
+		return res, nil
+	}
+
+	err = ds.removeDimgs(sweep, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// must be called with ds.storeLock held
+func (ds *DimgStore) markAllChains(roots []digest.Digest, marked map[digest.Digest]struct{}) {
+	byId := map[digest.Digest][]digest.Digest{}
+	for d, entry := range ds.dimgDigests {
+		byId[entry.Id] = append(byId[entry.Id], d)
+	}
+	visited := map[digest.Digest]struct{}{}
+	queue := append([]digest.Digest{}, roots...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[id]; ok || id == "" {
+			continue
+		}
+		visited[id] = struct{}{}
+		for _, d := range byId[id] {
+			marked[d] = struct{}{}
+			queue = append(queue, ds.dimgDigests[d].ParentId)
+		}
+	}
+}
+
+// must be called with ds.storeLock held
+func (ds *DimgStore) markShortestChains(roots []digest.Digest, marked map[digest.Digest]struct{}) {
+	for _, root := range roots {
+		chain, err := ds.getDimgEntries(root, []digest.Digest{""}, PathObjectiveHops)
+		if err != nil {
+			logger.Warnf("gc: chain for %s not found: %v", root, err)
+			continue
+		}
+		for _, entry := range chain {
+			marked[entry.Digest()] = struct{}{}
+		}
+	}
+}
+
+// removeDimgs removes dimgs and files in res.RemovedFiles.
+// must be called with ds.storeLock held
+func (ds *DimgStore) removeDimgs(dimgDigests []digest.Digest, res *GCResult) error {
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dimgStoreBucketDimgs))
+		for _, d := range dimgDigests {
+			err := b.Delete([]byte(d))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete dimgs from index: %v", err)
+	}
+
+	for _, d := range dimgDigests {
+		entry := ds.dimgDigests[d]
+		delete(ds.dimgDigests, d)
+		res.RemovedFiles = append(res.RemovedFiles, entry.Path)
+		logger.Infof("removed dimg %s (Id=%s ParentId=%s)", d, entry.Id, entry.ParentId)
+	}
+	ds.rebuildGraph()
+
+	for _, fPath := range res.RemovedFiles {
+		// opened files can be still read after removal
+		err = os.Remove(fPath)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warnf("failed to remove %s: %v", fPath, err)
+		}
+	}
+	return nil
+}
+
+// EvictLRU removes least recently mounted dimgs until the total size of dimgs is within quota.
+// Blobs of deduplicated dimgs are not counted.
+// Pinned dimgs (e.g. dimgs mounted by running containers) are never removed.
+func (ds *DimgStore) EvictLRU(quota int64, pinned []digest.Digest) (*GCResult, error) {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	pinnedSet := map[digest.Digest]struct{}{}
+	for _, d := range pinned {
+		pinnedSet[d] = struct{}{}
+	}
+
+	total := int64(0)
+	candidates := []digest.Digest{}
+	for d, entry := range ds.dimgDigests {
+		total += entry.storedSize()
+		if _, ok := pinnedSet[d]; !ok {
+			candidates = append(candidates, d)
+		}
+	}
+
+	res := &GCResult{
+		RemovedDimgs: []digest.Digest{},
+		RemovedFiles: []string{},
+	}
+	if total <= quota {
+		return res, nil
+	}
+
+	// dimgs never mounted are ordered by the time they were added
+	lastUsed := func(d digest.Digest) time.Time {
+		entry := ds.dimgDigests[d]
+		if entry.LastMountedAt.IsZero() {
+			return entry.AddedAt
+		}
+		return entry.LastMountedAt
+	}
+	slices.SortFunc(candidates, func(a, b digest.Digest) int {
+		return lastUsed(a).Compare(lastUsed(b))
+	})
+
+	evict := []digest.Digest{}
+	evictSet := map[digest.Digest]struct{}{}
+	for _, d := range candidates {
+		if total <= quota {
+			break
+		}
+		evict = append(evict, d)
+		evictSet[d] = struct{}{}
+		total -= ds.dimgDigests[d].storedSize()
+		res.RemovedDimgs = append(res.RemovedDimgs, d)
+		res.FreedBytes += ds.dimgDigests[d].storedSize()
+	}
+	if total > quota {
+		logger.Warnf("dimgs in use (%d bytes) exceed quota %d", total, quota)
+	}
+	blobs, blobsSize, err := ds.unreferencedBlobs(evictSet)
+	if err != nil {
+		return nil, err
+	}
+	res.RemovedFiles = append(res.RemovedFiles, blobs...)
+	res.FreedBytes += blobsSize
+
+	err = ds.removeDimgs(evict, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,114 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newGCTestStore returns the store with the base dimg of v1, the diff from v1 to v2 and the base dimg of v2
+func newGCTestStore(t *testing.T) (*DimgStore, []*DimgHeader) {
+	base1, diff12, base2 := storeTestDimgs(t)
+	ds, err := NewDimgStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+
+	headers := []*DimgHeader{}
+	for _, p := range []string{base1, diff12, base2} {
+		headers = append(headers, dimgHeaderOf(t, p))
+		err = ds.AddDimg(copyTestFile(t, p, t.TempDir()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ds, headers
+}
+
+func sortedDigests(ds []digest.Digest) []digest.Digest {
+	sorted := append([]digest.Digest{}, ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func storedDimgs(ds *DimgStore, headers []*DimgHeader) []bool {
+	stored := []bool{}
+	for _, h := range headers {
+		_, ok := ds.GetDimgEntry(h.Digest())
+		stored = append(stored, ok)
+	}
+	return stored
+}
+
+func TestGarbageCollect(t *testing.T) {
+	ds, headers := newGCTestStore(t)
+	base1, diff12, base2 := headers[0], headers[1], headers[2]
+	stray := filepath.Join(ds.storeDir, "stray")
+	assert.Equal(t, nil, os.WriteFile(stray, []byte("stray"), 0644))
+
+	// dimgs are kept within the grace period
+	res, err := ds.GarbageCollect(GCConfig{Roots: []digest.Digest{base1.Id}, GracePeriod: GC_DEFAULT_GRACE_PERIOD})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(res.RemovedDimgs))
+	assert.Equal(t, []bool{true, true, true}, storedDimgs(ds, headers))
+
+	res, err = ds.GarbageCollect(GCConfig{Roots: []digest.Digest{base1.Id}, DryRun: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sortedDigests([]digest.Digest{diff12.Digest(), base2.Digest()}), sortedDigests(res.RemovedDimgs))
+	assert.Contains(t, res.RemovedFiles, stray)
+	assert.Equal(t, []bool{true, true, true}, storedDimgs(ds, headers))
+	_, err = os.Stat(stray)
+	assert.Equal(t, nil, err)
+
+	// every chain to the root is kept
+	res, err = ds.GarbageCollect(GCConfig{Roots: []digest.Digest{base2.Id}, Pinned: []digest.Digest{diff12.Digest()}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(res.RemovedDimgs))
+	assert.Equal(t, []bool{true, true, true}, storedDimgs(ds, headers))
+	_, err = os.Stat(stray)
+	assert.True(t, os.IsNotExist(err))
+
+	// only the chain with the fewest dimgs is kept
+	res, err = ds.GarbageCollect(GCConfig{Roots: []digest.Digest{base2.Id}, ShortestChainOnly: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sortedDigests([]digest.Digest{base1.Digest(), diff12.Digest()}), sortedDigests(res.RemovedDimgs))
+	assert.Equal(t, []bool{false, false, true}, storedDimgs(ds, headers))
+	entry, _ := ds.GetDimgEntry(base2.Digest())
+	_, err = os.Stat(entry.Path)
+	assert.Equal(t, nil, err)
+}
+
+func TestEvictLRU(t *testing.T) {
+	ds, headers := newGCTestStore(t)
+	base1, diff12, base2 := headers[0], headers[1], headers[2]
+	sizes := map[*DimgHeader]int64{}
+	total := int64(0)
+	for _, h := range headers {
+		entry, _ := ds.GetDimgEntry(h.Digest())
+		sizes[h] = entry.storedSize()
+		total += sizes[h]
+	}
+
+	res, err := ds.EvictLRU(total, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(res.RemovedDimgs))
+
+	// base1 is the least recently used and diff12 is pinned
+	assert.Equal(t, nil, ds.TouchDimgs([]digest.Digest{diff12.Digest(), base2.Digest()}))
+	res, err = ds.EvictLRU(total-1, []digest.Digest{diff12.Digest()})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []digest.Digest{base1.Digest()}, res.RemovedDimgs)
+	assert.Equal(t, sizes[base1], res.FreedBytes)
+	assert.Equal(t, []bool{false, true, true}, storedDimgs(ds, headers))
+
+	// pinned dimgs are kept even if they exceed quota
+	res, err = ds.EvictLRU(0, []digest.Digest{diff12.Digest()})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []digest.Digest{base2.Digest()}, res.RemovedDimgs)
+	assert.Equal(t, []bool{false, true, false}, storedDimgs(ds, headers))
+}
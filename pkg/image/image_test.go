@@ -0,0 +1,150 @@
+package image
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/stretchr/testify/assert"
+)
+
+type testFile struct {
+	body string
+	// directories have os.ModeDir and symlinks have os.ModeSymlink with the target in body
+	mode os.FileMode
+}
+
+// writeTestDir creates files in a new directory
+func writeTestDir(t *testing.T, files map[string]testFile) string {
+	dir := t.TempDir()
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		f := files[p]
+		fPath := filepath.Join(dir, p)
+		err := os.MkdirAll(filepath.Dir(fPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case f.mode&os.ModeDir != 0:
+			err = os.MkdirAll(fPath, 0755)
+		case f.mode&os.ModeSymlink != 0:
+			err = os.Symlink(f.body, fPath)
+		default:
+			err = os.WriteFile(fPath, []byte(f.body), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// read-only directories are chmod-ed after their children are created
+	for i := len(paths) - 1; i >= 0; i-- {
+		f := files[paths[i]]
+		if f.mode&os.ModeSymlink != 0 {
+			continue
+		}
+		err := os.Chmod(filepath.Join(dir, paths[i]), f.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func packTestDir(t *testing.T, dir string) string {
+	out := filepath.Join(t.TempDir(), "image.dimg")
+	err := PackDir(context.Background(), dir, out, 4, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// testPluginManager returns PluginManager without plugins built as shared objects
+func testPluginManager(t *testing.T) *bsdiffx.PluginManager {
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	err := os.WriteFile(path, []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := bsdiffx.LoadOrDefaultPlugins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pm
+}
+
+// diffTestDimg generates the file-level diff which does not require plugins
+func diffTestDimg(t *testing.T, oldDimg, newDimg string) string {
+	out := filepath.Join(t.TempDir(), "diff.dimg")
+	dc := DiffConfig{
+		ThreadNum:    4,
+		ScheduleMode: DIFF_MULTI_SCHED_NONE,
+	}
+	err := GenerateDiffFromDimg(context.Background(), oldDimg, newDimg, out, false, dc, testPluginManager(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// assertSameTree checks that actual has the same entries, bodies, modes and ownership as expected
+func assertSameTree(t *testing.T, expected, actual string) {
+	walk := func(root string) map[string]fs.FileInfo {
+		infos := map[string]fs.FileInfo{}
+		err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			infos[rel] = info
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	expectedInfos := walk(expected)
+	actualInfos := walk(actual)
+	for p, e := range expectedInfos {
+		a, ok := actualInfos[p]
+		if !assert.True(t, ok, "%s not found", p) {
+			continue
+		}
+		assert.Equal(t, e.Mode(), a.Mode(), p)
+		es := e.Sys().(*syscall.Stat_t)
+		as := a.Sys().(*syscall.Stat_t)
+		assert.Equal(t, es.Uid, as.Uid, p)
+		assert.Equal(t, es.Gid, as.Gid, p)
+		switch {
+		case e.Mode().IsRegular():
+			eBody, _ := os.ReadFile(filepath.Join(expected, p))
+			aBody, _ := os.ReadFile(filepath.Join(actual, p))
+			assert.Equal(t, eBody, aBody, p)
+		case e.Mode()&os.ModeSymlink != 0:
+			eLink, _ := os.Readlink(filepath.Join(expected, p))
+			aLink, _ := os.Readlink(filepath.Join(actual, p))
+			assert.Equal(t, eLink, aLink, p)
+		}
+	}
+	for p := range actualInfos {
+		_, ok := expectedInfos[p]
+		assert.True(t, ok, "unexpected %s", p)
+	}
+}
@@ -0,0 +1,529 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"golang.org/x/sys/unix"
+)
+
+// In-place patching updates a directory without a second copy of the rootfs.
+// 1. changed entries are staged with temporary names next to their final paths
+// 2. the journal is committed with operations to move them into place
+// 3. removals, renames, hardlinks and attribute changes in the journal are applied
+// If the update is interrupted, RecoverPatchInPlace rolls back staged entries
+// before the commit and rolls forward operations after the commit.
+
+const (
+	INPLACE_JOURNAL_NAME = ".d4c-journal"
+	INPLACE_TMP_PREFIX   = ".d4c-tmp."
+
+	INPLACE_STATE_PREPARE = "prepare"
+	INPLACE_STATE_COMMIT  = "commit"
+
+	INPLACE_OP_REMOVE = "remove"
+	INPLACE_OP_RENAME = "rename"
+	INPLACE_OP_LINK   = "link"
+	// mode and ownership of existing entries are updated
+	INPLACE_OP_ATTR = "attr"
+)
+
+var ErrInPlaceJournalExists = errors.New("journal of interrupted update exists")
+
+type inPlaceOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Tmp  string `json:"tmp,omitempty"`
+	Link string `json:"link,omitempty"`
+	// existing entry at Path is removed before rename
+	Replace bool `json:"replace,omitempty"`
+	// for INPLACE_OP_ATTR
+	Mode uint32 `json:"mode,omitempty"`
+	UID  uint32 `json:"uid,omitempty"`
+	GID  uint32 `json:"gid,omitempty"`
+}
+
+type inPlaceJournal struct {
+	State string      `json:"state"`
+	Ops   []inPlaceOp `json:"ops"`
+}
+
+type inPlacePlan struct {
+	ops []inPlaceOp
+	// temporary entries left by interrupted updates without journal
+	stale []string
+	// directories and symlinks created in order
+	stages []patchTask
+	files  []patchTask
+}
+
+// ApplyPatchInPlace applies dirEntry in img to dirPath in place.
+func ApplyPatchInPlace(ctx context.Context, dirPath string, dirEntry *FileEntry, img *DimgFile, pm *bsdiffx.PluginManager, pc PatchConfig) error {
+	journalPath := filepath.Join(dirPath, INPLACE_JOURNAL_NAME)
+	_, err := os.Lstat(journalPath)
+	if err == nil {
+		return ErrInPlaceJournalExists
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !dirEntry.IsDir() {
+		return fmt.Errorf("root entry %q is not directory", dirEntry.Name)
+	}
+
+	pt := newProgressTracker(pc.Progress, "patch")
+	journal, err := prepareInPlace(ctx, dirPath, dirEntry, img, pm, pc, pt)
+	if err != nil {
+		return err
+	}
+
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
+	err = commitInPlace(dirPath, journal)
+	if err != nil {
+		return err
+	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
+
+	return nil
+}
+
+// prepareInPlace stages changed entries and returns the journal in INPLACE_STATE_PREPARE.
+// Staged entries are rolled back on failure.
+func prepareInPlace(ctx context.Context, dirPath string, dirEntry *FileEntry, img *DimgFile, pm *bsdiffx.PluginManager, pc PatchConfig, pt *progressTracker) (*inPlaceJournal, error) {
+	journalPath := filepath.Join(dirPath, INPLACE_JOURNAL_NAME)
+	pt.SetPhase(PROGRESS_PHASE_SCAN)
+	plan := &inPlacePlan{}
+	rootInfo, err := os.Lstat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	planAttrInPlace(rootInfo, dirEntry, ".", plan)
+	err = planInPlace(dirPath, dirEntry, ".", plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan: %v", err)
+	}
+	pt.AddTotal(int64(len(plan.files)))
+
+	journal := &inPlaceJournal{
+		State: INPLACE_STATE_PREPARE,
+		Ops:   plan.ops,
+	}
+	err = writeInPlaceJournal(journalPath, journal)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stageInPlace(ctx, dirPath, plan, img, pm, max(1, pc.ThreadNum), pt)
+	if err != nil {
+		rbErr := rollbackInPlace(dirPath, journal)
+		if rbErr != nil {
+			return nil, fmt.Errorf("failed to stage: %v (rollback failed: %v)", err, rbErr)
+		}
+		return nil, fmt.Errorf("failed to stage: %v", err)
+	}
+
+	return journal, nil
+}
+
+// commitInPlace commits the journal and applies it.
+// After the commit, the update is completed by RecoverPatchInPlace even if interrupted.
+func commitInPlace(dirPath string, journal *inPlaceJournal) error {
+	journal.State = INPLACE_STATE_COMMIT
+	err := writeInPlaceJournal(filepath.Join(dirPath, INPLACE_JOURNAL_NAME), journal)
+	if err != nil {
+		return err
+	}
+	err = rollForwardInPlace(dirPath, journal)
+	if err != nil {
+		return fmt.Errorf("failed to apply journal: %v", err)
+	}
+	return nil
+}
+
+// RecoverPatchInPlace completes or reverts the interrupted update in dirPath.
+// It returns true if the update is rolled forward.
+func RecoverPatchInPlace(dirPath string) (bool, error) {
+	journalPath := filepath.Join(dirPath, INPLACE_JOURNAL_NAME)
+	journalBytes, err := os.ReadFile(journalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var journal inPlaceJournal
+	err = json.Unmarshal(journalBytes, &journal)
+	if err != nil {
+		// journal is written atomically, so it is never partially written
+		return false, fmt.Errorf("failed to unmarshal journal: %v", err)
+	}
+
+	switch journal.State {
+	case INPLACE_STATE_PREPARE:
+		logger.Infof("rolling back interrupted update in %s", dirPath)
+		return false, rollbackInPlace(dirPath, &journal)
+	case INPLACE_STATE_COMMIT:
+		logger.Infof("rolling forward interrupted update in %s", dirPath)
+		return true, rollForwardInPlace(dirPath, &journal)
+	default:
+		return false, fmt.Errorf("unknown journal state %q", journal.State)
+	}
+}
+
+func planInPlace(rootPath string, dirEntry *FileEntry, dirPath string, plan *inPlacePlan) error {
+	diskEntries, err := os.ReadDir(filepath.Join(rootPath, dirPath))
+	if err != nil {
+		return err
+	}
+	for _, de := range diskEntries {
+		if dirPath == "." && de.Name() == INPLACE_JOURNAL_NAME {
+			continue
+		}
+		_, isChild := dirEntry.Childs[de.Name()]
+		if !isChild && strings.HasPrefix(de.Name(), INPLACE_TMP_PREFIX) {
+			plan.stale = append(plan.stale, path.Join(dirPath, de.Name()))
+			continue
+		}
+		if !isChild {
+			plan.ops = append(plan.ops, inPlaceOp{
+				Op:   INPLACE_OP_REMOVE,
+				Path: path.Join(dirPath, de.Name()),
+			})
+		}
+	}
+
+	for _, name := range sortedChildNames(dirEntry) {
+		entry := dirEntry.Childs[name]
+		entryPath := path.Join(dirPath, name)
+		tmpPath := path.Join(dirPath, INPLACE_TMP_PREFIX+name)
+		fi, err := os.Lstat(filepath.Join(rootPath, entryPath))
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		switch entry.Type {
+		case FILE_ENTRY_DIR:
+			if !exists || !fi.IsDir() {
+				return fmt.Errorf("base directory %s not found", entryPath)
+			}
+			err = entry.Verify(nil)
+			if err != nil {
+				return fmt.Errorf("failed to verify %s(%d, %d): %v", entryPath, entry.Type, entry.Size, err)
+			}
+			planAttrInPlace(fi, entry, entryPath, plan)
+			err = planInPlace(rootPath, entry, entryPath, plan)
+			if err != nil {
+				return err
+			}
+		case FILE_ENTRY_FILE_SAME:
+			if !exists || !fi.Mode().IsRegular() {
+				return fmt.Errorf("base file %s not found", entryPath)
+			}
+			planAttrInPlace(fi, entry, entryPath, plan)
+		case FILE_ENTRY_FILE_DIFF:
+			if !exists || !fi.Mode().IsRegular() {
+				return fmt.Errorf("base file %s not found", entryPath)
+			}
+			plan.files = append(plan.files, patchTask{entry: entry, basePath: entryPath, newPath: tmpPath, setAttrs: true})
+			plan.ops = append(plan.ops, inPlaceOp{Op: INPLACE_OP_RENAME, Path: entryPath, Tmp: tmpPath})
+		case FILE_ENTRY_HARDLINK:
+			plan.ops = append(plan.ops, inPlaceOp{
+				Op:   INPLACE_OP_LINK,
+				Path: entryPath,
+				Link: strings.TrimPrefix(entry.RealPath, "/"),
+			})
+		case FILE_ENTRY_FILE_NEW, FILE_ENTRY_SYMLINK, FILE_ENTRY_DIR_NEW:
+			plan.ops = append(plan.ops, inPlaceOp{
+				Op:   INPLACE_OP_RENAME,
+				Path: entryPath,
+				Tmp:  tmpPath,
+				// rename(2) cannot replace directories and cannot replace files with directories
+				Replace: exists && (fi.IsDir() || entry.IsDir()),
+			})
+			err = planNewInPlace(entry, entryPath, tmpPath, plan)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected error type=%v", entry.Type)
+		}
+	}
+
+	return nil
+}
+
+// planAttrInPlace updates mode and ownership of the existing entry if they are changed
+func planAttrInPlace(fi fs.FileInfo, entry *FileEntry, entryPath string, plan *inPlacePlan) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && stat.Mode&07777 == unixMode(entry.Mode) && stat.Uid == entry.UID && stat.Gid == entry.GID {
+		return
+	}
+	plan.ops = append(plan.ops, inPlaceOp{
+		Op:   INPLACE_OP_ATTR,
+		Path: entryPath,
+		Mode: entry.Mode,
+		UID:  entry.UID,
+		GID:  entry.GID,
+	})
+}
+
+// planNewInPlace stages entry at stagePath. entry must not depend on the base.
+func planNewInPlace(entry *FileEntry, entryPath, stagePath string, plan *inPlacePlan) error {
+	if entry.IsBaseRequired() {
+		return fmt.Errorf("invalid base image %q", entryPath)
+	}
+
+	switch entry.Type {
+	case FILE_ENTRY_FILE_NEW:
+		plan.files = append(plan.files, patchTask{entry: entry, newPath: stagePath, setAttrs: true})
+	case FILE_ENTRY_SYMLINK:
+		plan.stages = append(plan.stages, patchTask{entry: entry, newPath: stagePath})
+	case FILE_ENTRY_HARDLINK:
+		plan.ops = append(plan.ops, inPlaceOp{
+			Op:   INPLACE_OP_LINK,
+			Path: entryPath,
+			Link: strings.TrimPrefix(entry.RealPath, "/"),
+		})
+	case FILE_ENTRY_DIR, FILE_ENTRY_DIR_NEW:
+		err := entry.Verify(nil)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s(%d, %d): %v", entryPath, entry.Type, entry.Size, err)
+		}
+		plan.stages = append(plan.stages, patchTask{entry: entry, newPath: stagePath})
+		for _, name := range sortedChildNames(entry) {
+			err := planNewInPlace(entry.Childs[name], path.Join(entryPath, name), path.Join(stagePath, name), plan)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected error type=%v", entry.Type)
+	}
+
+	return nil
+}
+
+func stageInPlace(ctx context.Context, rootPath string, plan *inPlacePlan, img *DimgFile, pm *bsdiffx.PluginManager, threadNum int, pt *progressTracker) error {
+	rootFd, err := unix.Open(rootPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", rootPath, err)
+	}
+	defer unix.Close(rootFd)
+
+	for _, stale := range plan.stale {
+		err = os.RemoveAll(filepath.Join(rootPath, stale))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, st := range plan.stages {
+		if st.entry.IsDir() {
+			err = unix.Mkdirat(rootFd, st.newPath, uint32(os.ModePerm))
+		} else {
+			err = unix.Symlinkat(st.entry.RealPath, rootFd, st.newPath)
+			if err == nil {
+				err = unix.Fchownat(rootFd, st.newPath, int(st.entry.UID), int(st.entry.GID), unix.AT_SYMLINK_NOFOLLOW)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", st.newPath, err)
+		}
+	}
+
+	enqueue := func(ctx context.Context, taskChan chan patchTask) error {
+		for _, task := range plan.files {
+			err := sendTask(ctx, taskChan, task)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pt.SetPhase(PROGRESS_PHASE_PROCESS)
+	err = applyPatchMultithread(ctx, enqueue, func(task patchTask) error {
+		return processPatchTask(rootFd, rootFd, task, img, pm)
+	}, threadNum, pt)
+	if err != nil {
+		return err
+	}
+
+	// directories can be read-only, so their modes are applied after their children are staged
+	for i := len(plan.stages) - 1; i >= 0; i-- {
+		st := plan.stages[i]
+		if !st.entry.IsDir() {
+			continue
+		}
+		err = setAttrsAt(rootFd, st.newPath, st.entry.Mode, st.entry.UID, st.entry.GID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// staged entries must be persisted before the commit
+	return unix.Syncfs(rootFd)
+}
+
+func rollbackInPlace(rootPath string, journal *inPlaceJournal) error {
+	for _, op := range journal.Ops {
+		if op.Op != INPLACE_OP_RENAME {
+			continue
+		}
+		err := os.RemoveAll(filepath.Join(rootPath, op.Tmp))
+		if err != nil {
+			return err
+		}
+	}
+
+	return removeInPlaceJournal(rootPath)
+}
+
+// setAttrsAt applies mode and ownership to the directory or the regular file at name
+func setAttrsAt(dirFd int, name string, mode, uid, gid uint32) error {
+	// chown(2) clears setuid and setgid bits, so chmod is applied after it
+	err := unix.Fchownat(dirFd, name, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("failed to chown %s: %v", name, err)
+	}
+	err = unix.Fchmodat(dirFd, name, unixMode(mode), 0)
+	if err != nil {
+		return fmt.Errorf("failed to chmod %s: %v", name, err)
+	}
+	return nil
+}
+
+// rollForwardInPlace applies operations in journal.
+// Every operation can be applied again after the interruption.
+func rollForwardInPlace(rootPath string, journal *inPlaceJournal) error {
+	for _, op := range journal.Ops {
+		if op.Op != INPLACE_OP_REMOVE {
+			continue
+		}
+		err := os.RemoveAll(filepath.Join(rootPath, op.Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, op := range journal.Ops {
+		if op.Op != INPLACE_OP_RENAME {
+			continue
+		}
+		tmpPath := filepath.Join(rootPath, op.Tmp)
+		_, err := os.Lstat(tmpPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// already renamed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		newPath := filepath.Join(rootPath, op.Path)
+		if op.Replace {
+			err = os.RemoveAll(newPath)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Rename(tmpPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, op := range journal.Ops {
+		if op.Op != INPLACE_OP_LINK {
+			continue
+		}
+		newPath := filepath.Join(rootPath, op.Path)
+		err := os.RemoveAll(newPath)
+		if err != nil {
+			return err
+		}
+		err = os.Link(filepath.Join(rootPath, op.Link), newPath)
+		if err != nil {
+			return fmt.Errorf("failed to create hardlink from %s to %s: %v", op.Path, op.Link, err)
+		}
+	}
+
+	for _, op := range journal.Ops {
+		if op.Op != INPLACE_OP_ATTR {
+			continue
+		}
+		err := setAttrsAt(unix.AT_FDCWD, filepath.Join(rootPath, op.Path), op.Mode, op.UID, op.GID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// applied operations must be persisted before the journal is removed
+	root, err := os.Open(rootPath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	err = unix.Syncfs(int(root.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %v", rootPath, err)
+	}
+
+	return removeInPlaceJournal(rootPath)
+}
+
+func writeInPlaceJournal(journalPath string, journal *inPlaceJournal) error {
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %v", err)
+	}
+
+	tmpPath := journalPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(journalBytes)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, journalPath)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(journalPath))
+}
+
+func removeInPlaceJournal(rootPath string) error {
+	err := os.Remove(filepath.Join(rootPath, INPLACE_JOURNAL_NAME))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return syncDir(rootPath)
+}
+
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,141 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var inPlaceOldFiles = map[string]testFile{
+	"bin":      {mode: os.ModeDir | 0755},
+	"bin/foo":  {body: "foo v1", mode: 0755},
+	"bin/keep": {body: "keep", mode: 0755},
+	"etc":      {mode: os.ModeDir | 0755},
+	"etc/conf": {body: "conf", mode: 0644},
+	"etc/gone": {body: "gone", mode: 0644},
+	"d":        {mode: os.ModeDir | 0755},
+	"d/f":      {body: "f", mode: 0644},
+	"link":     {body: "bin/foo", mode: os.ModeSymlink},
+}
+
+var inPlaceNewFiles = map[string]testFile{
+	"bin":      {mode: os.ModeDir | 0755},
+	"bin/foo":  {body: "foo v2", mode: 0755},
+	"bin/su":   {body: "su", mode: os.ModeSetuid | 0755},
+	"bin/keep": {body: "keep", mode: 0755},
+	"etc":      {mode: os.ModeDir | 0755},
+	"etc/conf": {body: "conf", mode: 0600},
+	"d":        {mode: os.ModeDir | 0700},
+	"d/f":      {body: "f", mode: 0644},
+	"n":        {mode: os.ModeDir | 0750},
+	"n/x":      {body: "x", mode: 0640},
+	"n/ro":     {mode: os.ModeDir | 0555},
+	"n/ro/y":   {body: "y", mode: 0444},
+	"link":     {body: "bin/su", mode: os.ModeSymlink},
+}
+
+// prepareInPlaceTest returns the base directory, the expected directory and the diff dimg
+func prepareInPlaceTest(t *testing.T) (string, string, *DimgFile) {
+	oldDir := writeTestDir(t, inPlaceOldFiles)
+	newDir := writeTestDir(t, inPlaceNewFiles)
+	if os.Geteuid() == 0 {
+		// ownership is updated for new files and existing files
+		assert.Equal(t, nil, os.Lchown(filepath.Join(newDir, "n/x"), 1234, 1234))
+		assert.Equal(t, nil, os.Lchown(filepath.Join(oldDir, "etc/conf"), 1234, 1234))
+	}
+	diffPath := diffTestDimg(t, packTestDir(t, oldDir), packTestDir(t, newDir))
+
+	img, err := OpenDimgFile(diffPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return oldDir, newDir, img
+}
+
+func TestApplyPatchInPlace(t *testing.T) {
+	baseDir, newDir, img := prepareInPlaceTest(t)
+
+	err := ApplyPatchInPlace(context.Background(), baseDir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4})
+	assert.Equal(t, nil, err)
+	assertSameTree(t, newDir, baseDir)
+}
+
+func TestRecoverPatchInPlaceRollback(t *testing.T) {
+	baseDir, _, img := prepareInPlaceTest(t)
+	expectedDir := writeTestDir(t, inPlaceOldFiles)
+	if os.Geteuid() == 0 {
+		assert.Equal(t, nil, os.Lchown(filepath.Join(expectedDir, "etc/conf"), 1234, 1234))
+	}
+
+	// interrupted before the commit
+	_, err := prepareInPlace(context.Background(), baseDir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4}, newProgressTracker(nil, "patch"))
+	assert.Equal(t, nil, err)
+	staged, err := filepath.Glob(filepath.Join(baseDir, "*", INPLACE_TMP_PREFIX+"*"))
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, 0, len(staged))
+
+	err = ApplyPatchInPlace(context.Background(), baseDir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4})
+	assert.Equal(t, ErrInPlaceJournalExists, err)
+
+	rolledForward, err := RecoverPatchInPlace(baseDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, rolledForward)
+	assertSameTree(t, expectedDir, baseDir)
+}
+
+func TestRecoverPatchInPlaceRollForward(t *testing.T) {
+	baseDir, newDir, img := prepareInPlaceTest(t)
+
+	journal, err := prepareInPlace(context.Background(), baseDir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4}, newProgressTracker(nil, "patch"))
+	assert.Equal(t, nil, err)
+
+	// interrupted in the middle of applying the committed journal
+	journal.State = INPLACE_STATE_COMMIT
+	renames := []inPlaceOp{}
+	for _, op := range journal.Ops {
+		if op.Op == INPLACE_OP_RENAME {
+			renames = append(renames, op)
+		}
+	}
+	assert.Less(t, 1, len(renames))
+	err = rollForwardInPlace(baseDir, &inPlaceJournal{State: INPLACE_STATE_COMMIT, Ops: renames[:len(renames)/2]})
+	assert.Equal(t, nil, err)
+	err = writeInPlaceJournal(filepath.Join(baseDir, INPLACE_JOURNAL_NAME), journal)
+	assert.Equal(t, nil, err)
+
+	rolledForward, err := RecoverPatchInPlace(baseDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, rolledForward)
+	assertSameTree(t, newDir, baseDir)
+
+	// recovery without journal does nothing
+	rolledForward, err = RecoverPatchInPlace(baseDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, rolledForward)
+	_, err = os.Lstat(filepath.Join(baseDir, INPLACE_JOURNAL_NAME))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestApplyPatchInPlaceTmpPrefixChild(t *testing.T) {
+	oldDir := writeTestDir(t, map[string]testFile{
+		INPLACE_TMP_PREFIX + "real": {body: "real", mode: 0644},
+		"a":                         {body: "a v1", mode: 0644},
+	})
+	newDir := writeTestDir(t, map[string]testFile{
+		INPLACE_TMP_PREFIX + "real": {body: "real", mode: 0644},
+		"a":                         {body: "a v2", mode: 0644},
+	})
+	img, err := OpenDimgFile(diffTestDimg(t, packTestDir(t, oldDir), packTestDir(t, newDir)))
+	assert.Equal(t, nil, err)
+	defer img.Close()
+
+	// files with the prefix are removed as stale only if they are not in the image
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(oldDir, INPLACE_TMP_PREFIX+"stale"), []byte("stale"), 0644))
+	err = ApplyPatchInPlace(context.Background(), oldDir, &img.DimgHeader().FileEntry, img, testPluginManager(t), PatchConfig{ThreadNum: 4})
+	assert.Equal(t, nil, err)
+	assertSameTree(t, newDir, oldDir)
+}
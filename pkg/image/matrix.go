@@ -0,0 +1,140 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+type DiffMatrixEntry struct {
+	ParentId digest.Digest `json:"parentID"`
+	Id       digest.Digest `json:"id"`
+	Size     int64         `json:"size"`
+	Path     string        `json:"path"`
+}
+
+// DiffMatrixManifest lists the base image and deltas generated by GenerateDiffMatrixFromCdimg.
+// The base image comes first with empty ParentId and deltas are ordered so that parents are pushed before children.
+type DiffMatrixManifest struct {
+	Deltas []DiffMatrixEntry `json:"deltas"`
+}
+
+func LoadDiffMatrixManifest(path string) (*DiffMatrixManifest, error) {
+	manifestBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest DiffMatrixManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %v", err)
+	}
+
+	return &manifest, nil
+}
+
+func (m *DiffMatrixManifest) Write(path string) error {
+	manifestBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+
+	return os.WriteFile(path, manifestBytes, 0644)
+}
+
+// GenerateDiffMatrixFromCdimg generates deltas from each of previous 'window' images to every image.
+// cdimgPaths must be ordered from the oldest to the newest.
+// Deltas to the same image are generated concurrently up to dc.ThreadNum.
+// Decompressed bodies are kept up to dc.BodyCacheQuota bytes while images are in the window and shared among the deltas.
+func GenerateDiffMatrixFromCdimg(ctx context.Context, cdimgPaths []string, window int, outDir string, isBinaryDiff bool, dc DiffConfig, pm *bsdiffx.PluginManager) (*DiffMatrixManifest, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid window: %d", window)
+	}
+	err := dc.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]digest.Digest, len(cdimgPaths))
+	for i, p := range cdimgPaths {
+		cdimg, err := OpenCdimgFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", p, err)
+		}
+		ids[i] = cdimg.DimgHeader().Id
+		cdimg.Close()
+	}
+
+	if dc.BodyCacheQuota > 0 {
+		dc.bodyCache = newBodyCache(dc.BodyCacheQuota)
+	}
+	basePath, err := filepath.Abs(cdimgPaths[0])
+	if err != nil {
+		return nil, err
+	}
+	baseStat, err := os.Stat(basePath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &DiffMatrixManifest{
+		Deltas: []DiffMatrixEntry{
+			{
+				ParentId: "",
+				Id:       ids[0],
+				Size:     baseStat.Size(),
+				Path:     basePath,
+			},
+		},
+	}
+	for newIdx := 1; newIdx < len(cdimgPaths); newIdx++ {
+		firstIdx := max(0, newIdx-window)
+		deltas := make([]DiffMatrixEntry, newIdx-firstIdx)
+		eg, egCtx := errgroup.WithContext(ctx)
+		eg.SetLimit(dc.ThreadNum)
+		for oldIdx := firstIdx; oldIdx < newIdx; oldIdx++ {
+			oldIdx := oldIdx
+			eg.Go(func() error {
+				outPath, err := filepath.Abs(filepath.Join(outDir, fmt.Sprintf("diff_%d-%d.cdimg", oldIdx, newIdx)))
+				if err != nil {
+					return err
+				}
+				logger.Infof("generating diff from %s to %s", cdimgPaths[oldIdx], cdimgPaths[newIdx])
+				err = GenerateDiffFromCdimg(egCtx, cdimgPaths[oldIdx], cdimgPaths[newIdx], outPath, isBinaryDiff, dc, pm)
+				if err != nil {
+					return fmt.Errorf("failed to generate diff from %s to %s: %v", cdimgPaths[oldIdx], cdimgPaths[newIdx], err)
+				}
+
+				stat, err := os.Stat(outPath)
+				if err != nil {
+					return err
+				}
+				deltas[oldIdx-firstIdx] = DiffMatrixEntry{
+					ParentId: ids[oldIdx],
+					Id:       ids[newIdx],
+					Size:     stat.Size(),
+					Path:     outPath,
+				}
+				return nil
+			})
+		}
+		err = eg.Wait()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Deltas = append(manifest.Deltas, deltas...)
+
+		// the image is not used as an old image anymore
+		if evictIdx := newIdx - window; evictIdx >= 0 {
+			dc.bodyCache.evict(ids[evictIdx])
+		}
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func packTestCdimg(t *testing.T, files map[string]testFile) string {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configPath, []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "image.cdimg")
+	err = PackCdimg(configPath, packTestDir(t, writeTestDir(t, files)), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestGenerateDiffMatrixFromCdimg(t *testing.T) {
+	cdimgs := []string{}
+	for v := 0; v < 4; v++ {
+		cdimgs = append(cdimgs, packTestCdimg(t, map[string]testFile{
+			"version": {body: fmt.Sprintf("v%d", v), mode: 0644},
+			"common":  {body: "common", mode: 0644},
+		}))
+	}
+	dc := DiffConfig{
+		ThreadNum:      2,
+		ScheduleMode:   DIFF_MULTI_SCHED_NONE,
+		BodyCacheQuota: 1024 * 1024,
+	}
+	manifest, err := GenerateDiffMatrixFromCdimg(context.Background(), cdimgs, 2, t.TempDir(), false, dc, testPluginManager(t))
+	assert.Equal(t, nil, err)
+
+	// the base image comes first and deltas are ordered by the new image
+	pairs := []string{}
+	for _, d := range manifest.Deltas {
+		cdimg, err := OpenCdimgFile(d.Path)
+		if !assert.Equal(t, nil, err) {
+			continue
+		}
+		assert.Equal(t, d.ParentId, cdimg.DimgHeader().ParentId)
+		assert.Equal(t, d.Id, cdimg.DimgHeader().Id)
+		cdimg.Close()
+		pairs = append(pairs, filepath.Base(d.Path))
+	}
+	assert.Equal(t, []string{"image.cdimg", "diff_0-1.cdimg", "diff_0-2.cdimg", "diff_1-2.cdimg", "diff_1-3.cdimg", "diff_2-3.cdimg"}, pairs)
+	assert.Equal(t, cdimgs[0], manifest.Deltas[0].Path)
+	assert.Equal(t, "", string(manifest.Deltas[0].ParentId))
+
+	dc.ThreadNum = 0
+	_, err = GenerateDiffMatrixFromCdimg(context.Background(), cdimgs, 2, t.TempDir(), false, dc, testPluginManager(t))
+	assert.NotEqual(t, nil, err)
+}
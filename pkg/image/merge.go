@@ -25,22 +25,30 @@ type mergeTask struct {
 	data       []byte
 }
 
-func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *bytes.Buffer, mc MergeConfig, pm *bsdiffx.PluginManager) (*FileEntry, error) {
+func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *bytes.Buffer, mc MergeConfig, pm *bsdiffx.PluginManager, pt *progressTracker) (*FileEntry, error) {
 	lowerEntry := &lowerImgFile.DimgHeader().FileEntry
 	upperEntry := &upperImgFile.DimgHeader().FileEntry
 
 	mergeTasks := make(chan mergeTask, 1000)
 	writeTasks := make(chan mergeTask, 1000)
 	wg := sync.WaitGroup{}
+	spool, err := os.CreateTemp("", "*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	written := map[*FileEntry]struct{}{}
 
 	var gErr error
 	ctx, cancel := context.WithCancel(context.Background())
 
+	pt.SetPhase(PROGRESS_PHASE_SCAN)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		logger.Info("started merge task enqueue thread")
-		err := enqueueMergeTaskToQueue(lowerEntry, upperEntry, mergeTasks)
+		err := enqueueMergeTaskToQueue(lowerEntry, upperEntry, mergeTasks, pt)
 		if err != nil {
 			gErr = fmt.Errorf("failed to enqueue: %v", err)
 			cancel()
@@ -48,12 +56,14 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 		}
 		close(mergeTasks)
 		logger.Info("finished mege task enqueue thread")
+		pt.SetPhase(PROGRESS_PHASE_PROCESS)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		logger.Info("started merge write thread")
+		offset := int64(0)
 		cont := true
 		for cont {
 			select {
@@ -65,14 +75,17 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 					cont = false
 					break
 				}
-				mt.upperEntry.Offset = int64(mergeOut.Len())
-				_, err := mergeOut.Write(mt.data)
+				mt.upperEntry.Offset = offset
+				_, err := spool.Write(mt.data)
+				written[mt.upperEntry] = struct{}{}
 				if err != nil {
-					gErr = fmt.Errorf("failed to write to mergeOut: %v", err)
+					gErr = fmt.Errorf("failed to write to spool: %v", err)
 					cancel()
 					logger.Errorf("merge write thread: %v", gErr)
 					return
 				}
+				offset += int64(len(mt.data))
+				pt.FileDone(mt.upperEntry.Name, int64(mt.upperEntry.Size), int64(len(mt.data)))
 			}
 		}
 		logger.Info("finished merge write thread")
@@ -101,6 +114,12 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 					mode := ""
 					if mt.lowerEntry != nil && mt.upperEntry != nil {
 						p := pm.GetPluginByUuid(mt.upperEntry.PluginUuid)
+						if p == nil {
+							gErr = fmt.Errorf("plugin for %s not found", mt.upperEntry.PluginUuid)
+							cancel()
+							logger.Errorf("merge thread: %v", gErr)
+							return
+						}
 						if mt.lowerEntry.Type == FILE_ENTRY_FILE_NEW && mt.upperEntry.Type == FILE_ENTRY_FILE_DIFF {
 							lowerBytes := make([]byte, mt.lowerEntry.CompressedSize)
 							upperBytes := make([]byte, mt.upperEntry.CompressedSize)
@@ -134,7 +153,7 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 								return
 							}
 
-							mergeCompressed, err := CompressWithZstd(mergeBytes)
+							mergeCompressed, frames, err := compressSeekableBytes(mergeBytes)
 							if err != nil {
 								gErr = fmt.Errorf("failed to compresse merged bytes: %v", err)
 								cancel()
@@ -143,12 +162,10 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 							}
 							mt.upperEntry.Type = FILE_ENTRY_FILE_NEW
 							mt.upperEntry.CompressedSize = int64(len(mergeCompressed))
+							mt.upperEntry.Frames = frames
 							mt.data = mergeCompressed
 							mode = "apply"
 						} else if mt.lowerEntry.Type == FILE_ENTRY_FILE_DIFF && mt.upperEntry.Type == FILE_ENTRY_FILE_DIFF {
-							if mt.lowerEntry.PluginUuid != mt.upperEntry.PluginUuid {
-								panic(fmt.Sprintf("unmatched plugin lower %s upper %s", mt.lowerEntry.PluginUuid, mt.upperEntry.PluginUuid))
-							}
 							lowerBytes := make([]byte, mt.lowerEntry.CompressedSize)
 							upperBytes := make([]byte, mt.upperEntry.CompressedSize)
 							_, err := lowerImgFile.ReadAt(lowerBytes, mt.lowerEntry.Offset)
@@ -166,7 +183,15 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 								return
 							}
 							mergeBytes := bytes.NewBuffer(nil)
-							err = p.Merge(bytes.NewBuffer(lowerBytes), bytes.NewBuffer(upperBytes), mergeBytes)
+							if mt.lowerEntry.PluginUuid == mt.upperEntry.PluginUuid {
+								err = p.Merge(bytes.NewBuffer(lowerBytes), bytes.NewBuffer(upperBytes), mergeBytes)
+							} else {
+								// diffs generated by different plugins are kept as a chain
+								var composed []byte
+								composed, err = pm.ComposePatches(mt.lowerEntry.PluginUuid, lowerBytes, mt.upperEntry.PluginUuid, upperBytes)
+								mergeBytes.Write(composed)
+								mt.upperEntry.PluginUuid = bsdiffx.ChainPluginUuid
+							}
 							if err != nil {
 								gErr = fmt.Errorf("failed to merge diffs: %v", err)
 								cancel()
@@ -219,7 +244,10 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 						}
 						err := mc.Benchmarker.AppendResult(metric)
 						if err != nil {
-							panic(err)
+							gErr = fmt.Errorf("failed to append benchmark result: %v", err)
+							cancel()
+							logger.Errorf("merge thread: %v", gErr)
+							return
 						}
 					}
 					writeTasks <- mt
@@ -236,29 +264,45 @@ func mergeDiffDimgMultihread(lowerImgFile, upperImgFile *DimgFile, mergeOut *byt
 	}()
 	wg.Wait()
 
+	if gErr == nil && mc.FullImages != nil {
+		logger.Info("started to verify merged diffs")
+		err := verifyMergedDiffs(lowerImgFile, upperImgFile, upperEntry, written, spool, mc, pm)
+		if err != nil {
+			gErr = fmt.Errorf("failed to verify merged diffs: %v", err)
+		}
+		logger.Info("finished to verify merged diffs")
+	}
+
 	logger.Info("started to update dir entry")
 	updateDirFileEntry(upperEntry)
 	logger.Info("finished to update dir entry")
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 
 	if gErr != nil {
 		return nil, gErr
 	}
+
+	err = canonicalizeBody(upperEntry, written, spool, mergeOut, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to mergeOut: %v", err)
+	}
 	return upperEntry, nil
 }
 
 // upperEntry is updated to merged FileEntry
-func enqueueMergeTaskToQueue(lowerEntry, upperEntry *FileEntry, taskChan chan mergeTask) error {
-	for upperfName := range upperEntry.Childs {
+func enqueueMergeTaskToQueue(lowerEntry, upperEntry *FileEntry, taskChan chan mergeTask, pt *progressTracker) error {
+	for _, upperfName := range sortedChildNames(upperEntry) {
 		upperChild := upperEntry.Childs[upperfName]
 		switch upperChild.Type {
 		case FILE_ENTRY_DIR_NEW, FILE_ENTRY_FILE_NEW, FILE_ENTRY_SYMLINK, FILE_ENTRY_HARDLINK:
 			log.Debugf("upperChild is new")
 			if upperChild.IsDir() {
-				err := enqueueMergeTaskToQueue(nil, upperChild, taskChan)
+				err := enqueueMergeTaskToQueue(nil, upperChild, taskChan, pt)
 				if err != nil {
 					return err
 				}
 			} else if upperChild.HasBody() {
+				pt.AddTotal(1)
 				taskChan <- mergeTask{
 					lowerEntry: nil,
 					upperEntry: upperChild,
@@ -282,7 +326,7 @@ func enqueueMergeTaskToQueue(lowerEntry, upperEntry *FileEntry, taskChan chan me
 			switch upperChild.Type {
 			case FILE_ENTRY_DIR:
 				if lowerChild.IsDir() {
-					err := enqueueMergeTaskToQueue(lowerChild, upperChild, taskChan)
+					err := enqueueMergeTaskToQueue(lowerChild, upperChild, taskChan, pt)
 					if err != nil {
 						return err
 					}
@@ -298,6 +342,7 @@ func enqueueMergeTaskToQueue(lowerEntry, upperEntry *FileEntry, taskChan chan me
 					lowerChild.GID = upperChild.GID
 					lowerChild.Digest = upperChild.Digest
 					upperEntry.Childs[upperfName] = lowerChild
+					pt.AddTotal(1)
 					taskChan <- mergeTask{
 						lowerEntry: lowerChild,
 						upperEntry: nil,
@@ -309,11 +354,13 @@ func enqueueMergeTaskToQueue(lowerEntry, upperEntry *FileEntry, taskChan chan me
 				}
 			case FILE_ENTRY_FILE_DIFF:
 				if lowerChild.Type == FILE_ENTRY_FILE_SAME {
+					pt.AddTotal(1)
 					taskChan <- mergeTask{
 						lowerEntry: nil,
 						upperEntry: upperChild,
 					}
 				} else if lowerChild.HasBody() {
+					pt.AddTotal(1)
 					taskChan <- mergeTask{
 						lowerEntry: lowerChild,
 						upperEntry: upperChild,
@@ -333,23 +380,29 @@ type MergeConfig struct {
 	MergeDimgConcurrentNum int
 	BenchmarkPerFile       bool
 	Benchmarker            *benchmark.Benchmark
+	Progress               ProgressReporter
+
+	// If FullImages is set, merged diffs are verified against the full images
+	// and re-diffed from them when verification fails.
+	FullImages FullImageResolver
 }
 
 func MergeDimg(lowerDimg, upperDimg string, merged io.Writer, mc MergeConfig, pm *bsdiffx.PluginManager) (*DimgHeader, error) {
 	lowerImgFile, err := OpenDimgFile(lowerDimg)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to open %s: %v", lowerDimg, err)
 	}
 	defer lowerImgFile.Close()
 	upperImgFile, err := OpenDimgFile(upperDimg)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to open %s: %v", upperDimg, err)
 	}
 	defer upperImgFile.Close()
 	tmp := bytes.Buffer{}
-	mergedEntry, err := mergeDiffDimgMultihread(lowerImgFile, upperImgFile, &tmp, mc, pm)
+	pt := newProgressTracker(mc.Progress, "merge")
+	mergedEntry, err := mergeDiffDimgMultihread(lowerImgFile, upperImgFile, &tmp, mc, pm, pt)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to merge: %v", err)
 	}
 
 	header := DimgHeader{
@@ -363,28 +416,30 @@ func MergeDimg(lowerDimg, upperDimg string, merged io.Writer, mc MergeConfig, pm
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to dimg: %v", err)
 	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
 	return &header, nil
 }
 
 func MergeCdimg(lowerCdimg, upperCdimg string, merged io.Writer, mc MergeConfig, pm *bsdiffx.PluginManager) (*DimgHeader, error) {
 	lowerCdimgFile, err := OpenCdimgFile(lowerCdimg)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to open %s: %v", lowerCdimg, err)
 	}
 	defer lowerCdimgFile.Close()
 	lowerDimg := lowerCdimgFile.Dimg
 
 	upperCdimgFile, err := OpenCdimgFile(upperCdimg)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to open %s: %v", upperCdimg, err)
 	}
 	defer upperCdimgFile.Close()
 	upperDimg := upperCdimgFile.Dimg
 
 	tmp := bytes.Buffer{}
-	mergedEntry, err := mergeDiffDimgMultihread(lowerDimg, upperDimg, &tmp, mc, pm)
+	pt := newProgressTracker(mc.Progress, "merge")
+	mergedEntry, err := mergeDiffDimgMultihread(lowerDimg, upperDimg, &tmp, mc, pm, pt)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to merge: %v", err)
 	}
 
 	header := DimgHeader{
@@ -408,6 +463,7 @@ func MergeCdimg(lowerCdimg, upperCdimg string, merged io.Writer, mc MergeConfig,
 	if err != nil {
 		return nil, fmt.Errorf("failed to write dimg: %v", err)
 	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
 	return &header, nil
 }
 
@@ -520,6 +576,7 @@ func runMergeDimgTask(task *mergeDimgTask, tmpDir string, threadLimit chan struc
 
 	threadLimit <- struct{}{}
 	go func() {
+		defer func() { <-threadLimit }()
 		upperDimg := task.upperMergeTask.dimg
 		lowerDimg := task.lowerMergeTask.dimg
 
@@ -552,9 +609,114 @@ func runMergeDimgTask(task *mergeDimgTask, tmpDir string, threadLimit chan struc
 		task.dimg.DimgHeader = *header
 		task.dimg.Path = mergedDimgPath
 		task.done <- nil
-
-		<-threadLimit
 	}()
 
 	return nil
 }
+
+// weights to estimate merge cost of dimgs
+const (
+	mergeCostPerNewEntry  = 4 * 1024
+	mergeCostPerDiffEntry = 64 * 1024 // merging diffs is much more expensive than copying
+)
+
+type mergeCost struct {
+	bodySize    int64
+	newEntries  int64
+	diffEntries int64
+}
+
+func (c mergeCost) add(o mergeCost) mergeCost {
+	return mergeCost{
+		bodySize:    c.bodySize + o.bodySize,
+		newEntries:  c.newEntries + o.newEntries,
+		diffEntries: c.diffEntries + o.diffEntries,
+	}
+}
+
+func (c mergeCost) weight() int64 {
+	return c.bodySize + c.newEntries*mergeCostPerNewEntry + c.diffEntries*mergeCostPerDiffEntry
+}
+
+func getMergeCost(fe *FileEntry) mergeCost {
+	c := mergeCost{}
+	switch fe.Type {
+	case FILE_ENTRY_FILE_NEW:
+		c.bodySize = fe.CompressedSize
+		c.newEntries = 1
+	case FILE_ENTRY_FILE_DIFF:
+		c.bodySize = fe.CompressedSize
+		c.diffEntries = 1
+	}
+	for _, child := range fe.Childs {
+		c = c.add(getMergeCost(child))
+	}
+	return c
+}
+
+// planMergeDimgTask builds the merge tree by merging the adjacent pair with the smallest cost first,
+// like Huffman coding constrained to keep the order of dimgs.
+// The merged dimg is estimated to have the sum of costs of the pair.
+func planMergeDimgTask(dimgs []*DimgEntry) *mergeDimgTask {
+	if len(dimgs) == 0 {
+		return nil
+	}
+
+	type node struct {
+		task *mergeDimgTask
+		cost mergeCost
+	}
+	nodes := make([]node, 0, len(dimgs))
+	for _, d := range dimgs {
+		nodes = append(nodes, node{
+			task: &mergeDimgTask{
+				dimg: d,
+				done: make(chan error, 1),
+			},
+			cost: getMergeCost(&d.FileEntry),
+		})
+	}
+
+	for len(nodes) > 1 {
+		minIdx := 0
+		for i := 1; i < len(nodes)-1; i++ {
+			if nodes[i].cost.add(nodes[i+1].cost).weight() < nodes[minIdx].cost.add(nodes[minIdx+1].cost).weight() {
+				minIdx = i
+			}
+		}
+		// dimgs[0] is the top, so the left is upper
+		merged := node{
+			task: &mergeDimgTask{
+				upperMergeTask: nodes[minIdx].task,
+				lowerMergeTask: nodes[minIdx+1].task,
+				done:           make(chan error, 1),
+			},
+			cost: nodes[minIdx].cost.add(nodes[minIdx+1].cost),
+		}
+		nodes = append(nodes[:minIdx+1], nodes[minIdx+2:]...)
+		nodes[minIdx] = merged
+	}
+
+	return nodes[0].task
+}
+
+// MergeDimgsWithPlan merges dimgs along the tree planned with their sizes and entries.
+// dimgs[0] must be the top.
+func MergeDimgsWithPlan(dimgs []*DimgEntry, tmpDir string, mc MergeConfig, isCdimg bool, pm *bsdiffx.PluginManager) (*DimgEntry, error) {
+	mergeTask := planMergeDimgTask(dimgs)
+	if mergeTask == nil {
+		return nil, fmt.Errorf("mergeTasks is nil")
+	}
+
+	threadLimit := make(chan struct{}, max(1, mc.MergeDimgConcurrentNum))
+	err := runMergeDimgTask(mergeTask, tmpDir, threadLimit, mc, isCdimg, pm)
+	if err != nil {
+		return nil, err
+	}
+
+	if mergeErr := <-mergeTask.done; mergeErr != nil {
+		return nil, fmt.Errorf("failed to merge: %v", mergeErr)
+	}
+
+	return mergeTask.dimg, nil
+}
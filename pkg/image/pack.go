@@ -3,6 +3,7 @@ package image
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -14,6 +15,7 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 type packTask struct {
@@ -21,83 +23,92 @@ type packTask struct {
 	data  *bytes.Buffer
 }
 
-func packDirImplMultithread(dirPath string, layer v1.Layer, outDirEntry *FileEntry, outWriter io.Writer, threadNum int) error {
+func packDirImplMultithread(ctx context.Context, dirPath string, layer v1.Layer, outDirEntry *FileEntry, outWriter io.Writer, threadNum int, profile *AccessProfile, pt *progressTracker) error {
 	compressTasks := make(chan packTask, 1000)
 	writeTasks := make(chan packTask, 1000)
-	wg := sync.WaitGroup{}
-
-	if layer != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			logger.Info("started pack enqueu thread")
-			err := enqueuePackTaskToChannelFromLayer(layer, outDirEntry, compressTasks)
-			if err != nil {
-				logger.Errorf("failed to enque: %v", err)
-			}
-			close(compressTasks)
-			logger.Info("finished pack enqueu thread")
-		}()
-	} else {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			logger.Info("started pack enqueu thread")
-			err := enqueuePackTaskToChannel(dirPath, outDirEntry, compressTasks)
-			if err != nil {
-				logger.Errorf("failed to enque: %v", err)
-			}
-			close(compressTasks)
-			logger.Info("finished pack enqueu thread")
-		}()
+	eg, ctx := errgroup.WithContext(ctx)
+
+	spool, err := os.CreateTemp("", "*")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	written := map[*FileEntry]struct{}{}
+
+	pt.SetPhase(PROGRESS_PHASE_SCAN)
+	eg.Go(func() error {
+		defer close(compressTasks)
+		logger.Info("started pack enqueu thread")
+		var err error
+		if layer != nil {
+			err = enqueuePackTaskToChannelFromLayer(ctx, layer, outDirEntry, compressTasks, pt)
+		} else {
+			err = enqueuePackTaskToChannel(ctx, dirPath, outDirEntry, compressTasks, pt)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enqueue: %v", err)
+		}
+		logger.Info("finished pack enqueu thread")
+		pt.SetPhase(PROGRESS_PHASE_PROCESS)
+		return nil
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	eg.Go(func() error {
 		offset := int64(0)
 		logger.Info("started pack write thread")
 		for {
-			wt, more := <-writeTasks
-			if !more {
-				break
-			}
-			wt.entry.Offset = offset
-			len := int64(wt.data.Len())
-			_, err := io.Copy(outWriter, wt.data)
-			if err != nil {
-				logger.Errorf("failed to copy to outBody: %v", err)
-				return
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case wt, more := <-writeTasks:
+				if !more {
+					logger.Info("finished pack write thread")
+					return nil
+				}
+				wt.entry.Offset = offset
+				len := int64(wt.data.Len())
+				_, err := io.Copy(spool, wt.data)
+				if err != nil {
+					return fmt.Errorf("failed to copy to spool: %v", err)
+				}
+				offset += len
+				written[wt.entry] = struct{}{}
+				pt.FileDone(wt.entry.Name, int64(wt.entry.Size), len)
 			}
-			offset += len
 		}
-		logger.Info("finished pack write thread")
-	}()
+	})
 
 	compWg := sync.WaitGroup{}
 	for i := 0; i < threadNum; i++ {
-		wg.Add(1)
 		compWg.Add(1)
-		go func(threadId int) {
+		threadId := i
+		eg.Go(func() error {
 			logger.Infof("started pack compress thread idx=%d", threadId)
-			defer wg.Done()
 			defer compWg.Done()
 			for {
-				ct, more := <-compressTasks
-				if !more {
-					break
-				}
-				outBuffer, err := compressWithZstdIo(ct.data)
-				if err != nil {
-					logger.Errorf("failed to pack file %s: %v", ct.entry.Name, err)
-					break
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ct, more := <-compressTasks:
+					if !more {
+						logger.Infof("finished pack compress thread idx=%d", threadId)
+						return nil
+					}
+					outBuffer, frames, err := compressSeekable(ct.data)
+					if err != nil {
+						return fmt.Errorf("failed to pack file %s: %v", ct.entry.Name, err)
+					}
+					ct.entry.CompressedSize = int64(outBuffer.Len())
+					ct.entry.Frames = frames
+					ct.data = outBuffer
+					err = sendTask(ctx, writeTasks, ct)
+					if err != nil {
+						return err
+					}
 				}
-				ct.entry.CompressedSize = int64(outBuffer.Len())
-				ct.data = outBuffer
-				writeTasks <- ct
 			}
-			logger.Infof("finished pack compress thread idx=%d", threadId)
-		}(i)
+		})
 	}
 
 	go func() {
@@ -106,11 +117,29 @@ func packDirImplMultithread(dirPath string, layer v1.Layer, outDirEntry *FileEnt
 		logger.Infof("all compression tasks finished")
 	}()
 
-	wg.Wait()
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+
+	err = canonicalizeBody(outDirEntry, written, spool, outWriter, profile)
+	if err != nil {
+		return fmt.Errorf("failed to write outBody: %v", err)
+	}
 	return nil
 }
 
-func enqueuePackTaskToChannel(dirPath string, parentEntry *FileEntry, taskChan chan packTask) error {
+// sendTask sends t to ch unless ctx is canceled
+func sendTask[T any](ctx context.Context, ch chan T, t T) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch <- t:
+		return nil
+	}
+}
+
+func enqueuePackTaskToChannel(ctx context.Context, dirPath string, parentEntry *FileEntry, taskChan chan packTask, pt *progressTracker) error {
 	logger.Debugf("dirPath:%s\n", dirPath)
 	dirEntries, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -180,9 +209,13 @@ func enqueuePackTaskToChannel(dirPath string, parentEntry *FileEntry, taskChan c
 			}
 
 			parentEntry.Childs[fName] = entry
-			taskChan <- packTask{
+			pt.AddTotal(1)
+			err = sendTask(ctx, taskChan, packTask{
 				entry: entry,
 				data:  bytes.NewBuffer(fileBody),
+			})
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -193,7 +226,7 @@ func enqueuePackTaskToChannel(dirPath string, parentEntry *FileEntry, taskChan c
 			Name:   childDir.Name(),
 			Childs: map[string]*FileEntry{},
 		}
-		err = enqueuePackTaskToChannel(childDirPath, entry, taskChan)
+		err = enqueuePackTaskToChannel(ctx, childDirPath, entry, taskChan, pt)
 		if err != nil {
 			return err
 		}
@@ -218,7 +251,7 @@ func enqueuePackTaskToChannel(dirPath string, parentEntry *FileEntry, taskChan c
 	return nil
 }
 
-func enqueuePackTaskToChannelFromLayer(layer v1.Layer, rootEntry *FileEntry, taskChan chan packTask) error {
+func enqueuePackTaskToChannelFromLayer(ctx context.Context, layer v1.Layer, rootEntry *FileEntry, taskChan chan packTask, pt *progressTracker) error {
 	uncomp, err := layer.Uncompressed()
 	if err != nil {
 		return fmt.Errorf("failed to get uncompressed layer: %v", err)
@@ -272,9 +305,13 @@ func enqueuePackTaskToChannelFromLayer(layer v1.Layer, rootEntry *FileEntry, tas
 				if err != nil {
 					return err
 				}
-				taskChan <- packTask{
+				pt.AddTotal(1)
+				err = sendTask(ctx, taskChan, packTask{
 					entry: entry,
 					data:  &data,
+				})
+				if err != nil {
+					return err
 				}
 			} else {
 				entry.Digest, err = entry.GenerateDigest(nil)
@@ -335,7 +372,22 @@ func generateDigestDir(parentFe *FileEntry) error {
 	return nil
 }
 
-func PackDir(dirPath, outDimgPath string, threadNum int) error {
+// PackDir packs dirPath into a dimg.
+// If profile is not nil, bodies of files in the profile are placed at the front of the body.
+func PackDir(ctx context.Context, dirPath, outDimgPath string, threadNum int, profile *AccessProfile, progress ProgressReporter) error {
+	pt := newProgressTracker(progress, "pack")
+	err := packDir(ctx, dirPath, outDimgPath, threadNum, profile, pt)
+	if err != nil {
+		// remove partial output
+		os.Remove(outDimgPath)
+		return err
+	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
+
+	return nil
+}
+
+func packDir(ctx context.Context, dirPath, outDimgPath string, threadNum int, profile *AccessProfile, pt *progressTracker) error {
 	entry := &FileEntry{
 		Name:   "/",
 		Childs: map[string]*FileEntry{},
@@ -353,10 +405,11 @@ func PackDir(dirPath, outDimgPath string, threadNum int) error {
 	defer os.Remove(outTmpFile.Name())
 	defer outTmpFile.Close()
 
-	err = packDirImplMultithread(dirPath, nil, entry, outTmpFile, threadNum)
+	err = packDirImplMultithread(ctx, dirPath, nil, entry, outTmpFile, threadNum, profile, pt)
 	if err != nil {
 		return err
 	}
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 	_, err = outTmpFile.Seek(0, 0)
 	if err != nil {
 		return err
@@ -384,7 +437,22 @@ func PackDir(dirPath, outDimgPath string, threadNum int) error {
 	return nil
 }
 
-func PackLayer(layer v1.Layer, outDimgPath string, threadNum int) error {
+// PackLayer packs the layer into a dimg.
+// If profile is not nil, bodies of files in the profile are placed at the front of the body.
+func PackLayer(ctx context.Context, layer v1.Layer, outDimgPath string, threadNum int, profile *AccessProfile, progress ProgressReporter) error {
+	pt := newProgressTracker(progress, "pack")
+	err := packLayer(ctx, layer, outDimgPath, threadNum, profile, pt)
+	if err != nil {
+		// remove partial output
+		os.Remove(outDimgPath)
+		return err
+	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
+
+	return nil
+}
+
+func packLayer(ctx context.Context, layer v1.Layer, outDimgPath string, threadNum int, profile *AccessProfile, pt *progressTracker) error {
 	entry := &FileEntry{
 		Name:   "/",
 		Childs: map[string]*FileEntry{},
@@ -396,10 +464,11 @@ func PackLayer(layer v1.Layer, outDimgPath string, threadNum int) error {
 	defer outDimg.Close()
 
 	outBody := bytes.Buffer{}
-	err = packDirImplMultithread("", layer, entry, &outBody, threadNum)
+	err = packDirImplMultithread(ctx, "", layer, entry, &outBody, threadNum, profile, pt)
 	if err != nil {
 		return err
 	}
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 	//jsonBytes, _ := json.MarshalIndent(entry, " ", " ")
 	//fmt.Println(string(jsonBytes))
 	bodyDigest := digest.FromBytes(outBody.Bytes())
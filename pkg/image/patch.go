@@ -2,15 +2,18 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
-	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
-	cp "github.com/otiai10/copy"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 func ApplyFilePatch(baseFilePath, newFilePath string, patch io.Reader, p *bsdiffx.Plugin) error {
@@ -65,142 +68,463 @@ func ApplyFilePatch(baseFilePath, newFilePath string, patch io.Reader, p *bsdiff
 //	return nil
 //}
 
-func ApplyPatch(basePath, newPath string, dirEntry *FileEntry, img *DimgFile, isBase bool, pm *bsdiffx.PluginManager) error {
-	hardlinks, err := applyPatchImpl(basePath, newPath, dirEntry, img, isBase, pm)
+type PatchConfig struct {
+	ThreadNum int
+	Progress  ProgressReporter
+}
+
+type patchTask struct {
+	entry *FileEntry
+	// relative to the root of base and new directories
+	basePath string
+	newPath  string
+	// mode and ownership of entry are applied to the written file
+	setAttrs bool
+}
+
+type hardlinkEntry struct {
+	path string
+	link string
+}
+
+// ApplyPatch applies dirEntry in img to basePath and writes the result to newPath.
+// Files are created with *at syscalls relative to the root directories,
+// so ApplyPatch can be called concurrently in a process.
+func ApplyPatch(ctx context.Context, basePath, newPath string, dirEntry *FileEntry, img *DimgFile, isBase bool, pm *bsdiffx.PluginManager, pc PatchConfig) error {
+	if isBase {
+		basePath = ""
+	} else if basePath == "" {
+		return fmt.Errorf("basePath is required")
+	}
+	return applyPatchToDir(ctx, basePath, newPath, dirEntry, isBase, pc, func(baseRootFd, newRootFd int, task patchTask) error {
+		return processPatchTask(baseRootFd, newRootFd, task, img, pm)
+	})
+}
+
+// ApplyPatchChain applies imgs to basePath in order and writes only the final tree to newPath.
+// imgs must be ordered from the lowest to the top.
+// Each file is resolved through the chain in the same way as di3fs.
+func ApplyPatchChain(ctx context.Context, basePath, newPath string, imgs []*DimgFile, pm *bsdiffx.PluginManager, pc PatchConfig) error {
+	err := validateChain(imgs)
+	if err != nil {
+		return err
+	}
+
+	// files are always resolved in the images when the lowest is a base image.
+	// entries of the top image can depend on lower images even in that case.
+	if imgs[0].DimgHeader().ParentId == "" {
+		basePath = ""
+	} else if basePath == "" {
+		return fmt.Errorf("basePath is required")
+	}
+	top := imgs[len(imgs)-1]
+	return applyPatchToDir(ctx, basePath, newPath, &top.DimgHeader().FileEntry, false, pc, func(baseRootFd, newRootFd int, task patchTask) error {
+		return processChainTask(baseRootFd, newRootFd, task, imgs, pm)
+	})
+}
+
+func validateChain(imgs []*DimgFile) error {
+	if len(imgs) == 0 {
+		return fmt.Errorf("no images in chain")
+	}
+	for i := 1; i < len(imgs); i++ {
+		if imgs[i].DimgHeader().ParentId != imgs[i-1].DimgHeader().Id {
+			return fmt.Errorf("image %d (parentId=%s) is not a child of image %d (id=%s)", i, imgs[i].DimgHeader().ParentId, i-1, imgs[i-1].DimgHeader().Id)
+		}
+	}
+	return nil
+}
+
+func applyPatchToDir(ctx context.Context, basePath, newPath string, dirEntry *FileEntry, isBase bool, pc PatchConfig, process func(baseRootFd, newRootFd int, task patchTask) error) error {
+	pt := newProgressTracker(pc.Progress, "patch")
+	pt.SetPhase(PROGRESS_PHASE_SCAN)
+	pt.AddTotal(countFileEntries(dirEntry))
+
+	if !dirEntry.IsDir() {
+		return fmt.Errorf("root entry %q is not directory", dirEntry.Name)
+	}
+	if isBase && dirEntry.IsBaseRequired() {
+		return fmt.Errorf("invalid base image %q", newPath)
+	}
+	newRootPath := path.Join(newPath, dirEntry.Name)
+	err := os.Mkdir(newRootPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	newRootFd, err := unix.Open(newRootPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", newRootPath, err)
+	}
+	defer unix.Close(newRootFd)
+
+	// base image does not have base directory
+	baseRootFd := -1
+	if basePath != "" {
+		baseRootPath := path.Join(basePath, dirEntry.Name)
+		baseRootFd, err = unix.Open(baseRootPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", baseRootPath, err)
+		}
+		defer unix.Close(baseRootFd)
+	}
+
+	hardlinks := []*hardlinkEntry{}
+	// directories are created by enqueue thread before their children are enqueued
+	enqueue := func(ctx context.Context, taskChan chan patchTask) error {
+		var err error
+		hardlinks, err = enqueuePatchTask(ctx, newRootFd, dirEntry, ".", isBase, taskChan, pt)
+		return err
+	}
+	err = applyPatchMultithread(ctx, enqueue, func(task patchTask) error {
+		return process(baseRootFd, newRootFd, task)
+	}, max(1, pc.ThreadNum), pt)
 	if err != nil {
 		return fmt.Errorf("failed to apply patch: %v", err)
 	}
 
+	pt.SetPhase(PROGRESS_PHASE_FINALIZE)
 	for _, h := range hardlinks {
-		targetPath := filepath.Join(newPath, h.link)
-		err = os.Link(targetPath, h.path)
+		err = unix.Linkat(newRootFd, h.link, newRootFd, h.path, 0)
 		if err != nil {
-			return fmt.Errorf("failed to create hardlink from %s to %s", h.path, targetPath)
+			return fmt.Errorf("failed to create hardlink from %s to %s: %v", h.path, h.link, err)
 		}
 	}
+	pt.SetPhase(PROGRESS_PHASE_DONE)
 
 	return nil
 }
 
-type hardlinkEntry struct {
-	path string
-	link string
+// countFileEntries returns the number of non-directory entries under entry
+func countFileEntries(entry *FileEntry) int64 {
+	if !entry.IsDir() {
+		return 1
+	}
+	count := int64(0)
+	for _, c := range entry.Childs {
+		count += countFileEntries(c)
+	}
+	return count
 }
 
-func applyPatchImpl(basePath, newPath string, dirEntry *FileEntry, img *DimgFile, isBase bool, pm *bsdiffx.PluginManager) ([]*hardlinkEntry, error) {
-	fName := dirEntry.Name
-	baseFilePath := path.Join(basePath, fName)
-	newFilePath := path.Join(newPath, fName)
-	hardlinks := []*hardlinkEntry{}
+func applyPatchMultithread(ctx context.Context, enqueue func(context.Context, chan patchTask) error, process func(task patchTask) error, threadNum int, pt *progressTracker) error {
+	patchTasks := make(chan patchTask, 1000)
+	eg, ctx := errgroup.WithContext(ctx)
 
-	if isBase && dirEntry.IsBaseRequired() {
-		return nil, fmt.Errorf("invalid base image %q", newFilePath)
+	eg.Go(func() error {
+		defer close(patchTasks)
+		logger.Info("started patch enqueue thread")
+		err := enqueue(ctx, patchTasks)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue: %v", err)
+		}
+		logger.Info("finished patch enqueue thread")
+		pt.SetPhase(PROGRESS_PHASE_PROCESS)
+		return nil
+	})
+
+	for i := 0; i < threadNum; i++ {
+		threadId := i
+		eg.Go(func() error {
+			logger.Debugf("started patch thread idx=%d", threadId)
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case task, more := <-patchTasks:
+					if !more {
+						logger.Debugf("finished patch thread idx=%d", threadId)
+						return nil
+					}
+					err := process(task)
+					if err != nil {
+						return err
+					}
+					pt.FileDone(task.entry.Name, task.entry.CompressedSize, int64(task.entry.Size))
+				}
+			}
+		})
 	}
 
-	if dirEntry.Type == FILE_ENTRY_SYMLINK {
-		prevDir, err := filepath.Abs(".")
-		if err != nil {
-			return nil, err
+	return eg.Wait()
+}
+
+func enqueuePatchTask(ctx context.Context, newRootFd int, dirEntry *FileEntry, dirPath string, isBase bool, taskChan chan patchTask, pt *progressTracker) ([]*hardlinkEntry, error) {
+	hardlinks := []*hardlinkEntry{}
+	for _, name := range sortedChildNames(dirEntry) {
+		entry := dirEntry.Childs[name]
+		entryPath := path.Join(dirPath, name)
+		if isBase && entry.IsBaseRequired() {
+			return nil, fmt.Errorf("invalid base image %q", entryPath)
 		}
 
-		err = os.Chdir(newPath)
-		if err != nil {
-			return nil, err
+		switch {
+		case entry.Type == FILE_ENTRY_SYMLINK:
+			err := unix.Symlinkat(entry.RealPath, newRootFd, entryPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create symlink %s: %v", entryPath, err)
+			}
+		case entry.Type == FILE_ENTRY_HARDLINK:
+			hardlinks = append(hardlinks, &hardlinkEntry{
+				path: entryPath,
+				link: strings.TrimPrefix(entry.RealPath, "/"),
+			})
+		case entry.IsDir():
+			err := unix.Mkdirat(newRootFd, entryPath, uint32(os.ModePerm))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create dir %s: %v", entryPath, err)
+			}
+			h, err := enqueuePatchTask(ctx, newRootFd, entry, entryPath, isBase, taskChan, pt)
+			if err != nil {
+				return nil, err
+			}
+			hardlinks = append(hardlinks, h...)
+		case entry.IsFile():
+			err := sendTask(ctx, taskChan, patchTask{entry: entry, basePath: entryPath, newPath: entryPath})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected error type=%v", entry.Type)
 		}
 
-		err = os.Symlink(dirEntry.RealPath, fName)
+		err := entry.Verify(nil)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to verify %s(%d, %d): %v", entryPath, entry.Type, entry.Size, err)
+		}
+		if !entry.IsDir() {
+			pt.FileDone(entry.Name, entry.CompressedSize, int64(entry.Size))
 		}
+	}
+
+	err := dirEntry.Verify(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify %s(%d, %d): %v", dirPath, dirEntry.Type, dirEntry.Size, err)
+	}
+
+	return hardlinks, nil
+}
 
-		err = os.Chdir(prevDir)
+func openFileAt(dirFd int, name string, flag int, perm uint32) (*os.File, error) {
+	fd, err := unix.Openat(dirFd, name, flag|unix.O_CLOEXEC, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+var zstdDecoderPool = sync.Pool{
+	New: func() any {
+		d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
 		if err != nil {
-			return nil, err
+			panic(err)
 		}
-	} else if dirEntry.Type == FILE_ENTRY_HARDLINK {
-		hardlinks = append(hardlinks, &hardlinkEntry{
-			path: newFilePath,
-			link: dirEntry.RealPath,
-		})
-	} else if dirEntry.IsDir() {
-		err := os.Mkdir(newFilePath, os.ModePerm)
+		return d
+	},
+}
+
+// processPatchTask writes the file of the task.
+// The file is hashed while being written to verify it without reading it again.
+func processPatchTask(baseRootFd, newRootFd int, task patchTask, img *DimgFile, pm *bsdiffx.PluginManager) error {
+	entry := task.entry
+	digester, err := entry.Digester()
+	if err != nil {
+		return fmt.Errorf("failed to generate digest of %s: %v", task.newPath, err)
+	}
+
+	perm := uint32(0666)
+	var baseFile *os.File
+	if entry.IsBaseRequired() {
+		baseFile, err = openFileAt(baseRootFd, task.basePath, unix.O_RDONLY, 0)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		for _, c := range dirEntry.Childs {
-			h, err := applyPatchImpl(baseFilePath, newFilePath, c, img, isBase, pm)
+		defer baseFile.Close()
+		if entry.Type == FILE_ENTRY_FILE_SAME {
+			stat, err := baseFile.Stat()
 			if err != nil {
-				return nil, err
+				return err
 			}
-			hardlinks = append(hardlinks, h...)
+			perm = uint32(stat.Mode().Perm())
 		}
-	} else if dirEntry.Type == FILE_ENTRY_FILE_SAME {
-		err := cp.Copy(baseFilePath, newFilePath)
+	}
+
+	newFile, err := openFileAt(newRootFd, task.newPath, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+	out := io.MultiWriter(newFile, digester.Hash())
+
+	switch entry.Type {
+	case FILE_ENTRY_FILE_SAME:
+		_, err = io.Copy(out, baseFile)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to copy %s: %v", task.newPath, err)
 		}
-	} else if dirEntry.Type == FILE_ENTRY_FILE_NEW {
-		//if strings.Contains(dirEntry.Name, ".wh") {
-		//	fmt.Println(newFilePath)
-		//}
-		logger.Debugf("copy %q from image(offset=%d size=%d)", newFilePath, dirEntry.Offset, dirEntry.CompressedSize)
-		patchBytes := make([]byte, dirEntry.CompressedSize)
-		_, err := img.ReadAt(patchBytes, dirEntry.Offset)
+	case FILE_ENTRY_FILE_NEW:
+		logger.Debugf("copy %q from image(offset=%d size=%d)", task.newPath, entry.Offset, entry.CompressedSize)
+		// empty files do not have body
+		if entry.CompressedSize == 0 {
+			break
+		}
+		decoder := zstdDecoderPool.Get().(*zstd.Decoder)
+		defer zstdDecoderPool.Put(decoder)
+		err = decoder.Reset(io.NewSectionReader(img, entry.Offset, entry.CompressedSize))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		patchBuf := bytes.NewBuffer(patchBytes)
-		patchReader, err := zstd.NewReader(patchBuf)
+		_, err = io.Copy(out, decoder)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to decompress %s: %v", task.newPath, err)
 		}
-		defer patchReader.Close()
-
-		newFile, err := os.Create(newFilePath)
+	case FILE_ENTRY_FILE_DIFF:
+		p := pm.GetPluginByUuid(entry.PluginUuid)
+		if p == nil {
+			return fmt.Errorf("plugin for %s not found", entry.PluginUuid)
+		}
+		logger.Debugf("applying diff to %q from image(offset=%d size=%d)", task.newPath, entry.Offset, entry.CompressedSize)
+		patchBytes := make([]byte, entry.CompressedSize)
+		_, err := img.ReadAt(patchBytes, entry.Offset)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer newFile.Close()
-
-		_, err = io.Copy(newFile, patchReader)
+		baseBytes, err := io.ReadAll(baseFile)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else if dirEntry.Type == FILE_ENTRY_FILE_DIFF {
-		p := pm.GetPluginByUuid(dirEntry.PluginUuid)
-		var patchReader io.Reader
-		logger.Debugf("applying diff to %q from image(offset=%d size=%d)", newFilePath, dirEntry.Offset, dirEntry.CompressedSize)
-		patchBytes := make([]byte, dirEntry.CompressedSize)
-		_, err := img.ReadAt(patchBytes, dirEntry.Offset)
+		newBytes, err := p.Patch(baseBytes, bytes.NewBuffer(patchBytes))
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to patch %s: %v", task.newPath, err)
 		}
-		patchReader = bytes.NewBuffer(patchBytes)
-		err = ApplyFilePatch(baseFilePath, newFilePath, patchReader, p)
+		_, err = out.Write(newBytes)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else {
-		return nil, fmt.Errorf("unexpected error type=%v", dirEntry.Type)
 	}
 
-	data := []byte{}
-	if dirEntry.IsFile() {
-		f, err := os.Open(newFilePath)
+	if digester.Digest() != entry.Digest {
+		return fmt.Errorf("failed to verify %s(%d, %d): failed to verify digest", task.newPath, entry.Type, entry.Size)
+	}
+
+	if task.setAttrs {
+		// chown(2) clears setuid and setgid bits, so chmod is applied after it
+		err = unix.Fchown(int(newFile.Fd()), int(entry.UID), int(entry.GID))
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to chown %s: %v", task.newPath, err)
 		}
-		defer f.Close()
+		err = unix.Fchmod(int(newFile.Fd()), unixMode(entry.Mode))
+		if err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", task.newPath, err)
+		}
+	}
+
+	return nil
+}
 
-		data, err = io.ReadAll(f)
+// processChainTask writes the file of the task resolved through imgs.
+func processChainTask(baseRootFd, newRootFd int, task patchTask, imgs []*DimgFile, pm *bsdiffx.PluginManager) error {
+	top := len(imgs) - 1
+	switch task.entry.Type {
+	case FILE_ENTRY_FILE_NEW:
+		return processPatchTask(baseRootFd, newRootFd, task, imgs[top], pm)
+	case FILE_ENTRY_FILE_SAME:
+		// copied from the base directory if no image in the chain changes the file
+		_, src, err := findChainSource(imgs, top, task.basePath)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if src.Type == FILE_ENTRY_FILE_SAME {
+			return processPatchTask(baseRootFd, newRootFd, task, imgs[top], pm)
 		}
 	}
-	err := dirEntry.Verify(data)
+
+	body, err := readChainBody(baseRootFd, imgs, top, task.basePath, pm)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify %s(%d, %d): %v", newFilePath, dirEntry.Type, dirEntry.Size, err)
+		return fmt.Errorf("failed to resolve %s: %v", task.basePath, err)
 	}
 
-	return hardlinks, nil
+	digester, err := task.entry.Digester()
+	if err != nil {
+		return fmt.Errorf("failed to generate digest of %s: %v", task.newPath, err)
+	}
+	newFile, err := openFileAt(newRootFd, task.newPath, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+	_, err = io.MultiWriter(newFile, digester.Hash()).Write(body)
+	if err != nil {
+		return err
+	}
+	if digester.Digest() != task.entry.Digest {
+		return fmt.Errorf("failed to verify %s(%d, %d): failed to verify digest", task.newPath, task.entry.Type, task.entry.Size)
+	}
+
+	return nil
+}
+
+// findChainSource returns the highest entry under layer which is not FILE_SAME.
+// If the file is not changed in imgs, FILE_SAME entry of the lowest is returned.
+func findChainSource(imgs []*DimgFile, layer int, filePath string) (int, *FileEntry, error) {
+	for ; layer >= 0; layer-- {
+		entry, err := imgs[layer].DimgHeader().FileEntry.Lookup(filePath)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s not found in image %d: %v", filePath, layer, err)
+		}
+		if entry.Type != FILE_ENTRY_FILE_SAME || layer == 0 {
+			return layer, entry, nil
+		}
+	}
+	return 0, nil, ErrUnexpected
+}
+
+// readChainBody returns the body of filePath in imgs[layer].
+func readChainBody(baseRootFd int, imgs []*DimgFile, layer int, filePath string, pm *bsdiffx.PluginManager) ([]byte, error) {
+	entry, err := imgs[layer].DimgHeader().FileEntry.Lookup(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("not found in image %d: %v", layer, err)
+	}
+
+	switch entry.Type {
+	case FILE_ENTRY_FILE_NEW:
+		return readFullBody(imgs[layer], entry)
+	case FILE_ENTRY_FILE_SAME, FILE_ENTRY_FILE_DIFF:
+		var lowerBytes []byte
+		if layer == 0 {
+			if baseRootFd < 0 {
+				return nil, fmt.Errorf("base directory is required")
+			}
+			baseFile, err := openFileAt(baseRootFd, filePath, unix.O_RDONLY, 0)
+			if err != nil {
+				return nil, err
+			}
+			defer baseFile.Close()
+			lowerBytes, err = io.ReadAll(baseFile)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			lowerBytes, err = readChainBody(baseRootFd, imgs, layer-1, filePath, pm)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if entry.Type == FILE_ENTRY_FILE_SAME {
+			return lowerBytes, nil
+		}
+
+		p := pm.GetPluginByUuid(entry.PluginUuid)
+		if p == nil {
+			return nil, fmt.Errorf("plugin for %s not found", entry.PluginUuid)
+		}
+		patchBytes := make([]byte, entry.CompressedSize)
+		_, err = imgs[layer].ReadAt(patchBytes, entry.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return p.Patch(lowerBytes, bytes.NewBuffer(patchBytes))
+	default:
+		return nil, fmt.Errorf("unexpected type %s in image %d", EntryTypeToString(entry.Type), layer)
+	}
 }
@@ -0,0 +1,61 @@
+package image
+
+import (
+	"errors"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/algorithm"
+)
+
+// PathObjective is the cost minimized when dimgs are selected from DimgStore
+type PathObjective string
+
+const (
+	// the number of dimgs
+	PathObjectiveHops = PathObjective("hops")
+	// the total size of dimgs to be transferred
+	PathObjectiveBytes = PathObjective("bytes")
+	// the estimated time to merge dimgs
+	PathObjectiveMergeTime = PathObjective("mergeTime")
+	// the total size of dimgs plus the estimated time to merge them scaled to bytes
+	PathObjectiveBytesAndMergeTime = PathObjective("bytesAndMergeTime")
+)
+
+// merge cost equivalent to transferring a byte in PathObjectiveBytesAndMergeTime
+const pathMergeCostPerByte = 4
+
+var (
+	ErrInvalidPathObjective = errors.New("invalid path objective")
+
+	pathObjectives = []PathObjective{PathObjectiveHops, PathObjectiveBytes, PathObjectiveMergeTime, PathObjectiveBytesAndMergeTime}
+)
+
+func GetPathObjective(objective string) (PathObjective, error) {
+	for _, o := range pathObjectives {
+		if string(o) == objective {
+			return o, nil
+		}
+	}
+	return "", ErrInvalidPathObjective
+}
+
+func newDimgGraphs() map[PathObjective]*algorithm.DirectedGraph {
+	graphs := map[PathObjective]*algorithm.DirectedGraph{}
+	for _, o := range pathObjectives {
+		graphs[o] = algorithm.NewDirectedGraph()
+	}
+	return graphs
+}
+
+// pathCost returns the cost of the edge for entry
+func pathCost(entry *DimgEntry, objective PathObjective) int {
+	switch objective {
+	case PathObjectiveBytes:
+		return int(entry.Size)
+	case PathObjectiveMergeTime:
+		return int(getMergeCost(&entry.FileEntry).weight())
+	case PathObjectiveBytesAndMergeTime:
+		return int(entry.Size + getMergeCost(&entry.FileEntry).weight()/pathMergeCostPerByte)
+	default:
+		return 1
+	}
+}
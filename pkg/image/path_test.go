@@ -0,0 +1,41 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathCost(t *testing.T) {
+	entry := &DimgEntry{
+		DimgHeader: DimgHeader{
+			FileEntry: FileEntry{
+				Type: FILE_ENTRY_DIR,
+				Childs: map[string]*FileEntry{
+					"new":  {Type: FILE_ENTRY_FILE_NEW, CompressedSize: 100},
+					"diff": {Type: FILE_ENTRY_FILE_DIFF, CompressedSize: 10},
+					"same": {Type: FILE_ENTRY_FILE_SAME},
+				},
+			},
+		},
+		Size: 1000,
+	}
+	mergeTime := 110 + mergeCostPerNewEntry + mergeCostPerDiffEntry
+
+	for _, c := range []struct {
+		objective PathObjective
+		cost      int
+	}{
+		{PathObjectiveHops, 1},
+		{PathObjectiveBytes, 1000},
+		{PathObjectiveMergeTime, mergeTime},
+		{PathObjectiveBytesAndMergeTime, 1000 + mergeTime/pathMergeCostPerByte},
+	} {
+		o, err := GetPathObjective(string(c.objective))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.cost, pathCost(entry, o), string(c.objective))
+	}
+
+	_, err := GetPathObjective("unknown")
+	assert.Equal(t, ErrInvalidPathObjective, err)
+}
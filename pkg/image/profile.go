@@ -0,0 +1,49 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AccessProfile lists files opened while a container starts.
+// Files are paths relative to the root of the image, ordered by the first access.
+type AccessProfile struct {
+	Files []string `json:"files"`
+}
+
+func LoadAccessProfile(path string) (*AccessProfile, error) {
+	profileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile AccessProfile
+	err = json.Unmarshal(profileBytes, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal profile: %v", err)
+	}
+
+	return &profile, nil
+}
+
+// Write writes the profile atomically so that concurrent mounts never read a partial profile
+func (p *AccessProfile) Write(path string) error {
+	profileBytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal profile: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "profile-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(profileBytes)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,236 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROGRESS_PHASE_SCAN     = "scan"
+	PROGRESS_PHASE_PROCESS  = "process"
+	PROGRESS_PHASE_FINALIZE = "finalize"
+	PROGRESS_PHASE_DONE     = "done"
+)
+
+const (
+	PROGRESS_MODE_NONE = "none"
+	PROGRESS_MODE_BAR  = "bar"
+	PROGRESS_MODE_JSON = "json"
+)
+
+// ProgressEvent is a snapshot of a long-running operation.
+// FilesTotal may grow while Phase is PROGRESS_PHASE_SCAN.
+type ProgressEvent struct {
+	Task       string `json:"task"`
+	Phase      string `json:"phase"`
+	Name       string `json:"name,omitempty"`
+	FilesDone  int64  `json:"filesDone"`
+	FilesTotal int64  `json:"filesTotal"`
+	BytesIn    int64  `json:"bytesIn"`
+	BytesOut   int64  `json:"bytesOut"`
+	ElapsedMs  int64  `json:"elapsedMs"`
+}
+
+// ProgressReporter receives events from pack, diff, merge and patch.
+// Report may be called from multiple goroutines, but calls for a task are serialized.
+type ProgressReporter interface {
+	Report(ev ProgressEvent)
+}
+
+// progressTracker accumulates counters of a task and forwards them to ProgressReporter.
+// nil progressTracker is valid and does nothing.
+type progressTracker struct {
+	reporter ProgressReporter
+	start    time.Time
+	mu       sync.Mutex
+	ev       ProgressEvent
+}
+
+func newProgressTracker(reporter ProgressReporter, task string) *progressTracker {
+	if reporter == nil {
+		return nil
+	}
+	return &progressTracker{
+		reporter: reporter,
+		start:    time.Now(),
+		ev: ProgressEvent{
+			Task: task,
+		},
+	}
+}
+
+// must be called with p.mu held
+func (p *progressTracker) report() {
+	p.ev.ElapsedMs = time.Since(p.start).Milliseconds()
+	p.reporter.Report(p.ev)
+}
+
+func (p *progressTracker) SetPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ev.Phase = phase
+	p.ev.Name = ""
+	p.report()
+}
+
+func (p *progressTracker) AddTotal(files int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ev.FilesTotal += files
+}
+
+func (p *progressTracker) FileDone(name string, bytesIn, bytesOut int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ev.Name = name
+	p.ev.FilesDone += 1
+	p.ev.BytesIn += bytesIn
+	p.ev.BytesOut += bytesOut
+	p.report()
+}
+
+// AddBytes adds bytes of the file in progress.
+func (p *progressTracker) AddBytes(bytesIn, bytesOut int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ev.BytesIn += bytesIn
+	p.ev.BytesOut += bytesOut
+	p.report()
+}
+
+// ProgressTracker reports progress of tasks outside this package such as pull and load.
+// ProgressTracker for nil reporter is valid and does nothing.
+type ProgressTracker struct {
+	*progressTracker
+}
+
+func NewProgressTracker(reporter ProgressReporter, task string) ProgressTracker {
+	return ProgressTracker{newProgressTracker(reporter, task)}
+}
+
+// ProgressWriter reports bytes written to w every progressWriterInterval bytes
+type ProgressWriter struct {
+	w       io.Writer
+	pt      *progressTracker
+	pending int64
+}
+
+const progressWriterInterval = 1024 * 1024
+
+func (pw *ProgressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.pending += int64(n)
+	if pw.pending >= progressWriterInterval {
+		pw.pt.AddBytes(pw.pending, pw.pending)
+		pw.pending = 0
+	}
+	return n, err
+}
+
+// Writer returns io.Writer which reports bytes written to w.
+// FileDone must be called with name after the last write.
+func (p ProgressTracker) Writer(w io.Writer) *ProgressWriter {
+	return &ProgressWriter{w: w, pt: p.progressTracker}
+}
+
+// FileDone reports the file written through pw.
+func (pw *ProgressWriter) FileDone(name string) {
+	pw.pt.FileDone(name, pw.pending, pw.pending)
+	pw.pending = 0
+}
+
+// NewProgressReporter returns reporter for mode.
+// nil is returned for PROGRESS_MODE_NONE.
+func NewProgressReporter(mode string, w io.Writer) (ProgressReporter, error) {
+	switch mode {
+	case PROGRESS_MODE_NONE, "":
+		return nil, nil
+	case PROGRESS_MODE_BAR:
+		return &barProgressReporter{w: w, interval: 200 * time.Millisecond}, nil
+	case PROGRESS_MODE_JSON:
+		return &jsonProgressReporter{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %s", mode)
+	}
+}
+
+// jsonProgressReporter emits an event per line
+type jsonProgressReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (r *jsonProgressReporter) Report(ev ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.enc.Encode(ev)
+	if err != nil {
+		logger.Warnf("failed to emit progress event: %v", err)
+	}
+}
+
+// barProgressReporter renders a progress bar on a terminal.
+// Redrawing is throttled by interval except on phase changes.
+type barProgressReporter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	interval  time.Duration
+	lastDraw  time.Time
+	lastPhase string
+}
+
+const progressBarWidth = 30
+
+func (r *barProgressReporter) Report(ev ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	phaseChanged := ev.Phase != r.lastPhase
+	if !phaseChanged && time.Since(r.lastDraw) < r.interval {
+		return
+	}
+	r.lastDraw = time.Now()
+	r.lastPhase = ev.Phase
+
+	filled := 0
+	percent := 0
+	if ev.FilesTotal > 0 {
+		filled = int(ev.FilesDone * progressBarWidth / ev.FilesTotal)
+		percent = int(ev.FilesDone * 100 / ev.FilesTotal)
+	}
+	filled = min(filled, progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	fmt.Fprintf(r.w, "\r%s %-8s [%s] %3d%% %d/%d files in=%s out=%s",
+		ev.Task, ev.Phase, bar, percent, ev.FilesDone, ev.FilesTotal, formatBytes(ev.BytesIn), formatBytes(ev.BytesOut))
+	if ev.Phase == PROGRESS_PHASE_DONE {
+		fmt.Fprintln(r.w)
+	}
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
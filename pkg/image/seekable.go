@@ -0,0 +1,98 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Bodies of FILE_NEW entries larger than SEEKABLE_FRAME_SIZE are compressed into
+// independent zstd frames of SEEKABLE_FRAME_SIZE bytes so that ranges can be read
+// without decompressing the whole body. The concatenated frames are still a valid zstd stream.
+const SEEKABLE_FRAME_SIZE = 1024 * 1024
+
+type ZstdFrame struct {
+	// offset in the compressed body
+	Offset int64 `json:"offset"`
+	// digest of the decompressed frame
+	Digest digest.Digest `json:"digest"`
+}
+
+// compressSeekable compresses src into frames of SEEKABLE_FRAME_SIZE bytes.
+// frames is nil if src fits in a frame.
+func compressSeekable(src io.Reader) (*bytes.Buffer, []ZstdFrame, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer enc.Close()
+
+	out := &bytes.Buffer{}
+	frames := []ZstdFrame{}
+	chunk := make([]byte, SEEKABLE_FRAME_SIZE)
+	for {
+		n, err := io.ReadFull(src, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		frames = append(frames, ZstdFrame{
+			Offset: int64(out.Len()),
+			Digest: digest.FromBytes(chunk[:n]),
+		})
+		out.Write(enc.EncodeAll(chunk[:n], nil))
+		if n < SEEKABLE_FRAME_SIZE {
+			break
+		}
+	}
+	if len(frames) <= 1 {
+		return out, nil, nil
+	}
+	return out, frames, nil
+}
+
+func compressSeekableBytes(src []byte) ([]byte, []ZstdFrame, error) {
+	out, frames, err := compressSeekable(bytes.NewReader(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), frames, nil
+}
+
+// IsSeekable returns true if ranges of the body can be read with ReadFrame
+func (fe *FileEntry) IsSeekable() bool {
+	return fe.Type == FILE_ENTRY_FILE_NEW && len(fe.Frames) != 0
+}
+
+// ReadFrame reads the i-th frame of the body from img and verifies it.
+// The frame contains [i*SEEKABLE_FRAME_SIZE, (i+1)*SEEKABLE_FRAME_SIZE) of the file.
+func (fe *FileEntry) ReadFrame(img io.ReaderAt, i int) ([]byte, error) {
+	if i < 0 || i >= len(fe.Frames) {
+		return nil, fmt.Errorf("frame %d out of range (%d frames)", i, len(fe.Frames))
+	}
+	end := fe.CompressedSize
+	if i+1 < len(fe.Frames) {
+		end = fe.Frames[i+1].Offset
+	}
+	compressed := make([]byte, end-fe.Frames[i].Offset)
+	_, err := img.ReadAt(compressed, fe.Offset+fe.Frames[i].Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame %d: %v", i, err)
+	}
+
+	decoder := zstdDecoderPool.Get().(*zstd.Decoder)
+	defer zstdDecoderPool.Put(decoder)
+	data, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame %d: %v", i, err)
+	}
+	if digest.FromBytes(data) != fe.Frames[i].Digest {
+		return nil, fmt.Errorf("failed to verify frame %d", i)
+	}
+	return data, nil
+}
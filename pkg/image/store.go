@@ -1,50 +1,169 @@
 package image
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/naoki9911/fuse-diff-containerd/pkg/algorithm"
 	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DIMG_STORE_INDEX_NAME = "index.db"
+
+	dimgStoreBucketDimgs = "dimgs"
+	dimgStoreBucketTags  = "tags"
 )
 
 type DimgEntry struct {
 	DimgHeader
-	Path        string
-	ConfigBytes []byte
+	Path        string `json:"path"`
+	ConfigBytes []byte `json:"configBytes"`
+	// size of the self-contained dimg
+	Size int64 `json:"size"`
+	// size of the file in the store. blobs are not included
+	StoredSize    int64     `json:"storedSize"`
+	AddedAt       time.Time `json:"addedAt"`
+	LastMountedAt time.Time `json:"lastMountedAt"`
 }
 
+// DimgStore keeps dimgs and image tags.
+// The index of dimgs and tags is persisted in DIMG_STORE_INDEX_NAME under storeDir.
 type DimgStore struct {
 	storeDir    string
+	dedup       bool
 	storeLock   sync.Mutex
-	dimgGraph   *algorithm.DirectedGraph
+	db          *bolt.DB
+	dimgGraphs  map[PathObjective]*algorithm.DirectedGraph
 	dimgDigests map[digest.Digest]*DimgEntry
+	tags        map[string]digest.Digest
+}
+
+type DimgStoreOptions struct {
+	// store bodies of FILE_NEW entries once in DIMG_STORE_BLOBS_DIR keyed by FileEntry.Digest
+	// and let dimgs added to the store reference them
+	Dedup bool
 }
 
-func NewDimgStore(storeDir string) (*DimgStore, error) {
+func NewDimgStore(storeDir string, opts ...DimgStoreOptions) (*DimgStore, error) {
 	err := os.MkdirAll(storeDir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dir %s: %v", storeDir, err)
 	}
 
+	indexPath := filepath.Join(storeDir, DIMG_STORE_INDEX_NAME)
+	db, err := bolt.Open(indexPath, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %s: %v", indexPath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{dimgStoreBucketDimgs, dimgStoreBucketTags} {
+			_, err := tx.CreateBucketIfNotExists([]byte(b))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets in %s: %v", indexPath, err)
+	}
+
 	s := &DimgStore{
 		storeDir:    storeDir,
+		dedup:       len(opts) != 0 && opts[0].Dedup,
 		storeLock:   sync.Mutex{},
-		dimgGraph:   algorithm.NewDirectedGraph(),
+		db:          db,
+		dimgGraphs:  newDimgGraphs(),
 		dimgDigests: map[digest.Digest]*DimgEntry{},
+		tags:        map[string]digest.Digest{},
+	}
+
+	err = s.load()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load index: %v", err)
 	}
 
-	// check existing dimgs in image store
+	// check dimgs not in the index
 	err = s.Walk()
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to walk: %v", err)
 	}
 
 	return s, nil
 }
 
+func (ds *DimgStore) Close() error {
+	return ds.db.Close()
+}
+
+// load reads dimgs and tags from the index
+func (ds *DimgStore) load() error {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	return ds.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(dimgStoreBucketDimgs)).ForEach(func(k, v []byte) error {
+			entry := &DimgEntry{}
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal dimg %s: %v", string(k), err)
+			}
+			ds.dimgDigests[digest.Digest(k)] = entry
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket([]byte(dimgStoreBucketTags)).ForEach(func(k, v []byte) error {
+			ds.tags[string(k)] = digest.Digest(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		ds.rebuildGraph()
+		return nil
+	})
+}
+
+// must be called with ds.storeLock held
+func (ds *DimgStore) rebuildGraph() {
+	ds.dimgGraphs = newDimgGraphs()
+	for d, entry := range ds.dimgDigests {
+		ds.addEdge(d, entry)
+	}
+}
+
+// edges are directed from Id to ParentId
+// because paths are searched from the requested image towards local images.
+func (ds *DimgStore) addEdge(d digest.Digest, entry *DimgEntry) {
+	for objective, g := range ds.dimgGraphs {
+		g.Add(entry.Id.String(), entry.ParentId.String(), d.String(), pathCost(entry, objective))
+	}
+}
+
+// must be called with ds.storeLock held
+func (ds *DimgStore) putEntry(tx *bolt.Tx, d digest.Digest, entry *DimgEntry) error {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(dimgStoreBucketDimgs)).Put([]byte(d), entryBytes)
+}
+
+// Walk adds dimgs in the store directory which are not in the index
+// and drops indexed dimgs whose files are removed.
 func (ds *DimgStore) Walk() error {
 	ds.storeLock.Lock()
 	defer ds.storeLock.Unlock()
@@ -54,66 +173,306 @@ func (ds *DimgStore) Walk() error {
 		return fmt.Errorf("failed to ReadDir %s: %v", ds.storeDir, err)
 	}
 
-	ds.dimgGraph = algorithm.NewDirectedGraph()
-	ds.dimgDigests = map[digest.Digest]*DimgEntry{}
+	indexed := map[string]struct{}{}
+	for _, entry := range ds.dimgDigests {
+		indexed[entry.Path] = struct{}{}
+	}
 
-	for _, dir := range dirs {
-		fPath := filepath.Join(ds.storeDir, dir.Name())
-		if !dir.Type().IsRegular() {
-			logger.Infof("%s is not regular file. ignored", fPath)
-			continue
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		for _, dir := range dirs {
+			fPath := filepath.Join(ds.storeDir, dir.Name())
+			if dir.Name() == DIMG_STORE_INDEX_NAME || dir.Name() == DIMG_STORE_BLOBS_DIR {
+				continue
+			}
+			if !dir.Type().IsRegular() {
+				logger.Infof("%s is not regular file. ignored", fPath)
+				continue
+			}
+			if _, ok := indexed[fPath]; ok {
+				continue
+			}
+
+			entry, err := newDimgEntry(fPath)
+			if err != nil {
+				logger.Infof("%s is invalid dimg file: %v", fPath, err)
+				continue
+			}
+			d := entry.Digest()
+			if _, ok := ds.dimgDigests[d]; ok {
+				logger.Infof("%s is duplicated dimg of %s. ignored", fPath, d)
+				continue
+			}
+			ds.dedupEntry(entry)
+			err = ds.putEntry(tx, d, entry)
+			if err != nil {
+				return fmt.Errorf("failed to put dimg %s: %v", d, err)
+			}
+			ds.dimgDigests[d] = entry
+			logger.Infof("%s is added to the index", fPath)
 		}
 
-		dimgFile, err := OpenDimgFile(fPath)
-		if err != nil {
-			logger.Infof("%s is invalid dimg file: %v", fPath, err)
-			continue
+		for d, entry := range ds.dimgDigests {
+			if _, err := os.Stat(entry.Path); err == nil {
+				continue
+			}
+			err = tx.Bucket([]byte(dimgStoreBucketDimgs)).Delete([]byte(d))
+			if err != nil {
+				return fmt.Errorf("failed to delete dimg %s: %v", d, err)
+			}
+			delete(ds.dimgDigests, d)
+			logger.Warnf("%s is removed from the index because the file is not found", entry.Path)
 		}
-		header := dimgFile.DimgHeader()
 
-		entry := &DimgEntry{
-			DimgHeader: *header,
-			Path:       fPath,
+		ds.rebuildGraph()
+		return nil
+	})
+}
+
+func newDimgEntry(dimgPath string) (*DimgEntry, error) {
+	dimgFile, err := OpenDimgFile(dimgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dimgFile.Close()
+
+	stat, err := os.Stat(dimgPath)
+	if err != nil {
+		return nil, err
+	}
+	size, err := dimgFile.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DimgEntry{
+		DimgHeader: *dimgFile.DimgHeader(),
+		Path:       dimgPath,
+		Size:       size,
+		StoredSize: stat.Size(),
+		AddedAt:    time.Now(),
+	}, nil
+}
+
+func (de *DimgEntry) storedSize() int64 {
+	// indexed before StoredSize is introduced
+	if de.StoredSize == 0 {
+		return de.Size
+	}
+	return de.StoredSize
+}
+
+// dedupEntry rewrites the dimg of the entry into the deduplicated format if the store is in dedup mode.
+// The dimg is kept self-contained if it fails.
+// must be called with ds.storeLock held
+func (ds *DimgStore) dedupEntry(entry *DimgEntry) {
+	if !ds.dedup {
+		return
+	}
+	shared, err := dedupDimg(entry.Path, ds.blobsDir())
+	if err != nil {
+		logger.Warnf("failed to deduplicate %s: %v", entry.Path, err)
+		return
+	}
+	stat, err := os.Stat(entry.Path)
+	if err != nil {
+		logger.Warnf("failed to stat %s: %v", entry.Path, err)
+		return
+	}
+	logger.Infof("deduplicated %s (size=%d stored=%d shared=%d)", entry.Path, entry.Size, stat.Size(), shared)
+	entry.StoredSize = stat.Size()
+}
+
+func (ds *DimgStore) blobsDir() string {
+	return filepath.Join(ds.storeDir, DIMG_STORE_BLOBS_DIR)
+}
+
+// unreferencedBlobs returns paths and the total size of blobs not referenced by dimgs except excluded ones.
+// must be called with ds.storeLock held
+func (ds *DimgStore) unreferencedBlobs(excluded map[digest.Digest]struct{}) ([]string, int64, error) {
+	blobs, err := os.ReadDir(ds.blobsDir())
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to ReadDir %s: %v", ds.blobsDir(), err)
+	}
+
+	dimgs := []*DimgEntry{}
+	for d, entry := range ds.dimgDigests {
+		if _, ok := excluded[d]; !ok {
+			dimgs = append(dimgs, entry)
 		}
-		ds.dimgGraph.Add(string(header.ParentId), header.Id.String(), string(header.Digest()), 1)
-		ds.dimgDigests[header.Digest()] = entry
 	}
+	refs := referencedBlobs(dimgs)
 
-	return nil
+	paths := []string{}
+	size := int64(0)
+	for _, blob := range blobs {
+		if _, ok := refs[digest.NewDigestFromEncoded(digest.Canonical, blob.Name())]; ok {
+			continue
+		}
+		info, err := blob.Info()
+		if err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(ds.blobsDir(), blob.Name()))
+		size += info.Size()
+	}
+	return paths, size, nil
 }
 
+// AddDimg moves the dimg at dimgPath into the store.
+// If the same dimg already exists, dimgPath is removed.
 func (ds *DimgStore) AddDimg(dimgPath string, configBytes ...[]byte) error {
 	ds.storeLock.Lock()
 	defer ds.storeLock.Unlock()
 
-	dimgFile, err := OpenDimgFile(dimgPath)
+	entry, err := newDimgEntry(dimgPath)
 	if err != nil {
 		return fmt.Errorf("failed to open dimg %s: %v", dimgPath, err)
 	}
+	d := entry.Digest()
+
+	if existing, ok := ds.dimgDigests[d]; ok {
+		if configBytes != nil && existing.ConfigBytes == nil {
+			updated := *existing
+			updated.ConfigBytes = configBytes[0]
+			err = ds.db.Update(func(tx *bolt.Tx) error {
+				return ds.putEntry(tx, d, &updated)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update dimg %s: %v", d, err)
+			}
+			ds.dimgDigests[d] = &updated
+		}
+		os.Remove(dimgPath)
+		return nil
+	}
 
-	header := dimgFile.DimgHeader()
-	fPath := filepath.Join(ds.storeDir, fmt.Sprintf("%s.dimg", string(header.Digest())))
+	fPath := filepath.Join(ds.storeDir, fmt.Sprintf("%s.dimg", string(d)))
 	err = os.Rename(dimgPath, fPath)
 	if err != nil {
 		return fmt.Errorf("failed to rename %s to %s", dimgPath, fPath)
 	}
+	entry.Path = fPath
+	ds.dedupEntry(entry)
+	if configBytes != nil {
+		entry.ConfigBytes = configBytes[0]
+	}
+
+	err = ds.db.Update(func(tx *bolt.Tx) error {
+		return ds.putEntry(tx, d, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put dimg %s: %v", d, err)
+	}
+	ds.addEdge(d, entry)
+	ds.dimgDigests[d] = entry
+
+	return nil
+}
 
-	entry := &DimgEntry{
-		DimgHeader: *header,
-		Path:       fPath,
+// TouchDimgs records that dimgs are mounted now
+func (ds *DimgStore) TouchDimgs(dimgDigests []digest.Digest) error {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	now := time.Now()
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range dimgDigests {
+			entry, ok := ds.dimgDigests[d]
+			if !ok {
+				return fmt.Errorf("dimg %s not found", d)
+			}
+			updated := *entry
+			updated.LastMountedAt = now
+			err := ds.putEntry(tx, d, &updated)
+			if err != nil {
+				return fmt.Errorf("failed to update dimg %s: %v", d, err)
+			}
+			ds.dimgDigests[d] = &updated
+		}
+		return nil
+	})
+}
+
+// GetDimgEntry returns a copy of the dimg entry
+func (ds *DimgStore) GetDimgEntry(d digest.Digest) (*DimgEntry, bool) {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	entry, ok := ds.dimgDigests[d]
+	if !ok {
+		return nil, false
 	}
+	entryCopy := *entry
+	return &entryCopy, true
+}
 
-	if configBytes != nil {
-		entry.ConfigBytes = configBytes[0]
+// SetTag associates tag with the image id
+func (ds *DimgStore) SetTag(tag string, id digest.Digest) error {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(dimgStoreBucketTags)).Put([]byte(tag), []byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put tag %s: %v", tag, err)
 	}
+	ds.tags[tag] = id
+	return nil
+}
+
+func (ds *DimgStore) GetTag(tag string) (digest.Digest, bool) {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	id, ok := ds.tags[tag]
+	return id, ok
+}
+
+// Tags returns a copy of tags
+func (ds *DimgStore) Tags() map[string]digest.Digest {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	tags := map[string]digest.Digest{}
+	for tag, id := range ds.tags {
+		tags[tag] = id
+	}
+	return tags
+}
 
-	// Id -> ParentId
-	ds.dimgGraph.Add(header.Id.String(), header.ParentId.String(), header.Digest().String(), 1)
-	ds.dimgDigests[header.Digest()] = entry
+func (ds *DimgStore) DeleteTag(tag string) error {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
 
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(dimgStoreBucketTags)).Delete([]byte(tag))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete tag %s: %v", tag, err)
+	}
+	delete(ds.tags, tag)
 	return nil
 }
 
+// FullImageResolver returns FullImageResolver for full dimgs in the store.
+func (ds *DimgStore) FullImageResolver() FullImageResolver {
+	return func(id digest.Digest) (*DimgFile, error) {
+		ds.storeLock.Lock()
+		defer ds.storeLock.Unlock()
+
+		for _, dimg := range ds.dimgDigests {
+			if dimg.Id == id && dimg.ParentId == "" {
+				return OpenDimgFile(dimg.Path)
+			}
+		}
+		return nil, nil
+	}
+}
+
 // string[0] == top
 // string[1] == layer(parentId top.Id)
 func (ds *DimgStore) GetDimgPathsWithDimgId(dimgId digest.Digest) ([]string, error) {
@@ -121,7 +480,7 @@ func (ds *DimgStore) GetDimgPathsWithDimgId(dimgId digest.Digest) ([]string, err
 	defer ds.storeLock.Unlock()
 
 	// start search from current Id towards baseId(="")
-	dimgs, err := ds.GetDimgEntriesWithDimgIds(dimgId, []digest.Digest{""})
+	dimgs, err := ds.getDimgEntries(dimgId, []digest.Digest{""}, PathObjectiveHops)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get dimgs: %v", err)
 	}
@@ -134,12 +493,30 @@ func (ds *DimgStore) GetDimgPathsWithDimgId(dimgId digest.Digest) ([]string, err
 	return paths, nil
 }
 
+// GetDimgEntriesWithDimgIds returns dimgs in the path with the fewest dimgs
 func (ds *DimgStore) GetDimgEntriesWithDimgIds(startDimgId digest.Digest, goalDimgIds []digest.Digest) ([]*DimgEntry, error) {
+	return ds.GetDimgEntriesWithObjective(startDimgId, goalDimgIds, PathObjectiveHops)
+}
+
+// GetDimgEntriesWithObjective returns dimgs in the cheapest path from startDimgId to one of goalDimgIds
+func (ds *DimgStore) GetDimgEntriesWithObjective(startDimgId digest.Digest, goalDimgIds []digest.Digest, objective PathObjective) ([]*DimgEntry, error) {
+	ds.storeLock.Lock()
+	defer ds.storeLock.Unlock()
+
+	return ds.getDimgEntries(startDimgId, goalDimgIds, objective)
+}
+
+// must be called with ds.storeLock held
+func (ds *DimgStore) getDimgEntries(startDimgId digest.Digest, goalDimgIds []digest.Digest, objective PathObjective) ([]*DimgEntry, error) {
+	g, ok := ds.dimgGraphs[objective]
+	if !ok {
+		return nil, ErrInvalidPathObjective
+	}
 	goals := []string{}
 	for _, dimg := range goalDimgIds {
 		goals = append(goals, dimg.String())
 	}
-	_, dimgs, err := ds.dimgGraph.ShortestPathWithMultipleGoals(startDimgId.String(), goals)
+	_, dimgs, err := g.ShortestPathWithMultipleGoals(startDimgId.String(), goals)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get shortest path from %s to %v: %v", startDimgId, goals, err)
 	}
@@ -150,7 +527,9 @@ func (ds *DimgStore) GetDimgEntriesWithDimgIds(startDimgId digest.Digest, goalDi
 		if !ok {
 			return nil, fmt.Errorf("dimg for %s not found", dimgEdge.GetName())
 		}
-		dimgChain[i] = dimg
+		// merging dimgs overwrites entries
+		dimgCopy := *dimg
+		dimgChain[i] = &dimgCopy
 	}
 
 	return dimgChain, nil
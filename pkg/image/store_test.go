@@ -0,0 +1,159 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	storeTestV1Files = map[string]testFile{
+		"a": {body: "a v1", mode: 0644},
+		"b": {body: "b", mode: 0644},
+	}
+	storeTestV2Files = map[string]testFile{
+		"a": {body: "a v2", mode: 0644},
+		"b": {body: "b", mode: 0644},
+	}
+)
+
+// storeTestDimgs returns paths of the base dimg of v1, the diff from v1 to v2 and the base dimg of v2
+func storeTestDimgs(t *testing.T) (string, string, string) {
+	v1 := packTestDir(t, writeTestDir(t, storeTestV1Files))
+	v2 := packTestDir(t, writeTestDir(t, storeTestV2Files))
+	return v1, diffTestDimg(t, v1, v2), v2
+}
+
+func dimgHeaderOf(t *testing.T, path string) *DimgHeader {
+	img, err := OpenDimgFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	header := *img.DimgHeader()
+	return &header
+}
+
+// copyTestFile copies src into dir because AddDimg moves dimgs into the store
+func copyTestFile(t *testing.T, src, dir string) string {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.CreateTemp(dir, "*.dimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	_, err = dst.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst.Name()
+}
+
+func TestDimgStoreReopen(t *testing.T) {
+	base, diff, _ := storeTestDimgs(t)
+	baseHeader := dimgHeaderOf(t, base)
+	diffHeader := dimgHeaderOf(t, diff)
+	storeDir := t.TempDir()
+
+	ds, err := NewDimgStore(storeDir)
+	assert.Equal(t, nil, err)
+	err = ds.AddDimg(copyTestFile(t, base, t.TempDir()), []byte("config"))
+	assert.Equal(t, nil, err)
+	err = ds.AddDimg(copyTestFile(t, base, t.TempDir()))
+	assert.Equal(t, nil, err)
+	err = ds.AddDimg(copyTestFile(t, diff, t.TempDir()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, ds.SetTag("v1", baseHeader.Id))
+	assert.Equal(t, nil, ds.SetTag("v2", diffHeader.Id))
+	assert.Equal(t, nil, ds.SetTag("gone", diffHeader.Id))
+	assert.Equal(t, nil, ds.DeleteTag("gone"))
+	assert.Equal(t, nil, ds.Close())
+
+	ds, err = NewDimgStore(storeDir)
+	assert.Equal(t, nil, err)
+	defer ds.Close()
+	assert.Equal(t, map[string]digest.Digest{"v1": baseHeader.Id, "v2": diffHeader.Id}, ds.Tags())
+	id, ok := ds.GetTag("v2")
+	assert.True(t, ok)
+	assert.Equal(t, diffHeader.Id, id)
+
+	entry, ok := ds.GetDimgEntry(baseHeader.Digest())
+	assert.True(t, ok)
+	assert.Equal(t, []byte("config"), entry.ConfigBytes)
+	entry, ok = ds.GetDimgEntry(diffHeader.Digest())
+	assert.True(t, ok)
+	assert.Equal(t, []byte(nil), entry.ConfigBytes)
+
+	chain, err := ds.GetDimgEntriesWithDimgIds(diffHeader.Id, []digest.Digest{""})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(chain))
+}
+
+func TestDimgStoreWalkAndAddDimgEdges(t *testing.T) {
+	base, diff, _ := storeTestDimgs(t)
+	baseHeader := dimgHeaderOf(t, base)
+	diffHeader := dimgHeaderOf(t, diff)
+
+	for _, c := range []struct {
+		name   string
+		walked string
+		added  string
+	}{
+		{"base walked", base, diff},
+		{"diff walked", diff, base},
+	} {
+		storeDir := t.TempDir()
+		copyTestFile(t, c.walked, storeDir)
+		ds, err := NewDimgStore(storeDir)
+		assert.Equal(t, nil, err, c.name)
+		err = ds.AddDimg(copyTestFile(t, c.added, t.TempDir()))
+		assert.Equal(t, nil, err, c.name)
+
+		// dimgs are ordered from the requested image to the base image
+		chain, err := ds.GetDimgEntriesWithDimgIds(diffHeader.Id, []digest.Digest{""})
+		assert.Equal(t, nil, err, c.name)
+		if assert.Equal(t, 2, len(chain), c.name) {
+			assert.Equal(t, diffHeader.Digest(), chain[0].Digest(), c.name)
+			assert.Equal(t, baseHeader.Digest(), chain[1].Digest(), c.name)
+		}
+		_, err = ds.GetDimgEntriesWithDimgIds(baseHeader.Id, []digest.Digest{diffHeader.Id})
+		assert.NotEqual(t, nil, err, c.name)
+		ds.Close()
+
+		// edges are rebuilt from the index in the same direction
+		ds, err = NewDimgStore(storeDir)
+		assert.Equal(t, nil, err, c.name)
+		chain, err = ds.GetDimgEntriesWithDimgIds(diffHeader.Id, []digest.Digest{""})
+		assert.Equal(t, nil, err, c.name)
+		assert.Equal(t, 2, len(chain), c.name)
+		ds.Close()
+	}
+}
+
+func TestDimgStoreWalkRemovedFile(t *testing.T) {
+	base, _, _ := storeTestDimgs(t)
+	baseHeader := dimgHeaderOf(t, base)
+	storeDir := t.TempDir()
+
+	ds, err := NewDimgStore(storeDir)
+	assert.Equal(t, nil, err)
+	defer ds.Close()
+	err = ds.AddDimg(copyTestFile(t, base, t.TempDir()))
+	assert.Equal(t, nil, err)
+	entry, ok := ds.GetDimgEntry(baseHeader.Digest())
+	assert.True(t, ok)
+	assert.Equal(t, storeDir, filepath.Dir(entry.Path))
+
+	assert.Equal(t, nil, os.Remove(entry.Path))
+	assert.Equal(t, nil, ds.Walk())
+	_, ok = ds.GetDimgEntry(baseHeader.Digest())
+	assert.False(t, ok)
+	_, err = ds.GetDimgEntriesWithDimgIds(baseHeader.Id, []digest.Digest{""})
+	assert.NotEqual(t, nil, err)
+}
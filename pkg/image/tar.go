@@ -0,0 +1,188 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"golang.org/x/sys/unix"
+)
+
+// ApplyPatchToTar writes the tree reconstructed from basePath and imgs to w as a tar stream.
+// imgs must be ordered from the lowest to the top. If imgs[0] is a base image,
+// basePath is not used and the tree is reconstructed only from imgs.
+// Ownership and modes are taken from the top image, so no privilege is required.
+func ApplyPatchToTar(ctx context.Context, basePath string, imgs []*DimgFile, pm *bsdiffx.PluginManager, w io.Writer) error {
+	err := validateChain(imgs)
+	if err != nil {
+		return err
+	}
+
+	baseRootFd := -1
+	if imgs[0].DimgHeader().ParentId != "" {
+		if basePath == "" {
+			return fmt.Errorf("basePath is required")
+		}
+		baseRootFd, err = unix.Open(basePath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", basePath, err)
+		}
+		defer unix.Close(baseRootFd)
+	}
+
+	tw := tar.NewWriter(w)
+	hardlinks := []*tar.Header{}
+	var walk func(dirEntry *FileEntry, dirPath string) error
+	walk = func(dirEntry *FileEntry, dirPath string) error {
+		for _, name := range sortedChildNames(dirEntry) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry := dirEntry.Childs[name]
+			entryPath := path.Join(dirPath, name)
+			header := &tar.Header{
+				Name:   entryPath,
+				Mode:   tarMode(entry.Mode),
+				Uid:    int(entry.UID),
+				Gid:    int(entry.GID),
+				Format: tar.FormatPAX,
+			}
+
+			switch {
+			case entry.IsDir():
+				header.Typeflag = tar.TypeDir
+				header.Name += "/"
+				err := tw.WriteHeader(header)
+				if err != nil {
+					return err
+				}
+				err = walk(entry, entryPath)
+				if err != nil {
+					return err
+				}
+			case entry.Type == FILE_ENTRY_SYMLINK:
+				header.Typeflag = tar.TypeSymlink
+				header.Linkname = entry.RealPath
+				err := tw.WriteHeader(header)
+				if err != nil {
+					return err
+				}
+			case entry.Type == FILE_ENTRY_HARDLINK:
+				// hardlinks must follow their targets
+				header.Typeflag = tar.TypeLink
+				header.Linkname = strings.TrimPrefix(entry.RealPath, "/")
+				hardlinks = append(hardlinks, header)
+			case entry.IsFile():
+				header.Typeflag = tar.TypeReg
+				header.Size = int64(entry.Size)
+				err := tw.WriteHeader(header)
+				if err != nil {
+					return err
+				}
+				err = writeChainBody(tw, baseRootFd, imgs, entry, entryPath, pm)
+				if err != nil {
+					return fmt.Errorf("failed to write %s: %v", entryPath, err)
+				}
+			default:
+				return fmt.Errorf("unexpected error type=%v", entry.Type)
+			}
+		}
+		return nil
+	}
+
+	err = walk(&imgs[len(imgs)-1].DimgHeader().FileEntry, "")
+	if err != nil {
+		return err
+	}
+	for _, h := range hardlinks {
+		err = tw.WriteHeader(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// tarMode converts FileEntry.Mode into the mode of tar header.
+// FileEntry.Mode is os.FileMode for packed directories and the mode of tar header for packed layers.
+func tarMode(mode uint32) int64 {
+	fm := os.FileMode(mode)
+	m := int64(mode & 07777)
+	if fm&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if fm&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if fm&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// unixMode converts FileEntry.Mode into permission bits for chmod(2)
+func unixMode(mode uint32) uint32 {
+	return uint32(tarMode(mode))
+}
+
+// writeChainBody writes the body of entry at filePath in the top of imgs and verifies it.
+func writeChainBody(w io.Writer, baseRootFd int, imgs []*DimgFile, entry *FileEntry, filePath string, pm *bsdiffx.PluginManager) error {
+	digester, err := entry.Digester()
+	if err != nil {
+		return err
+	}
+	out := io.MultiWriter(w, digester.Hash())
+
+	top := len(imgs) - 1
+	// bodies of new files and unchanged files in the base directory are streamed
+	layer, src, err := findChainSource(imgs, top, filePath)
+	if err != nil {
+		return err
+	}
+	if src.Type == FILE_ENTRY_FILE_NEW && src.CompressedSize != 0 {
+		decoder := zstdDecoderPool.Get().(*zstd.Decoder)
+		defer zstdDecoderPool.Put(decoder)
+		err = decoder.Reset(io.NewSectionReader(imgs[layer], src.Offset, src.CompressedSize))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, decoder)
+		if err != nil {
+			return err
+		}
+	} else if src.Type == FILE_ENTRY_FILE_SAME {
+		if baseRootFd < 0 {
+			return fmt.Errorf("base directory is required")
+		}
+		baseFile, err := openFileAt(baseRootFd, filePath, unix.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer baseFile.Close()
+		_, err = io.Copy(out, baseFile)
+		if err != nil {
+			return err
+		}
+	} else if src.Type == FILE_ENTRY_FILE_DIFF {
+		body, err := readChainBody(baseRootFd, imgs, top, filePath, pm)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if digester.Digest() != entry.Digest {
+		return fmt.Errorf("failed to verify digest")
+	}
+	return nil
+}
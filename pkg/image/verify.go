@@ -0,0 +1,197 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/opencontainers/go-digest"
+)
+
+// FullImageResolver opens the full dimg (ParentId == "") of the image id.
+// It returns nil without error if the full image is not available.
+// The caller closes the returned DimgFile.
+type FullImageResolver func(id digest.Digest) (*DimgFile, error)
+
+func readFullBody(img *DimgFile, entry *FileEntry) ([]byte, error) {
+	if entry.Size == 0 || !entry.HasBody() {
+		return []byte{}, nil
+	}
+	return (*bodyCache)(nil).readBody(img, entry)
+}
+
+// verifyMergedDiffs applies merged FILE_DIFF entries to the base image and checks their digests.
+// Broken diffs are re-generated from the full images and appended to spool.
+func verifyMergedDiffs(lowerImgFile, upperImgFile *DimgFile, mergedEntry *FileEntry, written map[*FileEntry]struct{}, spool *os.File, mc MergeConfig, pm *bsdiffx.PluginManager) error {
+	baseId := lowerImgFile.DimgHeader().ParentId
+	targetId := upperImgFile.DimgHeader().Id
+	baseImg, err := mc.FullImages(baseId)
+	if err != nil {
+		return fmt.Errorf("failed to open base image %s: %v", baseId, err)
+	}
+	if baseImg == nil {
+		logger.Warnf("full image for %s not found. merged diffs are not verified", baseId)
+		return nil
+	}
+	defer baseImg.Close()
+
+	// opened at the first broken diff
+	var targetImg *DimgFile
+	defer func() {
+		if targetImg != nil {
+			targetImg.Close()
+		}
+	}()
+
+	verified := map[*FileEntry]struct{}{}
+	brokenNum := 0
+	var walk func(baseEntry, entry *FileEntry, path string) error
+	walk = func(baseEntry, entry *FileEntry, path string) error {
+		for _, name := range sortedChildNames(entry) {
+			child := entry.Childs[name]
+			childPath := filepath.Join(path, name)
+			var baseChild *FileEntry
+			if baseEntry != nil {
+				baseChild = baseEntry.Childs[name]
+			}
+			if child.IsDir() {
+				err := walk(baseChild, child, childPath)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if child.Type != FILE_ENTRY_FILE_DIFF {
+				continue
+			}
+			if _, ok := written[child]; !ok {
+				continue
+			}
+			// entries may be shared among directories
+			if _, ok := verified[child]; ok {
+				continue
+			}
+			verified[child] = struct{}{}
+
+			if baseChild == nil {
+				return fmt.Errorf("base file for %s not found", childPath)
+			}
+			baseBytes, err := readFullBody(baseImg, baseChild)
+			if err != nil {
+				return fmt.Errorf("failed to read base body of %s: %v", childPath, err)
+			}
+
+			diff := make([]byte, child.CompressedSize)
+			_, err = spool.ReadAt(diff, child.Offset)
+			if err != nil {
+				return fmt.Errorf("failed to read diff of %s from spool: %v", childPath, err)
+			}
+			err = verifyDiff(baseBytes, diff, child, pm)
+			if err == nil {
+				continue
+			}
+			brokenNum++
+			logger.Warnf("merged diff for %s is broken: %v. re-diffing from full images", childPath, err)
+
+			if targetImg == nil {
+				targetImg, err = mc.FullImages(targetId)
+				if err != nil {
+					return fmt.Errorf("failed to open target image %s: %v", targetId, err)
+				}
+				if targetImg == nil {
+					return fmt.Errorf("full image for %s not found to re-diff %s", targetId, childPath)
+				}
+			}
+			targetChild, err := targetImg.DimgHeader().FileEntry.Lookup(childPath)
+			if err != nil {
+				return fmt.Errorf("target file for %s not found: %v", childPath, err)
+			}
+			targetBytes, err := readFullBody(targetImg, targetChild)
+			if err != nil {
+				return fmt.Errorf("failed to read target body of %s: %v", childPath, err)
+			}
+
+			p := pm.GetPluginByFile(child.Name, targetBytes)
+			if p == nil {
+				p = pm.GetPluginBySize(child.Size)
+			}
+			diffWriter := new(bytes.Buffer)
+			err = p.Diff(baseBytes, targetBytes, diffWriter, lowerImgFile.DimgHeader().CompressionMode)
+			if err != nil {
+				return fmt.Errorf("failed to re-diff %s: %v", childPath, err)
+			}
+			offset, err := spool.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			child.Offset = offset
+			child.CompressedSize = int64(diffWriter.Len())
+			child.PluginUuid = p.ID()
+			_, err = spool.Write(diffWriter.Bytes())
+			if err != nil {
+				return fmt.Errorf("failed to write to spool: %v", err)
+			}
+		}
+		return nil
+	}
+
+	err = walk(&baseImg.DimgHeader().FileEntry, mergedEntry, "/")
+	if err != nil {
+		return err
+	}
+	logger.Infof("verified %d merged diffs (%d re-diffed)", len(verified), brokenNum)
+
+	return nil
+}
+
+func verifyDiff(baseBytes, diff []byte, entry *FileEntry, pm *bsdiffx.PluginManager) error {
+	p := pm.GetPluginByUuid(entry.PluginUuid)
+	if p == nil {
+		return fmt.Errorf("plugin for %s not found", entry.PluginUuid)
+	}
+	patched, err := p.Patch(baseBytes, bytes.NewBuffer(diff))
+	if err != nil {
+		return fmt.Errorf("failed to patch: %v", err)
+	}
+	return entry.Verify(patched)
+}
+
+// NewFullImageResolver returns FullImageResolver for the full images at paths.
+func NewFullImageResolver(paths []string, isCdimg bool) (FullImageResolver, error) {
+	images := map[digest.Digest]string{}
+	for _, path := range paths {
+		img, err := openDimgOrCdimg(path, isCdimg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		header := img.DimgHeader()
+		img.Close()
+		if header.ParentId != "" {
+			return nil, fmt.Errorf("%s is not a full image (parentId=%s)", path, header.ParentId)
+		}
+		images[header.Id] = path
+	}
+
+	return func(id digest.Digest) (*DimgFile, error) {
+		path, ok := images[id]
+		if !ok {
+			return nil, nil
+		}
+		return openDimgOrCdimg(path, isCdimg)
+	}, nil
+}
+
+func openDimgOrCdimg(path string, isCdimg bool) (*DimgFile, error) {
+	if !isCdimg {
+		return OpenDimgFile(path)
+	}
+	cdimg, err := OpenCdimgFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return cdimg.Dimg, nil
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/bsdiffx"
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenDiffTestDimg rewrites the new file b in the diff as FILE_DIFF whose patch does not change the base
+func brokenDiffTestDimg(t *testing.T, diffDimg string) string {
+	header := dimgHeaderOf(t, diffDimg)
+	b := header.FileEntry.Childs["b"]
+	if b == nil || b.Type != FILE_ENTRY_FILE_NEW {
+		t.Fatalf("unexpected entry for b: %v", b)
+	}
+	// empty chain patch
+	patch := []byte("D4CC\x00")
+	b.Type = FILE_ENTRY_FILE_DIFF
+	b.PluginUuid = bsdiffx.ChainPluginUuid
+	b.Offset = 0
+	b.CompressedSize = int64(len(patch))
+
+	out := &bytes.Buffer{}
+	err := WriteDimg(out, header, bytes.NewBuffer(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "broken.dimg")
+	err = os.WriteFile(path, out.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMergeDimgVerifyError(t *testing.T) {
+	v1 := packTestDir(t, writeTestDir(t, map[string]testFile{
+		"a": {body: "a v1", mode: 0644},
+		"b": {body: "b", mode: 0644},
+	}))
+	v2 := packTestDir(t, writeTestDir(t, map[string]testFile{
+		"a": {body: "a v2", mode: 0644},
+		"b": {body: "b", mode: 0644},
+	}))
+	v3 := packTestDir(t, writeTestDir(t, map[string]testFile{
+		"a": {body: "a v2", mode: 0644},
+		"b": {body: "b v3", mode: 0644},
+	}))
+	lower := diffTestDimg(t, v1, v2)
+	upper := brokenDiffTestDimg(t, diffTestDimg(t, v2, v3))
+
+	// the broken diff is detected but the full image of v3 is not available to re-diff it
+	fullImages, err := NewFullImageResolver([]string{v1}, false)
+	assert.Equal(t, nil, err)
+	mc := MergeConfig{ThreadNum: 4, MergeDimgConcurrentNum: 1, FullImages: fullImages}
+	_, err = MergeDimg(lower, upper, &bytes.Buffer{}, mc, testPluginManager(t))
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "not found to re-diff")
+	}
+
+	_, err = MergeDimg(lower, filepath.Join(t.TempDir(), "missing.dimg"), &bytes.Buffer{}, mc, testPluginManager(t))
+	assert.NotEqual(t, nil, err)
+}
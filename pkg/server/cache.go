@@ -0,0 +1,128 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
+	"github.com/opencontainers/go-digest"
+)
+
+// mergeCache keeps merged dimgs keyed by the source dimgs and the target id.
+// Least recently used dimgs are evicted when the total size exceeds quota.
+type mergeCache struct {
+	dir     string
+	quota   int64
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[digest.Digest]*list.Element
+	size    int64
+}
+
+type mergeCacheEntry struct {
+	key  digest.Digest
+	dimg image.DimgEntry
+	size int64
+}
+
+func newMergeCache(dir string, quota int64) (*mergeCache, error) {
+	// cached dimgs are not indexed across restarts
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove dir %s: %v", dir, err)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %v", dir, err)
+	}
+
+	return &mergeCache{
+		dir:     dir,
+		quota:   quota,
+		lock:    sync.Mutex{},
+		lru:     list.New(),
+		entries: map[digest.Digest]*list.Element{},
+	}, nil
+}
+
+func mergeCacheKey(targetId digest.Digest, sources []digest.Digest) digest.Digest {
+	keys := []string{targetId.String()}
+	for _, s := range sources {
+		keys = append(keys, s.String())
+	}
+	return digest.FromString(strings.Join(keys, "\n"))
+}
+
+// Get returns the cached dimg. The returned entry is a copy.
+func (mc *mergeCache) Get(key digest.Digest) (*image.DimgEntry, bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	elem, ok := mc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	mc.lru.MoveToFront(elem)
+	dimg := elem.Value.(*mergeCacheEntry).dimg
+	return &dimg, true
+}
+
+// Put moves dimg.Path into the cache and returns the cached dimg.
+// If dimg is larger than quota, it is not cached and caller owns dimg.Path.
+func (mc *mergeCache) Put(key digest.Digest, dimg *image.DimgEntry) (*image.DimgEntry, error) {
+	stat, err := os.Stat(dimg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() > mc.quota {
+		logger.Infof("merged dimg %s (size=%d) exceeds cache quota %d", dimg.Path, stat.Size(), mc.quota)
+		return dimg, nil
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if elem, ok := mc.entries[key]; ok {
+		mc.removeElement(elem)
+	}
+
+	cachePath := filepath.Join(mc.dir, key.Encoded()+".dimg")
+	err = os.Rename(dimg.Path, cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename %s to %s: %v", dimg.Path, cachePath, err)
+	}
+	entry := &mergeCacheEntry{
+		key:  key,
+		dimg: *dimg,
+		size: stat.Size(),
+	}
+	entry.dimg.Path = cachePath
+	mc.entries[key] = mc.lru.PushFront(entry)
+	mc.size += entry.size
+
+	for mc.size > mc.quota {
+		mc.removeElement(mc.lru.Back())
+	}
+
+	cached := entry.dimg
+	return &cached, nil
+}
+
+// must be called with mc.lock held
+func (mc *mergeCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*mergeCacheEntry)
+	mc.lru.Remove(elem)
+	delete(mc.entries, entry.key)
+	mc.size -= entry.size
+
+	// opened files can be still read after removal
+	err := os.Remove(entry.dimg.Path)
+	if err != nil {
+		logger.Warnf("failed to remove cached dimg %s: %v", entry.dimg.Path, err)
+	}
+	logger.Infof("evicted merged dimg %s (size=%d)", entry.key, entry.size)
+}
@@ -20,11 +20,7 @@ import (
 
 var logger = log.G(context.TODO())
 
-const imageStorePath = "/tmp/d4c-server/images"
-
-type diffImage struct {
-	dimgId digest.Digest
-}
+const ImageStorePath = "/tmp/d4c-server/images"
 
 type DiffServer struct {
 	mergeConfig image.MergeConfig
@@ -33,18 +29,31 @@ type DiffServer struct {
 	pm          *bsdiffx.PluginManager
 
 	dimgStore *image.DimgStore
-	imageTags map[string]diffImage
+	storeOpts image.DimgStoreOptions
+
+	// merged dimgs are not cached if mergeCacheQuota is 0
+	mergeCacheQuota int64
+	mergeCache      *mergeCache
+
+	verifyMerge bool
+
+	// used if the request does not specify the objective
+	pathObjective image.PathObjective
 }
 
-func NewDiffServer(mc image.MergeConfig, pm *bsdiffx.PluginManager) (*DiffServer, error) {
+func NewDiffServer(mc image.MergeConfig, pm *bsdiffx.PluginManager, mergeCacheQuota int64, verifyMerge bool, pathObjective image.PathObjective, storeOpts image.DimgStoreOptions) (*DiffServer, error) {
 	server := &DiffServer{
-		mergeConfig: mc,
-		serverMux:   http.NewServeMux(),
-		lock:        sync.Mutex{},
-		pm:          pm,
+		mergeConfig:     mc,
+		serverMux:       http.NewServeMux(),
+		lock:            sync.Mutex{},
+		pm:              pm,
+		mergeCacheQuota: mergeCacheQuota,
+		verifyMerge:     verifyMerge,
+		pathObjective:   pathObjective,
+		storeOpts:       storeOpts,
 	}
 
-	err := server.clearAll()
+	err := server.openStore()
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +61,7 @@ func NewDiffServer(mc image.MergeConfig, pm *bsdiffx.PluginManager) (*DiffServer
 	server.serverMux.HandleFunc("/update", server.handleGetUpdateData)
 	server.serverMux.HandleFunc("/diffData/add", server.handlePostDiffData)
 	server.serverMux.HandleFunc("/cleanup", server.handleDeleteAll)
+	server.serverMux.HandleFunc("/gc", server.handleGC)
 
 	return server, nil
 }
@@ -61,18 +71,39 @@ func (ds *DiffServer) ListenAndServe(addr string) error {
 }
 
 func (ds *DiffServer) clearAll() error {
-	err := os.RemoveAll(imageStorePath)
+	if ds.dimgStore != nil {
+		err := ds.dimgStore.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close DimgStore: %v", err)
+		}
+		ds.dimgStore = nil
+	}
+
+	err := os.RemoveAll(ImageStorePath)
 	if err != nil {
-		return fmt.Errorf("failed to remove image store %v: %v", imageStorePath, err)
+		return fmt.Errorf("failed to remove image store %v: %v", ImageStorePath, err)
 	}
 
-	dimgStore, err := image.NewDimgStore(imageStorePath)
+	return ds.openStore()
+}
+
+// openStore opens the image store with dimgs and tags registered before restart.
+func (ds *DiffServer) openStore() error {
+	dimgStore, err := image.NewDimgStore(ImageStorePath, ds.storeOpts)
 	if err != nil {
-		return fmt.Errorf("failed to create DimgStore at %s: %v", imageStorePath, err)
+		return fmt.Errorf("failed to create DimgStore at %s: %v", ImageStorePath, err)
 	}
 
 	ds.dimgStore = dimgStore
-	ds.imageTags = map[string]diffImage{}
+
+	ds.mergeCache = nil
+	if ds.mergeCacheQuota > 0 {
+		cacheDir := filepath.Join(ImageStorePath, "merge-cache")
+		ds.mergeCache, err = newMergeCache(cacheDir, ds.mergeCacheQuota)
+		if err != nil {
+			return fmt.Errorf("failed to create merge cache at %s: %v", cacheDir, err)
+		}
+	}
 
 	return nil
 }
@@ -95,6 +126,46 @@ func (ds *DiffServer) handleDeleteAll(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleGC removes dimgs not required to serve tagged images
+func (ds *DiffServer) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		logger.Errorf("invalid method %s", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	gc, err := image.ParseGCQuery(r.URL.Query())
+	if err != nil {
+		logger.Errorf("invalid request err=%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for _, id := range ds.dimgStore.Tags() {
+		gc.Roots = append(gc.Roots, id)
+	}
+	res, err := ds.dimgStore.GarbageCollect(gc)
+	if err != nil {
+		logger.Errorf("failed to gc: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("gc removed %d dimgs (dryRun=%v freed=%d)", len(res.RemovedDimgs), gc.DryRun, res.FreedBytes)
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		logger.Errorf("failed to marshal json err=%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBytes)
+	if err != nil {
+		logger.Errorf("failed to send response json err=%v", err)
+	}
+}
+
 func (ds *DiffServer) handlePostDiffData(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		logger.Errorf("invalid method %s", r.Method)
@@ -117,7 +188,7 @@ func (ds *DiffServer) handlePostDiffData(w http.ResponseWriter, r *http.Request)
 	}
 	defer cdimgFile.Close()
 
-	dimgPath := filepath.Join(imageStorePath, utils.GetRandomId("temp")+".dimg")
+	dimgPath := filepath.Join(ImageStorePath, utils.GetRandomId("temp")+".dimg")
 	dimgFile, err := os.Create(dimgPath)
 	if err != nil {
 		logger.Errorf("failed to create temporarly dimg file at %s: %v", dimgPath, err)
@@ -148,11 +219,14 @@ func (ds *DiffServer) handlePostDiffData(w http.ResponseWriter, r *http.Request)
 	}
 
 	ds.lock.Lock()
-	ds.imageTags[diffData.ImageTag.String()] = diffImage{
-		dimgId: cdimgFile.Dimg.DimgHeader().Id,
+	err = ds.dimgStore.SetTag(diffData.ImageTag.String(), cdimgFile.Dimg.DimgHeader().Id)
+	ds.lock.Unlock()
+	if err != nil {
+		logger.Errorf("failed to register ImageTag %s: %v", diffData.ImageTag.String(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	logger.Infof("successfully registered ImageTag %s (Id=%s)", diffData.ImageTag.String(), cdimgFile.Dimg.DimgHeader().Id)
-	ds.lock.Unlock()
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -168,7 +242,7 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 	ds.lock.Lock()
 	defer ds.lock.Unlock()
 
-	img, ok := ds.imageTags[req.RequestImage.String()]
+	imgId, ok := ds.dimgStore.GetTag(req.RequestImage.String())
 	if !ok {
 		logger.Errorf("not found digest for %s", req.RequestImage.String())
 		w.WriteHeader(http.StatusBadRequest)
@@ -176,12 +250,22 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 	}
 
 	logger.Infof("client's local dimgs are %v", req.LocalDimgs)
-	logger.Infof("DimgId for requested image %s is %v", req.RequestImage.String(), img)
+	logger.Infof("DimgId for requested image %s is %v", req.RequestImage.String(), imgId)
+
+	objective := ds.pathObjective
+	if req.PathObjective != "" {
+		objective, err = image.GetPathObjective(req.PathObjective)
+		if err != nil {
+			logger.Errorf("invalid path objective %s", req.PathObjective)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
 	req.LocalDimgs = append(req.LocalDimgs, "")
-	selectedDimgPaths, err := ds.dimgStore.GetDimgEntriesWithDimgIds(img.dimgId, req.LocalDimgs)
+	selectedDimgPaths, err := ds.dimgStore.GetDimgEntriesWithObjective(imgId, req.LocalDimgs, objective)
 	if err != nil {
-		logger.Errorf("failed to get dimgs from %v to %v", img.dimgId, req.LocalDimgs)
+		logger.Errorf("failed to get dimgs from %v to %v", imgId, req.LocalDimgs)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -194,15 +278,17 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 	}
 	logger.Infof("Dimgs are sent to client %s", dimgsMsg)
 
-	tmpDir := filepath.Join(imageStorePath, utils.GetRandomId("merge-tmp"))
+	tmpDir := filepath.Join(ImageStorePath, utils.GetRandomId("merge-tmp"))
 	err = os.Mkdir(tmpDir, 0755)
 	if err != nil {
 		logger.Errorf("failed to create temporary directory %s: %v", tmpDir, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	//resDimg, err := image.MergeDimgsWithLinear(selectedDimgPaths, tmpDir, ds.mergeConfig)
-	resDimg, err := image.MergeDimgsWithBisectMultithread(selectedDimgPaths, tmpDir, ds.mergeConfig, false, ds.pm)
+	// the merged dimg is moved to the cache or sent before the removal
+	defer os.RemoveAll(tmpDir)
+
+	resDimg, err := ds.getMergedDimg(imgId, selectedDimgPaths, selectedDimgDigests, tmpDir)
 	if err != nil {
 		logger.Errorf("failed to merge: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -217,9 +303,9 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 	}
 	defer resDimgFile.Close()
 
-	resDimgFileStat, err := os.Stat(resDimg.Path)
+	resDimgSize, err := resDimgFile.Size()
 	if err != nil {
-		logger.Errorf("failed to stats dimg %s: %v", resDimg.Path, err)
+		logger.Errorf("failed to get size of dimg %s: %v", resDimg.Path, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -245,7 +331,7 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = image.WriteCdimgHeader(bytes.NewBuffer(resDimg.ConfigBytes), &resDimg.DimgHeader, resDimgFileStat.Size(), w)
+	err = image.WriteCdimgHeader(bytes.NewBuffer(resDimg.ConfigBytes), &resDimg.DimgHeader, resDimgSize, w)
 	if err != nil {
 		logger.Errorf("failed to cdimg header: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -259,3 +345,40 @@ func (ds *DiffServer) handleGetUpdateData(w http.ResponseWriter, r *http.Request
 	}
 	logger.Infof("update sent")
 }
+
+// getMergedDimg returns the dimg merged from dimgs.
+// Merged dimgs are cached by the target id and the source dimgs.
+func (ds *DiffServer) getMergedDimg(targetId digest.Digest, dimgs []*image.DimgEntry, dimgDigests []digest.Digest, tmpDir string) (*image.DimgEntry, error) {
+	// no need to merge
+	if len(dimgs) == 1 {
+		return dimgs[0], nil
+	}
+
+	key := mergeCacheKey(targetId, dimgDigests)
+	if ds.mergeCache != nil {
+		if cached, ok := ds.mergeCache.Get(key); ok {
+			logger.Infof("merged dimg for %s found in cache", targetId)
+			return cached, nil
+		}
+	}
+
+	//merged, err := image.MergeDimgsWithLinear(dimgs, tmpDir, ds.mergeConfig)
+	mc := ds.mergeConfig
+	if ds.verifyMerge {
+		mc.FullImages = ds.dimgStore.FullImageResolver()
+	}
+	merged, err := image.MergeDimgsWithPlan(dimgs, tmpDir, mc, false, ds.pm)
+	if err != nil {
+		return nil, err
+	}
+
+	if ds.mergeCache == nil {
+		return merged, nil
+	}
+	cached, err := ds.mergeCache.Put(key, merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache merged dimg: %v", err)
+	}
+
+	return cached, nil
+}
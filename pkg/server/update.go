@@ -27,6 +27,8 @@ type DiffData struct {
 type UpdateDataRequest struct {
 	RequestImage ImageTag        `json:"requestImage"`
 	LocalDimgs   []digest.Digest `json:"localDiffs"` // list of DimgHeader.Id
+	// hops, bytes, mergeTime or bytesAndMergeTime. the server's default is used if empty
+	PathObjective string `json:"pathObjective,omitempty"`
 }
 
 type UpdateDataResponse struct {
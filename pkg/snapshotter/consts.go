@@ -5,6 +5,7 @@ import (
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/naoki9911/fuse-diff-containerd/pkg/image"
 	"github.com/naoki9911/fuse-diff-containerd/pkg/utils"
 	"github.com/opencontainers/go-digest"
 )
@@ -20,6 +21,14 @@ const SnapshotLabelMount = "containerd.io/snapshot/di3fs.mount"
 const SnapshotLabelTempDimg = "containerd.io/snapshot/di3fs.tempDimg"
 const NerverGC = "containerd.io/gc.root"
 const TargetSnapshotLabel = "containerd.io/snapshot.ref"
+const AdminSocketPath = "/run/di3fs/admin.sock"
+
+// response of /compact on AdminSocketPath
+type CompactResponse struct {
+	// nil if the chain is already a single dimg
+	Compacted *image.DimgEntry `json:"compacted"`
+	GC        *image.GCResult  `json:"gc"`
+}
 
 func CreateSnapshot(ctx context.Context, ss snapshots.Snapshotter, manifestDigest, dimgId digest.Digest, imageName string, dimgPath string) error {
 	opts := snapshots.WithLabels(map[string]string{